@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"strconv"
+
+	storage "google.golang.org/api/storage/v1"
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ObjectHash calculates CRC32C and MD5 in the same format as the object metadata of GCS.
+type ObjectHash struct {
+	crc32c hash.Hash32
+	md5    hash.Hash
+	size   uint64
+}
+
+func NewObjectHash() *ObjectHash {
+	return &ObjectHash{
+		crc32c: crc32.New(crc32cTable),
+		md5:    md5.New(),
+	}
+}
+
+// HashFile returns the hashes of the file at p.
+func HashFile(p string) (*ObjectHash, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := NewObjectHash()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *ObjectHash) Write(p []byte) (int, error) {
+	h.crc32c.Write(p)
+	h.size += uint64(len(p))
+	return h.md5.Write(p)
+}
+
+func (h *ObjectHash) Crc32c() string {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, h.crc32c.Sum32())
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func (h *ObjectHash) Md5Hash() string {
+	return base64.StdEncoding.EncodeToString(h.md5.Sum(nil))
+}
+
+// Verify compares the size and hashes with the ones of obj. The hash which obj doesn't have is skipped
+// because composite objects don't have MD5.
+func (h *ObjectHash) Verify(url string, obj *storage.Object) error {
+	if h.size != obj.Size {
+		return &ChecksumError{URL: url, Algorithm: "size", Expected: strconv.FormatUint(obj.Size, 10), Actual: strconv.FormatUint(h.size, 10)}
+	}
+	if obj.Crc32c != "" {
+		if actual := h.Crc32c(); actual != obj.Crc32c {
+			return &ChecksumError{URL: url, Algorithm: "CRC32C", Expected: obj.Crc32c, Actual: actual}
+		}
+	}
+	if obj.Md5Hash != "" {
+		if actual := h.Md5Hash(); actual != obj.Md5Hash {
+			return &ChecksumError{URL: url, Algorithm: "MD5", Expected: obj.Md5Hash, Actual: actual}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	storage "google.golang.org/api/storage/v1"
+
+	"github.com/groovenauts/concurrent-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestObjectHash(t *testing.T) {
+	h := NewObjectHash()
+	h.Write([]byte("hello "))
+	h.Write([]byte("world"))
+	assert.Equal(t, "yZRlqg==", h.Crc32c())
+	assert.Equal(t, "XrY7u+Ae7tCTyyK7j1rNww==", h.Md5Hash())
+
+	url := "gs://bucket1/path/to/file1"
+	assert.NoError(t, h.Verify(url, &storage.Object{Size: 11, Crc32c: "yZRlqg==", Md5Hash: "XrY7u+Ae7tCTyyK7j1rNww=="}))
+	// Composite objects don't have MD5
+	assert.NoError(t, h.Verify(url, &storage.Object{Size: 11, Crc32c: "yZRlqg=="}))
+
+	err := h.Verify(url, &storage.Object{Size: 12, Crc32c: "yZRlqg=="})
+	if assert.IsType(t, &ChecksumError{}, err) {
+		assert.Equal(t, "size", err.(*ChecksumError).Algorithm)
+	}
+	err = h.Verify(url, &storage.Object{Size: 11, Crc32c: "AAAAAA=="})
+	if assert.IsType(t, &ChecksumError{}, err) {
+		assert.Equal(t, "CRC32C", err.(*ChecksumError).Algorithm)
+	}
+	err = h.Verify(url, &storage.Object{Size: 11, Md5Hash: "AAAAAAAAAAAAAAAAAAAAAA=="})
+	if assert.IsType(t, &ChecksumError{}, err) {
+		assert.Equal(t, "MD5", err.(*ChecksumError).Algorithm)
+		assert.Regexp(t, "MD5 mismatch for gs://bucket1/path/to/file1", err.Error())
+	}
+}
+
+func TestRetryableFuncWithChecksumError(t *testing.T) {
+	rf := &RetryableFunc{
+		name:     "download",
+		maxTries: 3,
+		interval: 1 * time.Millisecond,
+	}
+
+	tries := 0
+	f := rf.Wrap(func(j *concurrent.Job) error {
+		tries++
+		if tries < 3 {
+			return &ChecksumError{URL: "gs://bucket1/file1", Algorithm: "CRC32C", Expected: "a", Actual: "b"}
+		}
+		return nil
+	})
+	assert.NoError(t, f(&concurrent.Job{}))
+	assert.Equal(t, 3, tries)
+
+	tries = 0
+	f = rf.Wrap(func(j *concurrent.Job) error {
+		tries++
+		return errors.New("always")
+	})
+	assert.Error(t, f(&concurrent.Job{}))
+	assert.Equal(t, 4, tries)
+}
@@ -152,7 +152,7 @@ func (act *CliActions) Download(c *cli.Context) error {
 		}
 		return nil
 	})
-	p := act.newProcess(config)
+	p := act.newStorageProcess(config)
 	files := []interface{}{}
 	for _, arg := range c.Args() {
 		files = append(files, arg)
@@ -212,7 +212,7 @@ func (act *CliActions) Upload(c *cli.Context) error {
 		}
 		return nil
 	})
-	p := act.newProcess(config)
+	p := act.newStorageProcess(config)
 	job := &Job{
 		config:       config.Command,
 		uploads_dir:  c.String(flag_uploads_dir),
@@ -352,6 +352,20 @@ func (act *CliActions) newProcess(config *ProcessConfig) *Process {
 	return p
 }
 
+// newStorageProcess doesn't need the credentials of GCP for the local storage or no_auth.
+func (act *CliActions) newStorageProcess(config *ProcessConfig) *Process {
+	if config.Storage.RequiresGoogleClient() {
+		return act.newProcess(config)
+	}
+	p := &Process{config: config}
+	err := p.setupStorage(nil)
+	if err != nil {
+		fmt.Printf("Error to setup Process cause of %v\n", err)
+		os.Exit(1)
+	}
+	return p
+}
+
 func (act *CliActions) LogConfig(config *ProcessConfig) error {
 	text, err := json.MarshalIndent(config, "", "  ")
 	if err != nil {
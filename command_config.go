@@ -1,11 +1,53 @@
 package main
 
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+var EnvNamePattern = regexp.MustCompile(`\A[A-Za-z_][A-Za-z0-9_]*\z`)
+
 type CommandConfig struct {
-	Template []string            `json:"-"`
-	Options  map[string][]string `json:"options,omitempty"`
-	Dryrun   bool                `json:"dryrun,omitempty"`
+	Template  []string            `json:"-"`
+	Options   map[string][]string `json:"options,omitempty"`
+	Dryrun    bool                `json:"dryrun,omitempty"`
+	Timeout   string              `json:"timeout,omitempty"`
+	KillAfter string              `json:"kill_after,omitempty"`
+	// Env is the environment variables whose values can use the same variables as the command
+	Env map[string]string `json:"env,omitempty"`
+	// AttributesEnvPrefix exports all of the message attributes with the prefix if it's given
+	AttributesEnvPrefix string `json:"attributes_env_prefix,omitempty"`
+	// MessageFiles writes message.json and download_files.json into the workspace
+	MessageFiles bool `json:"message_files,omitempty"`
+
+	timeout   time.Duration
+	killAfter time.Duration
 }
 
 func (c *CommandConfig) setup() *ConfigError {
+	if c.Timeout != "" {
+		d, err := time.ParseDuration(c.Timeout)
+		if err != nil {
+			return &ConfigError{Name: "timeout", Message: fmt.Sprintf("Invalid timeout %q", c.Timeout)}
+		}
+		c.timeout = d
+	}
+	if c.KillAfter == "" {
+		c.KillAfter = "10s"
+	}
+	d, err := time.ParseDuration(c.KillAfter)
+	if err != nil {
+		return &ConfigError{Name: "kill_after", Message: fmt.Sprintf("Invalid kill_after %q", c.KillAfter)}
+	}
+	c.killAfter = d
+	for key := range c.Env {
+		if !EnvNamePattern.MatchString(key) {
+			return &ConfigError{Name: "env", Message: fmt.Sprintf("%q is invalid environment variable name", key)}
+		}
+	}
+	if c.AttributesEnvPrefix != "" && !EnvNamePattern.MatchString(c.AttributesEnvPrefix) {
+		return &ConfigError{Name: "attributes_env_prefix", Message: fmt.Sprintf("%q is invalid environment variable name", c.AttributesEnvPrefix)}
+	}
 	return nil
 }
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/groovenauts/blocks-variable"
+)
+
+// The environment variables given to the command
+const (
+	WorkspaceEnvKey    = "BLOCKS_WORKSPACE"
+	DownloadsDirEnvKey = "BLOCKS_DOWNLOADS_DIR"
+	UploadsDirEnvKey   = "BLOCKS_UPLOADS_DIR"
+	OutboxDirEnvKey    = "BLOCKS_OUTBOX_DIR"
+	MessageIdEnvKey    = "BLOCKS_MESSAGE_ID"
+	ExecUUIDEnvKey     = "BLOCKS_EXEC_UUID"
+	JobIdEnvKey        = "BLOCKS_JOB_ID"
+	ResultFileEnvKey   = "BLOCKS_RESULT_FILE"
+
+	MessageFileEnvKey       = "BLOCKS_MESSAGE_FILE"
+	DownloadFilesFileEnvKey = "BLOCKS_DOWNLOAD_FILES_FILE"
+)
+
+var envNameInvalidChars = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// attributeEnvName returns the name of the environment variable for the attribute key.
+// The characters which can't be used in the name are replaced with `_`.
+func attributeEnvName(prefix, key string) string {
+	return prefix + strings.ToUpper(envNameInvalidChars.ReplaceAllString(key, "_"))
+}
+
+// commandEnv returns the environment of the process with the standard variables of the job
+// including the paths of the message files,
+// the attributes with command/attributes_env_prefix and command/env expanded by v.
+// The later one takes precedence if the same name is given.
+func (job *Job) commandEnv(v *bvariable.Variable) ([]string, error) {
+	env := os.Environ()
+	env = append(env,
+		WorkspaceEnvKey+"="+job.workspace,
+		DownloadsDirEnvKey+"="+job.downloads_dir,
+		UploadsDirEnvKey+"="+job.uploads_dir,
+		OutboxDirEnvKey+"="+job.outbox_dir,
+		MessageIdEnvKey+"="+job.message.MessageId(),
+		ExecUUIDEnvKey+"="+job.execUUID,
+		JobIdEnvKey+"="+job.message.ConcurrentBatchJobId(),
+		ResultFileEnvKey+"="+job.resultFile(),
+	)
+	if job.messageFile != "" {
+		env = append(env,
+			MessageFileEnvKey+"="+job.messageFile,
+			DownloadFilesFileEnvKey+"="+job.downloadFilesFile,
+		)
+	}
+
+	if prefix := job.config.AttributesEnvPrefix; prefix != "" {
+		attrs := job.message.raw.Message.Attributes
+		keys := []string{}
+		for key := range attrs {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			env = append(env, attributeEnvName(prefix, key)+"="+attrs[key])
+		}
+	}
+
+	names := []string{}
+	for name := range job.config.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	errors := []error{}
+	for _, name := range names {
+		value, err := v.Expand(job.config.Env[name])
+		err = job.convertError(err)
+		if err != nil {
+			errors = append(errors, &InvalidJobError{cause: err})
+			continue
+		}
+		env = append(env, name+"="+value)
+	}
+	if len(errors) > 0 {
+		return nil, &CompositeError{errors}
+	}
+	return env, nil
+}
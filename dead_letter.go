@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strconv"
+
+	pubsub "google.golang.org/api/pubsub/v1"
+
+	logrus "github.com/sirupsen/logrus"
+)
+
+type DeadLetter struct {
+	Topic         string
+	MaxDeliveries int
+	// OnAck sends the failed message which is going to be acked regardless of MaxDeliveries
+	OnAck     bool
+	publisher Publisher
+}
+
+const (
+	DeadLetterDeliveriesKey        = "dead_letter.deliveries"
+	DeadLetterErrorKey             = "dead_letter.error"
+	DeadLetterOriginalMessageIdKey = "dead_letter.original_message_id"
+	DeadLetterSubscriptionKey      = "dead_letter.subscription"
+	DeadLetterTopicKey             = "job.dead-letter-topic"
+
+	// Max size of the attribute value
+	DeadLetterErrorMaxSize = 1024
+)
+
+// Required returns true if the failed message must be sent to the dead-letter topic.
+// The message which is going to be acked is sent only with OnAck because it's never delivered again.
+func (dl *DeadLetter) Required(rt ResponseType, deliveries int) bool {
+	if dl == nil || dl.Topic == "" {
+		return false
+	}
+	if rt == ACK && dl.OnAck {
+		return true
+	}
+	return dl.MaxDeliveries > 0 && deliveries >= dl.MaxDeliveries
+}
+
+// Publish sends the original message with the error to the dead-letter topic.
+func (dl *DeadLetter) Publish(msg *JobMessage, deliveries int, cause error) error {
+	attrs := map[string]string{}
+	for k, v := range msg.raw.Message.Attributes {
+		attrs[k] = v
+	}
+	errMsg := []byte(cause.Error())
+	if len(errMsg) > DeadLetterErrorMaxSize {
+		errMsg = errMsg[len(errMsg)-DeadLetterErrorMaxSize:]
+	}
+	attrs[DeadLetterErrorKey] = string(errMsg)
+	attrs[DeadLetterDeliveriesKey] = strconv.Itoa(deliveries)
+	attrs[DeadLetterOriginalMessageIdKey] = msg.MessageId()
+	attrs[DeadLetterSubscriptionKey] = msg.sub
+
+	logAttrs := logrus.Fields{"topic": dl.Topic, "job_message_id": msg.MessageId(), "deliveries": deliveries}
+	m := &pubsub.PubsubMessage{Data: msg.raw.Message.Data, Attributes: attrs}
+	_, err := dl.publisher.Publish(dl.Topic, m)
+	if err != nil {
+		logAttrs["error"] = err
+		msg.logEntry().WithFields(logAttrs).Errorln("Failed to publish the message to dead-letter topic")
+		return err
+	}
+	msg.logEntry().WithFields(logAttrs).Warnln("Published the message to dead-letter topic")
+	return nil
+}
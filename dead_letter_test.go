@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	pubsub "google.golang.org/api/pubsub/v1"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeliveryCounterInMemory(t *testing.T) {
+	dc := &DeliveryCounterInMemory{}
+	for i := 1; i <= 3; i++ {
+		count, err := dc.Increment("msg1")
+		assert.NoError(t, err)
+		assert.Equal(t, i, count)
+	}
+	count, err := dc.Increment("msg2")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	assert.NoError(t, dc.Clear("msg1"))
+	assert.NoError(t, dc.Clear("unknown"))
+	assert.Equal(t, 1, len(dc.counts))
+	count, err = dc.Increment("msg1")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
+
+func TestDeadLetterRequired(t *testing.T) {
+	var nilDL *DeadLetter
+	assert.False(t, nilDL.Required(ACK, 10))
+
+	noTopic := &DeadLetter{MaxDeliveries: 3}
+	assert.False(t, noTopic.Required(NACK, 10))
+
+	dl := &DeadLetter{Topic: "projects/proj1/topics/dead-letter", MaxDeliveries: 3}
+	assert.False(t, dl.Required(ACK, 1))
+	assert.False(t, dl.Required(NACK, 2))
+	assert.True(t, dl.Required(ACK, 3))
+	assert.True(t, dl.Required(NACK, 3))
+	assert.True(t, dl.Required(NONE, 4))
+
+	unlimited := &DeadLetter{Topic: "projects/proj1/topics/dead-letter"}
+	assert.False(t, unlimited.Required(ACK, 1))
+	assert.False(t, unlimited.Required(NACK, 100))
+
+	onAck := &DeadLetter{Topic: "projects/proj1/topics/dead-letter", OnAck: true}
+	assert.True(t, onAck.Required(ACK, 1))
+	assert.False(t, onAck.Required(NACK, 100))
+}
+
+func TestDeadLetterPublish(t *testing.T) {
+	publisher := &DummyPublisher{}
+	dl := &DeadLetter{
+		Topic:         "projects/proj1/topics/dead-letter",
+		MaxDeliveries: 3,
+		publisher:     publisher,
+	}
+	msg := &JobMessage{
+		sub: "projects/proj1/subscriptions/sub1",
+		raw: &pubsub.ReceivedMessage{
+			AckId: "ack1",
+			Message: &pubsub.PubsubMessage{
+				MessageId:  "msg1",
+				Data:       "data1",
+				Attributes: map[string]string{"foo": "bar"},
+			},
+		},
+	}
+
+	cause := fmt.Errorf("%s", strings.Repeat("x", DeadLetterErrorMaxSize)+"tail")
+	err := dl.Publish(msg, 3, cause)
+	assert.NoError(t, err)
+
+	assert.Equal(t, 1, len(publisher.Invocations))
+	inv := publisher.Invocations[0]
+	assert.Equal(t, dl.Topic, inv.Topic)
+	assert.Equal(t, "data1", inv.Message.Data)
+	attrs := inv.Message.Attributes
+	assert.Equal(t, "bar", attrs["foo"])
+	assert.Equal(t, "3", attrs[DeadLetterDeliveriesKey])
+	assert.Equal(t, "msg1", attrs[DeadLetterOriginalMessageIdKey])
+	assert.Equal(t, msg.sub, attrs[DeadLetterSubscriptionKey])
+	assert.Equal(t, DeadLetterErrorMaxSize, len(attrs[DeadLetterErrorKey]))
+	assert.True(t, strings.HasSuffix(attrs[DeadLetterErrorKey], "tail"))
+
+	// The original attributes must not be changed
+	_, ok := msg.raw.Message.Attributes[DeadLetterErrorKey]
+	assert.False(t, ok)
+}
+
+func TestProcessRunWithDeadLetter(t *testing.T) {
+	deadLetterTopic := "projects/proj1/topics/dead-letter"
+	tp := newTestProcess(t, "exit 1\n", nil, func(c *ProcessConfig) {
+		c.Job.ErrorResponseStr = "nack"
+		c.Job.DeadLetterTopic = deadLetterTopic
+		c.Job.MaxDeliveries = 2
+	})
+	defer tp.close()
+
+	tp.add("msg1", map[string]string{})
+	tp.run(nil)
+
+	published := tp.ps.Published(deadLetterTopic)
+	if assert.Equal(t, 1, len(published)) {
+		assert.Equal(t, "2", published[0].Attributes[DeadLetterDeliveriesKey])
+	}
+	// The count is cleared because the message is never delivered again
+	dc, ok := tp.p.deliveryCounter.(*DeliveryCounterInMemory)
+	if assert.True(t, ok) {
+		assert.Equal(t, 0, len(dc.counts))
+	}
+}
+
+type failingDeliveryCounter struct{}
+
+func (dc *failingDeliveryCounter) Increment(msg_id string) (int, error) {
+	return 0, fmt.Errorf("Failed to increment %v", msg_id)
+}
+
+func (dc *failingDeliveryCounter) Clear(msg_id string) error {
+	return fmt.Errorf("Failed to clear %v", msg_id)
+}
+
+func TestProcessCountDeliveriesWithFailure(t *testing.T) {
+	fallback := &DeliveryCounterInMemory{}
+	p := &Process{deliveryCounter: &failingDeliveryCounter{}, deliveryFallback: fallback}
+	newJob := func() *Job {
+		return &Job{message: &JobMessage{raw: &pubsub.ReceivedMessage{Message: &pubsub.PubsubMessage{MessageId: "msg1"}}}}
+	}
+
+	// The deliveries are counted in memory instead of regarded as 0
+	for i := 1; i <= 2; i++ {
+		job := newJob()
+		p.countDeliveries(job)
+		assert.Equal(t, i, job.deliveries)
+		assert.Equal(t, fallback, job.deliveryCounter)
+	}
+}
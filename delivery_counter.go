@@ -0,0 +1,38 @@
+package main
+
+import (
+	"sync"
+)
+
+type (
+	// DeliveryCounter counts how many times each message is delivered.
+	DeliveryCounter interface {
+		Increment(msg_id string) (int, error)
+		// Clear removes the count of the message which is never delivered again.
+		Clear(msg_id string) error
+	}
+
+	// DeliveryCounterInMemory is used when job_check method is none.
+	// The counts are lost when the process stops.
+	DeliveryCounterInMemory struct {
+		counts map[string]int
+		mux    sync.Mutex
+	}
+)
+
+func (dc *DeliveryCounterInMemory) Increment(msg_id string) (int, error) {
+	dc.mux.Lock()
+	defer dc.mux.Unlock()
+	if dc.counts == nil {
+		dc.counts = map[string]int{}
+	}
+	dc.counts[msg_id]++
+	return dc.counts[msg_id], nil
+}
+
+func (dc *DeliveryCounterInMemory) Clear(msg_id string) error {
+	dc.mux.Lock()
+	defer dc.mux.Unlock()
+	delete(dc.counts, msg_id)
+	return nil
+}
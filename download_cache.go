@@ -0,0 +1,312 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	storage "google.golang.org/api/storage/v1"
+
+	logrus "github.com/sirupsen/logrus"
+)
+
+type (
+	// DownloadCache keeps the downloaded files in Dir by the keys of bucket, object, generation and hashes
+	// so that the jobs on the same host download the same object only once.
+	// The files are evicted in least recently used order when the total size exceeds MaxSize.
+	// The cached files are read-only not to be modified through the hard links.
+	DownloadCache struct {
+		Dir     string
+		MaxSize int64
+		// Copy makes the cache copy the files to the destinations instead of hard links.
+		Copy bool
+
+		mux sync.Mutex
+		// fetching has the locks of the cache files being fetched
+		fetching map[string]*sync.Mutex
+	}
+
+	// downloadCacheStamp is written next to the cached file when it's verified.
+	// The file isn't hashed again while its size and modification time are the same.
+	// The modification time of the stamp is the last time when the file was used.
+	downloadCacheStamp struct {
+		Size    int64  `json:"size"`
+		ModTime int64  `json:"mod_time"`
+		Crc32c  string `json:"crc32c"`
+		Md5Hash string `json:"md5_hash"`
+	}
+
+	// CachedStorage downloads the objects through the cache.
+	CachedStorage struct {
+		Storage
+		cache *DownloadCache
+	}
+)
+
+const (
+	DownloadCacheTempSuffix     = ".tmp"
+	DownloadCacheVerifiedSuffix = ".verified"
+)
+
+func (cs *CachedStorage) Download(bucket, object, destPath string) error {
+	return cs.cache.Download(cs.Storage, bucket, object, destPath)
+}
+
+func (c *DownloadCache) path(bucket, object string, obj *storage.Object) string {
+	key := fmt.Sprintf("%s/%s#%d#%s#%s", bucket, object, obj.Generation, obj.Crc32c, obj.Md5Hash)
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(c.Dir, name[:2], name)
+}
+
+// Download puts the file of the object at destPath from the cache.
+// The object is downloaded into the cache by s if the cache doesn't have it.
+func (c *DownloadCache) Download(s Storage, bucket, object, destPath string) error {
+	url := "gs://" + bucket + "/" + object
+	log := log.WithFields(logrus.Fields{"url": url, "destPath": destPath})
+	obj, err := s.Get(bucket, object)
+	if err != nil {
+		return err
+	}
+	if obj == nil || isGzipEncoded(obj) {
+		// Let the storage return the error for the object not found.
+		// The object compressed by gzip isn't cached because the hashes are for the compressed bytes.
+		return s.Download(bucket, object, destPath)
+	}
+
+	p := c.path(bucket, object, obj)
+	if c.lookup(url, p, obj) {
+		log.WithFields(logrus.Fields{"cache": p}).Debugln("Download cache hit")
+	} else {
+		log.WithFields(logrus.Fields{"cache": p}).Debugln("Download cache miss")
+		cached, err := c.fetch(s, url, bucket, object, obj, p)
+		if err != nil {
+			return err
+		}
+		if !cached {
+			// The object was updated after getting its metadata
+			return s.Download(bucket, object, destPath)
+		}
+	}
+	return c.place(p, destPath)
+}
+
+// lookup returns true if the cache has the file which matches obj.
+// The file is hashed only if it was changed after the last verification.
+// The broken file is removed because the hard linked file might be modified.
+func (c *DownloadCache) lookup(url, p string, obj *storage.Object) bool {
+	info, err := os.Stat(p)
+	if err != nil {
+		return false
+	}
+	if !c.verified(p, info, obj) {
+		h, err := HashFile(p)
+		if err == nil {
+			err = h.Verify(url, obj)
+		}
+		if err != nil {
+			log.WithFields(logrus.Fields{"url": url, "cache": p, "error": err}).Warnln("Removing broken download cache")
+			os.Remove(p)
+			os.Remove(p + DownloadCacheVerifiedSuffix)
+			return false
+		}
+		if err := c.writeStamp(p, info, h); err != nil {
+			log.WithFields(logrus.Fields{"cache": p, "error": err}).Warnln("Failed to write download cache stamp")
+		}
+	}
+	now := time.Now()
+	os.Chtimes(p+DownloadCacheVerifiedSuffix, now, now)
+	return true
+}
+
+// verified returns true if the stamp of the file matches info and obj.
+func (c *DownloadCache) verified(p string, info os.FileInfo, obj *storage.Object) bool {
+	data, err := ioutil.ReadFile(p + DownloadCacheVerifiedSuffix)
+	if err != nil {
+		return false
+	}
+	stamp := &downloadCacheStamp{}
+	if err := json.Unmarshal(data, stamp); err != nil {
+		return false
+	}
+	return stamp.Size == info.Size() && stamp.ModTime == info.ModTime().UnixNano() &&
+		stamp.Crc32c == obj.Crc32c && stamp.Md5Hash == obj.Md5Hash
+}
+
+// writeStamp writes the stamp of the file verified by h.
+// It's renamed from the temporary file because the processes can share the cache.
+func (c *DownloadCache) writeStamp(p string, info os.FileInfo, h *ObjectHash) error {
+	data, err := json.Marshal(&downloadCacheStamp{
+		Size:    info.Size(),
+		ModTime: info.ModTime().UnixNano(),
+		Crc32c:  h.Crc32c(),
+		Md5Hash: h.Md5Hash(),
+	})
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(p), filepath.Base(p)+DownloadCacheVerifiedSuffix+DownloadCacheTempSuffix)
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+	_, err = f.Write(data)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, p+DownloadCacheVerifiedSuffix)
+}
+
+// fetch downloads the object into the cache.
+// The temporary file is named after the cache file and kept when the download fails,
+// so that the next try resumes the ranged download by its progress file.
+func (c *DownloadCache) fetch(s Storage, url, bucket, object string, obj *storage.Object, p string) (bool, error) {
+	unlock := c.lockFetch(p)
+	defer unlock()
+	// The other job may have fetched it while waiting for the lock
+	if c.lookup(url, p, obj) {
+		return true, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return false, err
+	}
+	tmp := p + DownloadCacheTempSuffix
+	if err := s.Download(bucket, object, tmp); err != nil {
+		return false, err
+	}
+	h, err := HashFile(tmp)
+	if err != nil {
+		return false, err
+	}
+	if h.Verify(url, obj) != nil {
+		c.removeTemp(tmp)
+		return false, nil
+	}
+	if err := os.Chmod(tmp, 0444); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		c.removeTemp(tmp)
+		return false, err
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		return false, err
+	}
+	if err := c.writeStamp(p, info, h); err != nil {
+		return false, err
+	}
+	c.evict(p)
+	return true, nil
+}
+
+// lockFetch serializes the fetches of the same cache file in the process because they share the temporary file.
+func (c *DownloadCache) lockFetch(p string) func() {
+	c.mux.Lock()
+	if c.fetching == nil {
+		c.fetching = map[string]*sync.Mutex{}
+	}
+	m, ok := c.fetching[p]
+	if !ok {
+		m = &sync.Mutex{}
+		c.fetching[p] = m
+	}
+	c.mux.Unlock()
+	m.Lock()
+	return m.Unlock
+}
+
+func (c *DownloadCache) removeTemp(tmp string) {
+	os.Remove(tmp)
+	os.Remove(tmp + RangedDownloadProgressSuffix)
+}
+
+// place puts the cached file at destPath by hard link or copy.
+func (c *DownloadCache) place(p, destPath string) error {
+	if err := os.Remove(destPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if !c.Copy {
+		err := os.Link(p, destPath)
+		if err == nil {
+			return nil
+		}
+		// The cache dir may be on another file system
+		log.WithFields(logrus.Fields{"cache": p, "destPath": destPath, "error": err}).Debugln("Copying download cache because of failure to link")
+	}
+	src, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	// The copy is writable unlike the cached file
+	dest, err := os.Create(destPath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dest, src); err != nil {
+		dest.Close()
+		return err
+	}
+	return dest.Close()
+}
+
+type downloadCacheEntry struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// evict removes the least recently used files until the total size gets MaxSize or less.
+// The file at keep isn't removed even if it's larger than MaxSize.
+// The files are used in the order of the modification time of their stamps.
+func (c *DownloadCache) evict(keep string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	entries := []*downloadCacheEntry{}
+	var total int64
+	filepath.Walk(c.Dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || strings.Contains(filepath.Base(p), DownloadCacheTempSuffix) ||
+			strings.HasSuffix(p, DownloadCacheVerifiedSuffix) {
+			return nil
+		}
+		modTime := info.ModTime()
+		if stamp, err := os.Stat(p + DownloadCacheVerifiedSuffix); err == nil {
+			modTime = stamp.ModTime()
+		}
+		entries = append(entries, &downloadCacheEntry{path: p, size: info.Size(), modTime: modTime})
+		total += info.Size()
+		return nil
+	})
+	sort.Slice(entries, func(i, j int) bool { return entries[i].modTime.Before(entries[j].modTime) })
+	for _, e := range entries {
+		if total <= c.MaxSize {
+			break
+		}
+		if e.path == keep {
+			continue
+		}
+		if err := os.Remove(e.path); err != nil && !os.IsNotExist(err) {
+			log.WithFields(logrus.Fields{"cache": e.path, "error": err}).Warnln("Failed to evict download cache")
+			continue
+		}
+		os.Remove(e.path + DownloadCacheVerifiedSuffix)
+		log.WithFields(logrus.Fields{"cache": e.path, "size": e.size}).Debugln("Evicted download cache")
+		total -= e.size
+	}
+}
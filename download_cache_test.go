@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	storage "google.golang.org/api/storage/v1"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type countingStorage struct {
+	Storage
+	downloads int
+}
+
+func (cs *countingStorage) Download(bucket, object, destPath string) error {
+	cs.downloads++
+	return cs.Storage.Download(bucket, object, destPath)
+}
+
+func TestDownloadCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "download_cache")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ls := &LocalStorage{Root: filepath.Join(dir, "storage")}
+	upload := func(object, content string) {
+		src := filepath.Join(dir, "src")
+		assert.NoError(t, ioutil.WriteFile(src, []byte(content), 0644))
+		assert.NoError(t, ls.Upload("bucket1", object, src))
+	}
+	upload("model2", "abcdefghij")
+
+	for _, copy := range []bool{false, true} {
+		upload("model1", "0123456789")
+		cacheDir := filepath.Join(dir, "cache")
+		os.RemoveAll(cacheDir)
+		cs := &countingStorage{Storage: ls}
+		s := &CachedStorage{
+			Storage: cs,
+			cache:   &DownloadCache{Dir: cacheDir, MaxSize: 15, Copy: copy},
+		}
+		read := func(p string) string {
+			data, err := ioutil.ReadFile(p)
+			assert.NoError(t, err)
+			return string(data)
+		}
+		dest1 := filepath.Join(dir, "dest1")
+		dest2 := filepath.Join(dir, "dest2")
+
+		// Downloaded only once
+		assert.NoError(t, s.Download("bucket1", "model1", dest1))
+		assert.NoError(t, s.Download("bucket1", "model1", dest2))
+		assert.Equal(t, 1, cs.downloads)
+		assert.Equal(t, "0123456789", read(dest1))
+		assert.Equal(t, "0123456789", read(dest2))
+
+		// The cached file is read-only and it has the verified hashes
+		obj, err := ls.Get("bucket1", "model1")
+		assert.NoError(t, err)
+		cached := s.cache.path("bucket1", "model1", obj)
+		if info, err := os.Stat(cached); assert.NoError(t, err) {
+			assert.Equal(t, os.FileMode(0444), info.Mode().Perm())
+		}
+		assert.Contains(t, read(cached+DownloadCacheVerifiedSuffix), `"md5_hash":"eB5eJF1ptWaXm4bijSPyxw=="`)
+
+		// The broken cache is downloaded again
+		// The command can make the hard linked file writable
+		assert.NoError(t, os.Chmod(dest1, 0644))
+		assert.NoError(t, ioutil.WriteFile(dest1, []byte("9876543210"), 0644))
+		assert.NoError(t, s.Download("bucket1", "model1", dest2))
+		assert.Equal(t, "0123456789", read(dest2))
+		if copy {
+			assert.Equal(t, 1, cs.downloads)
+		} else {
+			assert.Equal(t, 2, cs.downloads)
+		}
+		cs.downloads = 0
+
+		// model1 is evicted because the total size exceeds MaxSize
+		assert.NoError(t, s.Download("bucket1", "model2", dest1))
+		assert.Equal(t, "abcdefghij", read(dest1))
+		assert.NoError(t, s.Download("bucket1", "model1", dest2))
+		assert.Equal(t, 2, cs.downloads)
+
+		// The updated object is downloaded again
+		upload("model1", "updated")
+		assert.NoError(t, s.Download("bucket1", "model1", dest1))
+		assert.Equal(t, "updated", read(dest1))
+		assert.Equal(t, 3, cs.downloads)
+
+		// Not found
+		err = s.Download("bucket1", "unknown", dest1)
+		assert.True(t, IsGoogleApiError(err, 404))
+	}
+}
+
+// interruptedStorage fails the first download after writing the progress file of the ranged download
+type interruptedStorage struct {
+	Storage
+	destPaths []string
+	resumed   bool
+}
+
+func (is *interruptedStorage) Download(bucket, object, destPath string) error {
+	is.destPaths = append(is.destPaths, destPath)
+	if len(is.destPaths) == 1 {
+		if err := ioutil.WriteFile(destPath+RangedDownloadProgressSuffix, []byte("{}"), 0644); err != nil {
+			return err
+		}
+		return fmt.Errorf("Connection reset")
+	}
+	_, err := os.Stat(destPath + RangedDownloadProgressSuffix)
+	is.resumed = err == nil
+	os.Remove(destPath + RangedDownloadProgressSuffix)
+	return is.Storage.Download(bucket, object, destPath)
+}
+
+func TestDownloadCacheResumesFetch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "download_cache")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ls := &LocalStorage{Root: filepath.Join(dir, "storage")}
+	src := filepath.Join(dir, "src")
+	assert.NoError(t, ioutil.WriteFile(src, []byte("0123456789"), 0644))
+	assert.NoError(t, ls.Upload("bucket1", "model1", src))
+
+	is := &interruptedStorage{Storage: ls}
+	s := &CachedStorage{
+		Storage: is,
+		cache:   &DownloadCache{Dir: filepath.Join(dir, "cache"), MaxSize: 100},
+	}
+	dest := filepath.Join(dir, "dest")
+	assert.Error(t, s.Download("bucket1", "model1", dest))
+	assert.NoError(t, s.Download("bucket1", "model1", dest))
+
+	// The second try downloads into the same temporary file with the progress file
+	obj, err := ls.Get("bucket1", "model1")
+	assert.NoError(t, err)
+	cached := s.cache.path("bucket1", "model1", obj)
+	assert.Equal(t, []string{cached + DownloadCacheTempSuffix, cached + DownloadCacheTempSuffix}, is.destPaths)
+	assert.True(t, is.resumed)
+	_, err = os.Stat(cached + DownloadCacheTempSuffix)
+	assert.True(t, os.IsNotExist(err))
+	data, err := ioutil.ReadFile(dest)
+	assert.NoError(t, err)
+	assert.Equal(t, "0123456789", string(data))
+}
+
+// gzipStorage returns the objects with Content-Encoding gzip
+type gzipStorage struct {
+	*countingStorage
+}
+
+func (gs *gzipStorage) Get(bucket, object string) (*storage.Object, error) {
+	obj, err := gs.countingStorage.Get(bucket, object)
+	if obj != nil {
+		obj.ContentEncoding = "gzip"
+	}
+	return obj, err
+}
+
+func TestDownloadCacheWithGzipEncoding(t *testing.T) {
+	dir, err := ioutil.TempDir("", "download_cache")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ls := &LocalStorage{Root: filepath.Join(dir, "storage")}
+	src := filepath.Join(dir, "src")
+	assert.NoError(t, ioutil.WriteFile(src, []byte("0123456789"), 0644))
+	assert.NoError(t, ls.Upload("bucket1", "model1", src))
+
+	cs := &countingStorage{Storage: ls}
+	s := &CachedStorage{
+		Storage: &gzipStorage{cs},
+		cache:   &DownloadCache{Dir: filepath.Join(dir, "cache"), MaxSize: 100},
+	}
+	// Downloaded without the cache every time
+	dest := filepath.Join(dir, "dest")
+	assert.NoError(t, s.Download("bucket1", "model1", dest))
+	assert.NoError(t, s.Download("bucket1", "model1", dest))
+	assert.Equal(t, 2, cs.downloads)
+	_, err = os.Stat(filepath.Join(dir, "cache"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDownloadCacheConfig(t *testing.T) {
+	c := &DownloadConfig{}
+	assert.Nil(t, c.setup())
+	assert.Nil(t, c.DownloadCache())
+
+	c = &DownloadConfig{Cache: &DownloadCacheConfig{Dir: "/tmp/cache"}}
+	assert.Nil(t, c.setup())
+	cache := c.DownloadCache()
+	assert.Equal(t, int64(10*1024*1024*1024), cache.MaxSize)
+	assert.True(t, cache.Copy)
+
+	c = &DownloadConfig{Cache: &DownloadCacheConfig{Dir: "/tmp/cache", Method: DownloadCacheMethodLink}}
+	assert.Nil(t, c.setup())
+	assert.False(t, c.DownloadCache().Copy)
+
+	assert.NotNil(t, (&DownloadConfig{Cache: &DownloadCacheConfig{}}).setup())
+	assert.NotNil(t, (&DownloadConfig{Cache: &DownloadCacheConfig{Dir: "/tmp/cache", Method: "move"}}).setup())
+	assert.NotNil(t, (&DownloadConfig{Cache: &DownloadCacheConfig{Dir: "/tmp/cache", MaxSize: "big"}}).setup())
+}
@@ -1,13 +1,180 @@
 package main
 
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+)
+
 type DownloadConfig struct {
-	Worker            *WorkerConfig `json:"worker,omitempty"`
-	AllowIrregularUrl bool          `json:"allow_irregular_url,omitempty"`
+	Worker            *WorkerConfig        `json:"worker,omitempty"`
+	AllowIrregularUrl bool                 `json:"allow_irregular_url,omitempty"`
+	ChunkSize         string               `json:"chunk_size,omitempty"`
+	ChunksPerFile     int                  `json:"chunks_per_file,omitempty"`
+	Cache             *DownloadCacheConfig `json:"cache,omitempty"`
+	Schemes           []string             `json:"schemes,omitempty"`
+	S3                *S3Config            `json:"s3,omitempty"`
+
+	chunkSize int64
+}
+
+type DownloadCacheConfig struct {
+	Dir     string `json:"dir,omitempty"`
+	MaxSize string `json:"max_size,omitempty"`
+	Method  string `json:"method,omitempty"`
+
+	maxSize int64
+}
+
+const (
+	DownloadCacheMethodLink = "link"
+	DownloadCacheMethodCopy = "copy"
+)
+
+var DownloadCacheMethods = []string{DownloadCacheMethodLink, DownloadCacheMethodCopy}
+
+func (c *DownloadCacheConfig) setup() *ConfigError {
+	if c.Dir == "" {
+		return &ConfigError{Name: "dir", Message: "is required"}
+	}
+	if c.MaxSize == "" {
+		c.MaxSize = "10GiB"
+	}
+	if c.Method == "" {
+		c.Method = DownloadCacheMethodCopy
+	}
+	var err error
+	c.maxSize, err = ParseByteSize(c.MaxSize)
+	if err != nil {
+		return &ConfigError{Name: "max_size", Message: err.Error()}
+	}
+	switch c.Method {
+	case DownloadCacheMethodLink, DownloadCacheMethodCopy:
+	default:
+		return &ConfigError{Name: "method", Message: fmt.Sprintf("%q is invalid. It must be one of %v", c.Method, DownloadCacheMethods)}
+	}
+	return nil
+}
+
+// DownloadCache returns nil if the cache isn't configured.
+func (c *DownloadConfig) DownloadCache() *DownloadCache {
+	if c.Cache == nil {
+		return nil
+	}
+	return &DownloadCache{
+		Dir:     c.Cache.Dir,
+		MaxSize: c.Cache.maxSize,
+		Copy:    c.Cache.Method == DownloadCacheMethodCopy,
+	}
 }
 
 func (c *DownloadConfig) setup() *ConfigError {
 	if c.Worker == nil {
 		c.Worker = &WorkerConfig{}
 	}
+	if c.ChunkSize == "" {
+		c.ChunkSize = "64MiB"
+	}
+	if c.ChunksPerFile < 1 {
+		c.ChunksPerFile = 1
+	}
+	var err error
+	c.chunkSize, err = ParseByteSize(c.ChunkSize)
+	if err != nil {
+		return &ConfigError{Name: "chunk_size", Message: err.Error()}
+	}
+	if c.chunkSize < 1 {
+		return &ConfigError{Name: "chunk_size", Message: "chunk_size must be positive"}
+	}
+	if c.Cache != nil {
+		if err := c.Cache.setup(); err != nil {
+			err.Add("cache")
+			return err
+		}
+	}
+	if len(c.Schemes) == 0 {
+		c.Schemes = DefaultDownloadSchemes
+	}
+	for _, scheme := range c.Schemes {
+		if !c.supports(scheme, DownloadSchemes) {
+			return &ConfigError{Name: "schemes", Message: fmt.Sprintf("%q is invalid. It must be one of %v", scheme, DownloadSchemes)}
+		}
+	}
+	if c.S3 == nil {
+		c.S3 = &S3Config{}
+	}
+	if err := c.S3.setup(); err != nil {
+		err.Add("s3")
+		return err
+	}
 	return c.Worker.setup()
 }
+
+type S3Config struct {
+	Endpoint        string `json:"endpoint,omitempty"`
+	Region          string `json:"region,omitempty"`
+	AccessKeyID     string `json:"access_key_id,omitempty"`
+	SecretAccessKey string `json:"secret_access_key,omitempty"`
+}
+
+func (c *S3Config) setup() *ConfigError {
+	if c.Region == "" {
+		c.Region = FindFromEnv([]string{"AWS_REGION", "AWS_DEFAULT_REGION"})
+	}
+	if c.Region == "" {
+		c.Region = "us-east-1"
+	}
+	if c.AccessKeyID == "" && c.SecretAccessKey == "" {
+		c.AccessKeyID = os.Getenv(AwsAccessKeyIdKey)
+		c.SecretAccessKey = os.Getenv(AwsSecretAccessKeyKey)
+	}
+	if c.AccessKeyID != "" && c.SecretAccessKey == "" {
+		return &ConfigError{Name: "secret_access_key", Message: "is required with access_key_id"}
+	}
+	return nil
+}
+
+// MarshalJSON hides the secret access key from the logs of the config.
+func (c *S3Config) MarshalJSON() ([]byte, error) {
+	type s3Config S3Config
+	masked := s3Config(*c)
+	if masked.SecretAccessKey != "" {
+		masked.SecretAccessKey = "********"
+	}
+	return json.Marshal(&masked)
+}
+
+func (c *DownloadConfig) supports(scheme string, schemes []string) bool {
+	for _, s := range schemes {
+		if s == scheme {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows returns true if the files of the scheme can be downloaded.
+func (c *DownloadConfig) Allows(scheme string) bool {
+	return c.supports(scheme, c.Schemes)
+}
+
+// Downloader returns the downloader for the scheme other than gs.
+func (c *DownloadConfig) Downloader(scheme string) Downloader {
+	switch scheme {
+	case DownloadSchemeHttp, DownloadSchemeHttps:
+		return &HttpDownloader{Client: http.DefaultClient}
+	case DownloadSchemeS3:
+		return &S3Downloader{
+			Endpoint:        c.S3.Endpoint,
+			Region:          c.S3.Region,
+			AccessKeyID:     c.S3.AccessKeyID,
+			SecretAccessKey: c.S3.SecretAccessKey,
+			Client:          http.DefaultClient,
+		}
+	case DownloadSchemeFile:
+		return &FileDownloader{}
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	logrus "github.com/sirupsen/logrus"
+)
+
+// Downloader downloads the files which aren't on GCS.
+type Downloader interface {
+	Download(u *url.URL, destPath string) error
+}
+
+const (
+	DownloadSchemeGs    = "gs"
+	DownloadSchemeHttp  = "http"
+	DownloadSchemeHttps = "https"
+	DownloadSchemeS3    = "s3"
+	DownloadSchemeFile  = "file"
+)
+
+// DownloadSchemes are all of the schemes supported.
+var DownloadSchemes = []string{DownloadSchemeGs, DownloadSchemeHttp, DownloadSchemeHttps, DownloadSchemeS3, DownloadSchemeFile}
+
+// DefaultDownloadSchemes include only gs.
+// The other schemes must be enabled by the config not to let the job message make the host
+// send requests to any server or read any file on the host.
+var DefaultDownloadSchemes = []string{DownloadSchemeGs}
+
+// createDestFile creates the file and writes the body into it with the hashes.
+func createDestFile(destPath string, body io.Reader) (*ObjectHash, error) {
+	dest, err := os.Create(destPath)
+	if err != nil {
+		return nil, err
+	}
+	h := NewObjectHash()
+	if _, err := io.Copy(io.MultiWriter(dest, h), body); err != nil {
+		dest.Close()
+		return nil, err
+	}
+	return h, dest.Close()
+}
+
+// HttpDownloader downloads the file by GET request.
+type HttpDownloader struct {
+	Client *http.Client
+}
+
+func (d *HttpDownloader) Download(u *url.URL, destPath string) error {
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	return downloadResponse(d.Client, req, destPath, nil)
+}
+
+// downloadResponse writes the body of the response into destPath.
+// The size is verified by Content-Length and the MD5 is verified if md5Of returns it.
+func downloadResponse(client *http.Client, req *http.Request, destPath string, md5Of func(*http.Response) string) error {
+	url := req.URL.String()
+	log := log.WithFields(logrus.Fields{"url": url, "destPath": destPath})
+	log.Debugln("Downloading")
+	resp, err := client.Do(req)
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Warnf("Failed to download")
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = &DownloadStatusError{URL: url, StatusCode: resp.StatusCode}
+		log.WithFields(logrus.Fields{"error": err}).Warnf("Failed to download")
+		return err
+	}
+	h, err := createDestFile(destPath, resp.Body)
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Warnf("Failed to write dest file")
+		return err
+	}
+	if resp.ContentLength >= 0 && uint64(resp.ContentLength) != h.size {
+		return &ChecksumError{URL: url, Algorithm: "size", Expected: strconv.FormatInt(resp.ContentLength, 10), Actual: strconv.FormatUint(h.size, 10)}
+	}
+	if md5Of != nil {
+		if expected := md5Of(resp); expected != "" {
+			if actual := h.Md5Hash(); actual != expected {
+				return &ChecksumError{URL: url, Algorithm: "MD5", Expected: expected, Actual: actual}
+			}
+		}
+	}
+	log.Debugln("Download successfully")
+	return nil
+}
+
+// FileDownloader copies the local file of file:///path/to/file.
+type FileDownloader struct{}
+
+func (d *FileDownloader) Download(u *url.URL, destPath string) error {
+	src, err := os.Open(filepath.FromSlash(u.Path))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	_, err = createDestFile(destPath, src)
+	return err
+}
+
+// S3Downloader downloads the object of s3://bucket/key by the request signed with AWS Signature Version 4.
+// The request isn't signed if AccessKeyID is empty.
+type S3Downloader struct {
+	Endpoint        string
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+	Client          *http.Client
+
+	now func() time.Time
+}
+
+func (d *S3Downloader) Download(u *url.URL, destPath string) error {
+	req, err := d.request(u.Host, strings.TrimPrefix(u.Path, "/"))
+	if err != nil {
+		return err
+	}
+	return downloadResponse(d.Client, req, destPath, s3Md5)
+}
+
+// request returns the request by path-style for Endpoint such as MinIO or
+// virtual-hosted style for AWS.
+func (d *S3Downloader) request(bucket, key string) (*http.Request, error) {
+	var rawurl string
+	if d.Endpoint != "" {
+		rawurl = strings.TrimSuffix(d.Endpoint, "/") + "/" + bucket + "/" + s3EscapePath(key)
+	} else {
+		rawurl = fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", bucket, d.Region, s3EscapePath(key))
+	}
+	req, err := http.NewRequest(http.MethodGet, rawurl, nil)
+	if err != nil {
+		return nil, err
+	}
+	if d.AccessKeyID != "" {
+		now := time.Now
+		if d.now != nil {
+			now = d.now
+		}
+		d.sign(req, now().UTC())
+	}
+	return req, nil
+}
+
+// s3Md5 returns the MD5 in the ETag. The ETag of multipart uploaded objects isn't MD5.
+func s3Md5(resp *http.Response) string {
+	etag := strings.Trim(resp.Header.Get("ETag"), `"`)
+	b, err := hex.DecodeString(etag)
+	if err != nil || len(b) != 16 {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+const s3EmptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// sign adds Authorization header for the request without body.
+// See https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (d *S3Downloader) sign(req *http.Request, t time.Time) {
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", s3EmptyPayloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		if lk == "range" || strings.HasPrefix(lk, "x-amz-") {
+			headers[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := []string{}
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, k := range names {
+		canonicalHeaders += k + ":" + headers[k] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		s3EmptyPayloadHash,
+	}, "\n")
+	scope := date + "/" + d.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hexSha256(canonicalRequest),
+	}, "\n")
+
+	key := hmacSha256([]byte("AWS4"+d.SecretAccessKey), date)
+	key = hmacSha256(key, d.Region)
+	key = hmacSha256(key, "s3")
+	key = hmacSha256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		d.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hexSha256(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSha256(key []byte, s string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(s))
+	return m.Sum(nil)
+}
+
+// s3EscapePath escapes the key except `/` by URI encoding of Signature Version 4.
+func s3EscapePath(key string) string {
+	var b bytes.Buffer
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -18,3 +18,11 @@ var (
 	GcpProjectId = FindFromEnv([]string{"GCP_PROJECT_ID", "GCP_PROJECT", "PROJECT_ID", "PROJECT"})
 	Pipeline     = FindFromEnv([]string{"PIPELINE"})
 )
+
+const (
+	PubsubEmulatorHostKey  = "PUBSUB_EMULATOR_HOST"
+	StorageEmulatorHostKey = "STORAGE_EMULATOR_HOST"
+
+	AwsAccessKeyIdKey     = "AWS_ACCESS_KEY_ID"
+	AwsSecretAccessKeyKey = "AWS_SECRET_ACCESS_KEY"
+)
@@ -5,6 +5,7 @@ import (
 	"reflect"
 	"sort"
 	"strings"
+	"time"
 )
 
 type (
@@ -79,6 +80,66 @@ func (e *CompositeError) Any(f func(error) bool) bool {
 	return false
 }
 
+type (
+	CommandError struct {
+		ExitCode int // -1 if the command didn't exit normally
+		cause    error
+		output   string
+	}
+)
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("[%T] %v\noutput:\n%s", e.cause, e.cause.Error(), e.output)
+}
+
+type (
+	CommandTimeoutError struct {
+		Timeout time.Duration
+		output  string
+	}
+)
+
+func (e *CommandTimeoutError) Error() string {
+	return fmt.Sprintf("Command timed out after %v\noutput:\n%s", e.Timeout, e.output)
+}
+
+type (
+	// ChecksumError is retryable because the file may be broken while transferring.
+	ChecksumError struct {
+		URL       string
+		Algorithm string
+		Expected  string
+		Actual    string
+	}
+)
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("%s mismatch for %s expected %s but was %s", e.Algorithm, e.URL, e.Expected, e.Actual)
+}
+
+type (
+	// ObjectExistsError is returned when the object isn't uploaded because it already exists.
+	ObjectExistsError struct {
+		URL string
+	}
+)
+
+func (e *ObjectExistsError) Error() string {
+	return fmt.Sprintf("%s already exists", e.URL)
+}
+
+type (
+	// DownloadStatusError is returned when the server responds with the status other than 200 OK.
+	DownloadStatusError struct {
+		URL        string
+		StatusCode int
+	}
+)
+
+func (e *DownloadStatusError) Error() string {
+	return fmt.Sprintf("Failed to download %s with status %d", e.URL, e.StatusCode)
+}
+
 type ConfigError struct {
 	Name      string
 	Ancestors []string
@@ -103,3 +164,14 @@ func (e *ConfigError) Error() string {
 }
 
 type ConfigSetup func() *ConfigError
+
+type (
+	// TransferCancelledError is returned when the download or upload is cancelled because the job was interrupted.
+	TransferCancelledError struct {
+		Name string
+	}
+)
+
+func (e *TransferCancelledError) Error() string {
+	return fmt.Sprintf("Cancelled to %s because the job was interrupted", e.Name)
+}
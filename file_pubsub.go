@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	pubsub "google.golang.org/api/pubsub/v1"
+
+	logrus "github.com/sirupsen/logrus"
+)
+
+type (
+	// FilePubsub is a Puller and Publisher without network.
+	// It delivers the messages loaded from a JSONL file to any subscription
+	// and appends the published messages to another JSONL file.
+	// The messages are redelivered when the ack deadline passes or
+	// ModifyAckDeadline is called with 0 like Cloud Pub/Sub.
+	FilePubsub struct {
+		AckDeadline time.Duration
+
+		// output is the file path to write published messages. Nothing is written if it's blank.
+		output string
+
+		messages  []*filePubsubMessage
+		acks      map[string]*filePubsubMessage
+		published []*FilePubsubPublished
+		lastId    int
+		mux       sync.Mutex
+
+		// now is replaced in tests
+		now func() time.Time
+	}
+
+	filePubsubMessage struct {
+		message    *pubsub.PubsubMessage
+		ackId      string
+		deadline   time.Time
+		deliveries int
+	}
+
+	// FilePubsubPublished is a line of the output file.
+	FilePubsubPublished struct {
+		Topic       string            `json:"topic"`
+		Attributes  map[string]string `json:"attributes,omitempty"`
+		Data        string            `json:"data,omitempty"`
+		MessageId   string            `json:"messageId"`
+		PublishTime string            `json:"publishTime"`
+	}
+)
+
+// LoadFilePubsub reads the messages from input in the same format as the message file of exec command.
+func LoadFilePubsub(input, output string, ackDeadline time.Duration) (*FilePubsub, error) {
+	ps := &FilePubsub{AckDeadline: ackDeadline, output: output}
+	if input == "" {
+		return ps, nil
+	}
+	f, err := os.Open(input)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 10*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		msg := &pubsub.PubsubMessage{}
+		err := json.Unmarshal(scanner.Bytes(), msg)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse line %d of %s because of %v", line, input, err)
+		}
+		ps.Add(msg)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ps, nil
+}
+
+func (ps *FilePubsub) currentTime() time.Time {
+	if ps.now != nil {
+		return ps.now()
+	}
+	return time.Now()
+}
+
+func (ps *FilePubsub) nextId() string {
+	ps.lastId++
+	return strconv.Itoa(ps.lastId)
+}
+
+// Add makes msg delivered by Pull.
+func (ps *FilePubsub) Add(msg *pubsub.PubsubMessage) {
+	ps.mux.Lock()
+	defer ps.mux.Unlock()
+	if msg.MessageId == "" {
+		msg.MessageId = ps.nextId()
+	}
+	if msg.PublishTime == "" {
+		msg.PublishTime = ps.currentTime().Format(time.RFC3339)
+	}
+	ps.messages = append(ps.messages, &filePubsubMessage{message: msg})
+}
+
+// Remaining returns the number of messages which aren't acknowledged yet.
+func (ps *FilePubsub) Remaining() int {
+	ps.mux.Lock()
+	defer ps.mux.Unlock()
+	return len(ps.messages)
+}
+
+func (ps *FilePubsub) Pull(subscription string, pullrequest *pubsub.PullRequest) (*pubsub.PullResponse, error) {
+	ps.mux.Lock()
+	defer ps.mux.Unlock()
+
+	now := ps.currentTime()
+	res := &pubsub.PullResponse{}
+	for _, m := range ps.messages {
+		if pullrequest.MaxMessages > 0 && int64(len(res.ReceivedMessages)) >= pullrequest.MaxMessages {
+			break
+		}
+		if m.ackId != "" && now.Before(m.deadline) {
+			continue
+		}
+		if m.ackId != "" {
+			delete(ps.acks, m.ackId)
+		}
+		if ps.acks == nil {
+			ps.acks = map[string]*filePubsubMessage{}
+		}
+		m.ackId = "ack-" + m.message.MessageId + "-" + ps.nextId()
+		m.deadline = now.Add(ps.AckDeadline)
+		m.deliveries++
+		ps.acks[m.ackId] = m
+		log.WithFields(logrus.Fields{"subscription": subscription, "message_id": m.message.MessageId, "deliveries": m.deliveries}).Debugln("FilePubsub delivering message")
+
+		// Copy the message not to share the attributes which are modified by the job
+		attrs := map[string]string{}
+		for k, v := range m.message.Attributes {
+			attrs[k] = v
+		}
+		msg := *m.message
+		msg.Attributes = attrs
+		res.ReceivedMessages = append(res.ReceivedMessages, &pubsub.ReceivedMessage{AckId: m.ackId, Message: &msg})
+	}
+	return res, nil
+}
+
+// Acknowledge ignores the ackId expired like Cloud Pub/Sub.
+func (ps *FilePubsub) Acknowledge(subscription, ackId string) (*pubsub.Empty, error) {
+	ps.mux.Lock()
+	defer ps.mux.Unlock()
+
+	m, ok := ps.validMessage(ackId)
+	if !ok {
+		log.WithFields(logrus.Fields{"subscription": subscription, "ack_id": ackId}).Warnln("FilePubsub ignored expired ackId")
+		return &pubsub.Empty{}, nil
+	}
+	delete(ps.acks, ackId)
+	for i, msg := range ps.messages {
+		if msg == m {
+			ps.messages = append(ps.messages[:i], ps.messages[i+1:]...)
+			break
+		}
+	}
+	return &pubsub.Empty{}, nil
+}
+
+func (ps *FilePubsub) ModifyAckDeadline(subscription string, ackIds []string, ackDeadlineSeconds int64) (*pubsub.Empty, error) {
+	ps.mux.Lock()
+	defer ps.mux.Unlock()
+
+	deadline := ps.currentTime().Add(time.Duration(ackDeadlineSeconds) * time.Second)
+	for _, ackId := range ackIds {
+		m, ok := ps.validMessage(ackId)
+		if !ok {
+			log.WithFields(logrus.Fields{"subscription": subscription, "ack_id": ackId}).Warnln("FilePubsub ignored expired ackId")
+			continue
+		}
+		m.deadline = deadline
+	}
+	return &pubsub.Empty{}, nil
+}
+
+func (ps *FilePubsub) validMessage(ackId string) (*filePubsubMessage, bool) {
+	m, ok := ps.acks[ackId]
+	if !ok || m.ackId != ackId || !ps.currentTime().Before(m.deadline) {
+		return nil, false
+	}
+	return m, true
+}
+
+func (ps *FilePubsub) Get(subscription string) (*pubsub.Subscription, error) {
+	return &pubsub.Subscription{
+		Name:               subscription,
+		AckDeadlineSeconds: int64(ps.AckDeadline / time.Second),
+	}, nil
+}
+
+func (ps *FilePubsub) Publish(topic string, msg *pubsub.PubsubMessage) (*pubsub.PublishResponse, error) {
+	ps.mux.Lock()
+	defer ps.mux.Unlock()
+
+	p := &FilePubsubPublished{
+		Topic:       topic,
+		Attributes:  msg.Attributes,
+		Data:        msg.Data,
+		MessageId:   "published-" + ps.nextId(),
+		PublishTime: ps.currentTime().Format(time.RFC3339),
+	}
+	if ps.output != "" {
+		if err := ps.write(p); err != nil {
+			log.WithFields(logrus.Fields{"topic": topic, "output": ps.output, "error": err}).Errorln("FilePubsub failed to write published message")
+			return nil, err
+		}
+	}
+	ps.published = append(ps.published, p)
+	return &pubsub.PublishResponse{MessageIds: []string{p.MessageId}}, nil
+}
+
+// Published returns the messages published to topic.
+func (ps *FilePubsub) Published(topic string) []*FilePubsubPublished {
+	ps.mux.Lock()
+	defer ps.mux.Unlock()
+	res := []*FilePubsubPublished{}
+	for _, p := range ps.published {
+		if p.Topic == topic {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+func (ps *FilePubsub) write(p *FilePubsubPublished) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(ps.output, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	pubsub "google.golang.org/api/pubsub/v1"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilePubsubPullAndAck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file-pubsub")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	input := filepath.Join(dir, "messages.jsonl")
+	output := filepath.Join(dir, "published.jsonl")
+	lines := []string{
+		`{"messageId":"msg1","attributes":{"foo":"1"},"data":"data1"}`,
+		``,
+		`{"attributes":{"foo":"2"}}`,
+	}
+	assert.NoError(t, ioutil.WriteFile(input, []byte(strings.Join(lines, "\n")), 0644))
+
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	ps, err := LoadFilePubsub(input, output, 10*time.Second)
+	assert.NoError(t, err)
+	ps.now = func() time.Time { return now }
+	assert.Equal(t, 2, ps.Remaining())
+
+	sub := "projects/proj1/subscriptions/sub1"
+	s, err := ps.Get(sub)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), s.AckDeadlineSeconds)
+
+	res, err := ps.Pull(sub, &pubsub.PullRequest{MaxMessages: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(res.ReceivedMessages))
+	msg1 := res.ReceivedMessages[0]
+	assert.Equal(t, "msg1", msg1.Message.MessageId)
+	assert.Equal(t, "data1", msg1.Message.Data)
+
+	res, err = ps.Pull(sub, &pubsub.PullRequest{MaxMessages: 5})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(res.ReceivedMessages))
+	msg2 := res.ReceivedMessages[0]
+	assert.NotEqual(t, "", msg2.Message.MessageId)
+	assert.Equal(t, "2", msg2.Message.Attributes["foo"])
+
+	// No message is available until the deadline
+	res, err = ps.Pull(sub, &pubsub.PullRequest{MaxMessages: 5})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(res.ReceivedMessages))
+
+	// Extend the deadline of msg1
+	now = now.Add(5 * time.Second)
+	_, err = ps.ModifyAckDeadline(sub, []string{msg1.AckId}, 30)
+	assert.NoError(t, err)
+
+	// msg2 is redelivered after the deadline
+	now = now.Add(6 * time.Second)
+	res, err = ps.Pull(sub, &pubsub.PullRequest{MaxMessages: 5})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(res.ReceivedMessages))
+	assert.Equal(t, msg2.Message.MessageId, res.ReceivedMessages[0].Message.MessageId)
+	assert.NotEqual(t, msg2.AckId, res.ReceivedMessages[0].AckId)
+
+	// The expired ackId is ignored
+	_, err = ps.Acknowledge(sub, msg2.AckId)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, ps.Remaining())
+
+	// Nack makes the message delivered again
+	msg2 = res.ReceivedMessages[0]
+	_, err = ps.ModifyAckDeadline(sub, []string{msg2.AckId}, 0)
+	assert.NoError(t, err)
+	res, err = ps.Pull(sub, &pubsub.PullRequest{MaxMessages: 5})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(res.ReceivedMessages))
+	msg2 = res.ReceivedMessages[0]
+
+	_, err = ps.Acknowledge(sub, msg1.AckId)
+	assert.NoError(t, err)
+	_, err = ps.Acknowledge(sub, msg2.AckId)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, ps.Remaining())
+}
+
+func TestFilePubsubPublish(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file-pubsub")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	output := filepath.Join(dir, "published.jsonl")
+	ps, err := LoadFilePubsub("", output, 10*time.Second)
+	assert.NoError(t, err)
+
+	topic := "projects/proj1/topics/topic1"
+	for _, v := range []string{"1", "2"} {
+		_, err := ps.Publish(topic, &pubsub.PubsubMessage{Attributes: map[string]string{"foo": v}})
+		assert.NoError(t, err)
+	}
+	_, err = ps.Publish("projects/proj1/topics/topic2", &pubsub.PubsubMessage{Data: "bar"})
+	assert.NoError(t, err)
+
+	published := ps.Published(topic)
+	assert.Equal(t, 2, len(published))
+	assert.Equal(t, "1", published[0].Attributes["foo"])
+	assert.Equal(t, "2", published[1].Attributes["foo"])
+
+	data, err := ioutil.ReadFile(output)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Equal(t, 3, len(lines))
+	assert.Regexp(t, `"topic":"projects/proj1/topics/topic2"`, lines[2])
+}
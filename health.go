@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	pubsub "google.golang.org/api/pubsub/v1"
+	storage "google.golang.org/api/storage/v1"
+)
+
+// LoopState is the state of the pull loop in JobSubscription.listen.
+type LoopState string
+
+const (
+	LoopStarting        LoopState = "starting"
+	LoopWaitingForSlots LoopState = "waiting_for_slots"
+	LoopPulling         LoopState = "pulling"
+	LoopSleeping        LoopState = "sleeping"
+	LoopStopped         LoopState = "stopped"
+	LoopFailed          LoopState = "failed"
+)
+
+const (
+	HealthServicePubsub  = "pubsub"
+	HealthServiceStorage = "storage"
+)
+
+type (
+	// Health keeps the state of the pull loop, the running jobs and the last calls to
+	// Pub/Sub and GCS. All of the methods do nothing if it's nil.
+	Health struct {
+		StallTimeout time.Duration
+
+		mux          sync.Mutex
+		loopState    LoopState
+		loopSince    time.Time
+		lastPulledAt time.Time
+		jobs         map[string]*HealthJob
+		calls        map[string]*HealthCall
+
+		now func() time.Time
+	}
+
+	HealthJob struct {
+		MessageId string    `json:"message_id"`
+		ExecUUID  string    `json:"exec_uuid"`
+		Step      string    `json:"step"`
+		Since     time.Time `json:"since"`
+	}
+
+	HealthCall struct {
+		At    time.Time `json:"at"`
+		Error string    `json:"error,omitempty"`
+	}
+
+	HealthStatus struct {
+		Alive        bool                   `json:"alive"`
+		Ready        bool                   `json:"ready"`
+		Loop         LoopState              `json:"loop"`
+		LoopSince    time.Time              `json:"loop_since"`
+		LastPulledAt *time.Time             `json:"last_pulled_at,omitempty"`
+		Jobs         []*HealthJob           `json:"jobs"`
+		Calls        map[string]*HealthCall `json:"calls"`
+	}
+)
+
+func NewHealth(stallTimeout time.Duration) *Health {
+	h := &Health{
+		StallTimeout: stallTimeout,
+		jobs:         map[string]*HealthJob{},
+		calls:        map[string]*HealthCall{},
+		now:          time.Now,
+	}
+	h.loopState = LoopStarting
+	h.loopSince = h.now()
+	return h
+}
+
+func (h *Health) LoopChanged(state LoopState) {
+	if h == nil {
+		return
+	}
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if h.loopState != state {
+		h.loopState = state
+		h.loopSince = h.now()
+	}
+}
+
+func (h *Health) Pulled() {
+	if h == nil {
+		return
+	}
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.lastPulledAt = h.now()
+}
+
+func (h *Health) JobStepStarted(execUUID, messageId string, step JobStep) {
+	if h == nil {
+		return
+	}
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.jobs[execUUID] = &HealthJob{MessageId: messageId, ExecUUID: execUUID, Step: step.String(), Since: h.now()}
+}
+
+func (h *Health) JobFinished(execUUID string) {
+	if h == nil {
+		return
+	}
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	delete(h.jobs, execUUID)
+}
+
+// Called records the result of the call to the service.
+func (h *Health) Called(service string, err error) {
+	if h == nil {
+		return
+	}
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	c := &HealthCall{At: h.now()}
+	if err != nil {
+		c.Error = err.Error()
+	}
+	h.calls[service] = c
+}
+
+// Status returns the current status.
+// The process is alive unless the pull loop failed or it stays in the same state longer than StallTimeout
+// except waiting for the running jobs.
+// The process is ready if it's alive, the pull loop is running and the last calls to the services succeeded.
+func (h *Health) Status() *HealthStatus {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	st := &HealthStatus{
+		Loop:      h.loopState,
+		LoopSince: h.loopSince,
+		Jobs:      []*HealthJob{},
+		Calls:     map[string]*HealthCall{},
+	}
+	if !h.lastPulledAt.IsZero() {
+		t := h.lastPulledAt
+		st.LastPulledAt = &t
+	}
+	for _, j := range h.jobs {
+		job := *j
+		st.Jobs = append(st.Jobs, &job)
+	}
+	sort.Slice(st.Jobs, func(i, j int) bool { return st.Jobs[i].Since.Before(st.Jobs[j].Since) })
+
+	succeeded := true
+	for service, c := range h.calls {
+		call := *c
+		st.Calls[service] = &call
+		if c.Error != "" {
+			succeeded = false
+		}
+	}
+
+	switch h.loopState {
+	case LoopFailed:
+		st.Alive = false
+	case LoopWaitingForSlots, LoopStopped:
+		st.Alive = true
+	default:
+		st.Alive = h.now().Sub(h.loopSince) <= h.StallTimeout
+	}
+	running := h.loopState != LoopStarting && h.loopState != LoopStopped
+	st.Ready = st.Alive && running && succeeded
+	return st
+}
+
+// LivenessHandler returns the handler for /healthz which responds 503 if the process isn't alive.
+func (h *Health) LivenessHandler() http.Handler {
+	return h.handler(func(st *HealthStatus) bool { return st.Alive })
+}
+
+// ReadinessHandler returns the handler for /readyz which responds 503 if the process isn't ready.
+func (h *Health) ReadinessHandler() http.Handler {
+	return h.handler(func(st *HealthStatus) bool { return st.Ready })
+}
+
+func (h *Health) handler(ok func(*HealthStatus) bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		st := h.Status()
+		w.Header().Set("Content-Type", "application/json")
+		if !ok(st) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(st)
+	})
+}
+
+// HealthPuller records the results of the calls to Pub/Sub by Impl.
+type HealthPuller struct {
+	Impl   Puller
+	health *Health
+}
+
+func (hp *HealthPuller) Pull(subscription string, pullrequest *pubsub.PullRequest) (*pubsub.PullResponse, error) {
+	res, err := hp.Impl.Pull(subscription, pullrequest)
+	hp.health.Called(HealthServicePubsub, err)
+	return res, err
+}
+
+func (hp *HealthPuller) Acknowledge(subscription, ackId string) (*pubsub.Empty, error) {
+	res, err := hp.Impl.Acknowledge(subscription, ackId)
+	hp.health.Called(HealthServicePubsub, err)
+	return res, err
+}
+
+func (hp *HealthPuller) ModifyAckDeadline(subscription string, ackIds []string, ackDeadlineSeconds int64) (*pubsub.Empty, error) {
+	res, err := hp.Impl.ModifyAckDeadline(subscription, ackIds, ackDeadlineSeconds)
+	hp.health.Called(HealthServicePubsub, err)
+	return res, err
+}
+
+func (hp *HealthPuller) Get(subscription string) (*pubsub.Subscription, error) {
+	res, err := hp.Impl.Get(subscription)
+	hp.health.Called(HealthServicePubsub, err)
+	return res, err
+}
+
+// HealthPublisher records the results of the calls to Pub/Sub by Impl.
+type HealthPublisher struct {
+	Impl   Publisher
+	health *Health
+}
+
+func (hp *HealthPublisher) Publish(topic string, msg *pubsub.PubsubMessage) (*pubsub.PublishResponse, error) {
+	res, err := hp.Impl.Publish(topic, msg)
+	hp.health.Called(HealthServicePubsub, err)
+	return res, err
+}
+
+// HealthStorage records the results of the calls to the storage.
+type HealthStorage struct {
+	Storage
+	health *Health
+}
+
+func (hs *HealthStorage) Download(bucket, object, destPath string) error {
+	err := hs.Storage.Download(bucket, object, destPath)
+	hs.health.Called(HealthServiceStorage, err)
+	return err
+}
+
+func (hs *HealthStorage) Upload(bucket, object, srcPath string) error {
+	err := hs.Storage.Upload(bucket, object, srcPath)
+	hs.health.Called(HealthServiceStorage, err)
+	return err
+}
+
+func (hs *HealthStorage) UploadObject(bucket string, obj *storage.Object, srcPath string, opts *UploadOptions) error {
+	err := hs.Storage.UploadObject(bucket, obj, srcPath, opts)
+	if _, ok := err.(*ObjectExistsError); ok {
+		// The object which exists by no_clobber isn't a failure of the storage
+		hs.health.Called(HealthServiceStorage, nil)
+	} else {
+		hs.health.Called(HealthServiceStorage, err)
+	}
+	return err
+}
+
+func (hs *HealthStorage) Get(bucket, object string) (*storage.Object, error) {
+	res, err := hs.Storage.Get(bucket, object)
+	hs.health.Called(HealthServiceStorage, err)
+	return res, err
+}
+
+func (hs *HealthStorage) Delete(bucket, object string) error {
+	err := hs.Storage.Delete(bucket, object)
+	hs.health.Called(HealthServiceStorage, err)
+	return err
+}
+
+func (hs *HealthStorage) Update(bucket, object string, body *storage.Object) (*storage.Object, error) {
+	res, err := hs.Storage.Update(bucket, object, body)
+	hs.health.Called(HealthServiceStorage, err)
+	return res, err
+}
+
+func (hs *HealthStorage) CreateEmptyFile(bucket, object string) (*storage.Object, error) {
+	res, err := hs.Storage.CreateEmptyFile(bucket, object)
+	hs.health.Called(HealthServiceStorage, err)
+	return res, err
+}
+
+func (hs *HealthStorage) List(bucket, prefix string) ([]*storage.Object, error) {
+	res, err := hs.Storage.List(bucket, prefix)
+	hs.health.Called(HealthServiceStorage, err)
+	return res, err
+}
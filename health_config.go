@@ -0,0 +1,30 @@
+package main
+
+import (
+	"time"
+)
+
+type HealthConfig struct {
+	Listen string `json:"listen,omitempty"`
+	// StallTimeout is the seconds which the pull loop can stay in the same state
+	StallTimeout int `json:"stall_timeout,omitempty"`
+}
+
+func (c *HealthConfig) setup() *ConfigError {
+	if c.StallTimeout == 0 {
+		c.StallTimeout = 600
+	}
+	if c.StallTimeout < 0 {
+		return &ConfigError{Name: "stall_timeout", Message: "stall_timeout must be positive"}
+	}
+	return nil
+}
+
+// Enabled returns true if the health endpoints are given.
+func (c *HealthConfig) Enabled() bool {
+	return c.Listen != ""
+}
+
+func (c *HealthConfig) stallTimeout() time.Duration {
+	return time.Duration(c.StallTimeout) * time.Second
+}
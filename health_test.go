@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	pubsub "google.golang.org/api/pubsub/v1"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthStatus(t *testing.T) {
+	now := time.Date(2018, 4, 1, 12, 0, 0, 0, time.UTC)
+	h := NewHealth(time.Minute)
+	h.now = func() time.Time { return now }
+	h.LoopChanged(LoopStarting)
+
+	st := h.Status()
+	assert.True(t, st.Alive)
+	assert.False(t, st.Ready)
+	assert.Nil(t, st.LastPulledAt)
+
+	h.LoopChanged(LoopPulling)
+	h.Pulled()
+	h.Called(HealthServicePubsub, nil)
+	st = h.Status()
+	assert.True(t, st.Alive)
+	assert.True(t, st.Ready)
+	assert.Equal(t, now, *st.LastPulledAt)
+
+	// Running jobs
+	h.JobStepStarted("uuid1", "msg1", DOWNLOADING)
+	h.JobStepStarted("uuid1", "msg1", EXECUTING)
+	st = h.Status()
+	if assert.Equal(t, 1, len(st.Jobs)) {
+		assert.Equal(t, &HealthJob{MessageId: "msg1", ExecUUID: "uuid1", Step: "EXECUTING", Since: now}, st.Jobs[0])
+	}
+	h.JobFinished("uuid1")
+	assert.Equal(t, 0, len(h.Status().Jobs))
+
+	// The last call failed
+	h.Called(HealthServiceStorage, errors.New("unavailable"))
+	st = h.Status()
+	assert.True(t, st.Alive)
+	assert.False(t, st.Ready)
+	assert.Equal(t, "unavailable", st.Calls[HealthServiceStorage].Error)
+	h.Called(HealthServiceStorage, nil)
+	assert.True(t, h.Status().Ready)
+
+	// Stalled pull loop
+	now = now.Add(2 * time.Minute)
+	st = h.Status()
+	assert.False(t, st.Alive)
+	assert.False(t, st.Ready)
+
+	// Waiting for the running jobs isn't stalled
+	h.LoopChanged(LoopWaitingForSlots)
+	now = now.Add(time.Hour)
+	st = h.Status()
+	assert.True(t, st.Alive)
+	assert.True(t, st.Ready)
+
+	h.LoopChanged(LoopStopped)
+	st = h.Status()
+	assert.True(t, st.Alive)
+	assert.False(t, st.Ready)
+
+	h.LoopChanged(LoopFailed)
+	st = h.Status()
+	assert.False(t, st.Alive)
+	assert.False(t, st.Ready)
+}
+
+func TestHealthHandlers(t *testing.T) {
+	h := NewHealth(time.Minute)
+	h.LoopChanged(LoopSleeping)
+	h.JobStepStarted("uuid1", "msg1", UPLOADING)
+
+	get := func(handler http.Handler) (int, *HealthStatus) {
+		server := httptest.NewServer(handler)
+		defer server.Close()
+		resp, err := server.Client().Get(server.URL)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+		st := &HealthStatus{}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(st))
+		return resp.StatusCode, st
+	}
+
+	code, st := get(h.LivenessHandler())
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, LoopSleeping, st.Loop)
+	if assert.Equal(t, 1, len(st.Jobs)) {
+		assert.Equal(t, "UPLOADING", st.Jobs[0].Step)
+	}
+	code, _ = get(h.ReadinessHandler())
+	assert.Equal(t, http.StatusOK, code)
+
+	h.Called(HealthServicePubsub, errors.New("unavailable"))
+	code, _ = get(h.LivenessHandler())
+	assert.Equal(t, http.StatusOK, code)
+	code, st = get(h.ReadinessHandler())
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "unavailable", st.Calls[HealthServicePubsub].Error)
+}
+
+func TestHealthNil(t *testing.T) {
+	var h *Health
+	h.LoopChanged(LoopPulling)
+	h.Pulled()
+	h.JobStepStarted("uuid1", "msg1", EXECUTING)
+	h.JobFinished("uuid1")
+	h.Called(HealthServicePubsub, nil)
+}
+
+type DummyPullerForHealth struct {
+	DummyPullerForJobSubscription
+	err error
+}
+
+func (p *DummyPullerForHealth) Pull(subscription string, pullrequest *pubsub.PullRequest) (*pubsub.PullResponse, error) {
+	return &pubsub.PullResponse{}, p.err
+}
+
+func TestHealthJobSubscription(t *testing.T) {
+	h := NewHealth(time.Minute)
+	puller := &DummyPullerForHealth{}
+	s := &JobSubscription{
+		config: &JobSubscriptionConfig{Subscription: "projects/proj1/subscriptions/sub1", PullInterval: 1},
+		puller: &HealthPuller{Impl: puller, health: h},
+		health: h,
+	}
+
+	executed, err := s.process(func(*JobMessage) error { return nil })
+	assert.NoError(t, err)
+	assert.False(t, executed)
+	st := h.Status()
+	assert.Equal(t, LoopPulling, st.Loop)
+	assert.NotNil(t, st.LastPulledAt)
+	assert.Equal(t, "", st.Calls[HealthServicePubsub].Error)
+	assert.True(t, st.Ready)
+
+	puller.err = errors.New("unavailable")
+	err = s.listen(func(*JobMessage) error { return nil })
+	assert.Error(t, err)
+	st = h.Status()
+	assert.Equal(t, LoopFailed, st.Loop)
+	assert.Equal(t, "unavailable", st.Calls[HealthServicePubsub].Error)
+	assert.False(t, st.Alive)
+
+	s = &JobSubscription{config: s.config, puller: s.puller, health: h}
+	s.stop()
+	assert.NoError(t, s.listen(func(*JobMessage) error { return nil }))
+	assert.Equal(t, LoopStopped, h.Status().Loop)
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -12,13 +14,21 @@ import (
 	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/groovenauts/blocks-variable"
 	"github.com/groovenauts/concurrent-go"
 	"github.com/satori/go.uuid"
 
+	"golang.org/x/net/context"
+
+	storage "google.golang.org/api/storage/v1"
+
 	logrus "github.com/sirupsen/logrus"
 )
 
@@ -82,6 +92,7 @@ type Job struct {
 	workspace     string
 	downloads_dir string
 	uploads_dir   string
+	outbox_dir    string
 
 	// These are set at setupDownloadFiles
 	downloadFileMap     map[string]string
@@ -91,53 +102,220 @@ type Job struct {
 	// This is set at setupExecUUID
 	execUUID string
 
+	// This is set at execute if the command writes result.json
+	result *JobResult
+
+	// These are set at writeMessageFiles
+	messageFile       string
+	downloadFilesFile string
+
 	outputBuffer *bytes.Buffer
 
-	IntervalOnError int // seconds
-	ErrorResponse   ResponseType
+	IntervalOnError   int // seconds
+	ErrorResponse     ResponseType
+	TimeoutResponse   ResponseType
+	ExitCodeResponses map[string]ResponseType
+
+	// This is set at downloadFiles if the manifest is uploaded
+	downloadResults []*DownloadResult
+	downloadMux     sync.Mutex
+
+	// This is set at execute when the command exits
+	exitCode *int
+
+	// This is set at uploadFiles
+	uploadResults []*UploadResult
+	uploadMux     sync.Mutex
+
+	// This is set at build from the options key of the command
+	optionKey string
+
+	metrics *Metrics
+	health  *Health
+
+	tracing *Tracing
+	// These are the contexts of the spans of the job and the running step
+	traceCtx context.Context
+	stepCtx  context.Context
+
+	deadLetter *DeadLetter
+
+	// outbox publishes the messages in outbox_dir after uploading
+	outbox         *Outbox
+	publishResults []*PublishResult
+
+	// The number of deliveries of the message including this time
+	deliveries int
+	// deliveryCounter clears the count when the message is acked
+	deliveryCounter DeliveryCounter
 
 	cmd *exec.Cmd
+
+	// This is set at build from the config or the message attribute
+	timeout time.Duration
+
+	// These are set at signal to stop the job
+	interrupted   bool
+	interruptedBy os.Signal
+	cmdFinished   bool
+	cmdMux        sync.Mutex
+
+	// cancel is closed at interrupt to stop the downloads and uploads
+	cancel chan struct{}
+
+	// log is the logger with the fields of the job. The global log is used if it's nil.
+	log *logrus.Entry
 }
 
 const (
-	StartTimeKey  = "job.start-time"
-	FinishTimeKey = "job.finish-time"
+	StartTimeKey      = "job.start-time"
+	FinishTimeKey     = "job.finish-time"
+	ExitCodeKey       = "job.exit-code"
+	ResponseKey       = "job.response"
+	CommandTimeoutKey = "command.timeout"
 )
 
+func (job *Job) logEntry() *logrus.Entry {
+	if job.log != nil {
+		return job.log
+	}
+	return log
+}
+
 func (job *Job) run() error {
+	log := job.logEntry()
 	log.Debugln("Job.run start")
 	defer log.Debugln("Job.run done")
 
 	job.message.raw.Message.Attributes[StartTimeKey] = time.Now().Format(time.RFC3339)
 
+	span := job.startTrace()
+	defer span.End()
 	defer job.withNotify(CLEANUP, job.clearWorkspace)() // Call clearWorkspace even if job.prepare retuns error
 	err := job.withNotify(INITIALIZING, job.prepare)()
 
-	reaction := job.message.Ack
+	rt := ACK
 
 	if err == nil {
 		err = job.runWithoutErrorHandling()
 		if err != nil {
-			reaction = job.ErrorResponse.ResponseMethod(job)
-			time.Sleep(time.Duration(job.IntervalOnError) * time.Second)
+			if e, ok := err.(*CommandError); ok && e.ExitCode >= 0 {
+				job.message.raw.Message.Attributes[ExitCodeKey] = strconv.Itoa(e.ExitCode)
+			}
+			rt = job.responseFor(err)
+			if !job.isInterrupted() {
+				time.Sleep(time.Duration(job.IntervalOnError) * time.Second)
+			}
+		}
+		if r := job.responseByResult(rt, err); r != rt {
+			log.WithFields(logrus.Fields{"response": r, "original_response": rt}).Infoln("Response changed by result file")
+			rt = r
+			job.message.raw.Message.Attributes[ResponseKey] = rt.String()
 		}
 	}
+	if err != nil {
+		rt = job.sendToDeadLetterIfRequired(rt, err)
+		job.message.raw.Message.Attributes[ResponseKey] = rt.String()
+		log.WithFields(logrus.Fields{"response": rt}).Debugln("Response for the error")
+	}
+	reaction := job.reactionFor(rt)
 
 	job.message.raw.Message.Attributes[FinishTimeKey] = time.Now().Format(time.RFC3339)
-	var step JobStep
-	if err != nil {
-		step = CANCELLING
-	} else {
-		step = ACKSENDING
+	job.uploadManifest(rt, err)
+	setSpanError(span, err)
+	span.SetAttribute("job.response", rt.String())
+	step := stepFor(rt, err)
+	sig := job.interruptedSignal()
+	interrupted := err != nil && sig != nil
+	if interrupted {
+		job.message.raw.Message.Attributes["interrupted"] = "true"
+		job.message.raw.Message.Attributes["signal"] = sig.String()
 	}
-	e := job.withNotify(step, reaction)()
+	respond := func() (map[string]string, string, error) {
+		finish := job.startStep(step)
+		err := reaction()
+		finish(err)
+		attrs, msg := job.resultSummary()
+		if interrupted {
+			msg = fmt.Sprintf("Job was interrupted by %v", sig)
+		}
+		return attrs, msg, err
+	}
+	e := job.notification.wrapWithSummary(job.message.MessageId(), step, job.message.raw.Message.Attributes, respond)()
 	if e != nil {
 		return e
 	}
+	job.metrics.MessageResponded(job.optionKey, rt)
+	if rt == ACK {
+		job.clearDeliveries()
+	}
 	return nil
 }
 
+// clearDeliveries clears the delivery count of the message acked or sent to the dead-letter topic
+// because it's never delivered again.
+func (job *Job) clearDeliveries() {
+	if job.deliveryCounter == nil {
+		return
+	}
+	if err := job.deliveryCounter.Clear(job.message.MessageId()); err != nil {
+		job.logEntry().WithFields(logrus.Fields{"error": err}).Warnln("Failed to clear the delivery count")
+	}
+}
+
+// stepFor returns the step to respond to the message by rt.
+// The failed job is always CANCELLING, and the job which succeeded is NACKSENDING
+// only if result.json declared nack.
+func stepFor(rt ResponseType, err error) JobStep {
+	switch {
+	case err != nil:
+		return CANCELLING
+	case rt == ACK:
+		return ACKSENDING
+	case rt == NACK:
+		return NACKSENDING
+	default:
+		return CANCELLING
+	}
+}
+
+func (job *Job) responseFor(err error) ResponseType {
+	if job.isInterrupted() {
+		// The message must be delivered again because the job was interrupted by the signal
+		return NACK
+	}
+	switch e := err.(type) {
+	case *OutboxError:
+		// The message must be delivered again not to lose the follow-up messages
+		return NACK
+	case *CommandTimeoutError:
+		return job.TimeoutResponse
+	case *CommandError:
+		if rt, ok := job.ExitCodeResponses[strconv.Itoa(e.ExitCode)]; ok {
+			return rt
+		}
+		if rt, ok := job.ExitCodeResponses[DefaultExitCodeResponseKey]; ok {
+			return rt
+		}
+	}
+	return job.ErrorResponse
+}
+
+// sendToDeadLetterIfRequired returns ACK if the message is sent to the dead-letter topic.
+func (job *Job) sendToDeadLetterIfRequired(rt ResponseType, cause error) ResponseType {
+	if job.isInterrupted() || !job.deadLetter.Required(rt, job.deliveries) {
+		return rt
+	}
+	err := job.deadLetter.Publish(job.message, job.deliveries, cause)
+	if err != nil {
+		return rt
+	}
+	job.message.raw.Message.Attributes[DeadLetterTopicKey] = job.deadLetter.Topic
+	return ACK
+}
+
 func (job *Job) runWithoutErrorHandling() error {
+	log := job.logEntry()
 	log.Debugln("Job.runWithoutErrorHandling start")
 	defer log.Debugln("Job.runWithoutErrorHandling done")
 
@@ -154,20 +332,106 @@ func (job *Job) runWithoutErrorHandling() error {
 		return err
 	}
 
-	err = job.withNotify(UPLOADING, job.uploadFiles)()
+	upload := func() (map[string]string, string, error) {
+		finish := job.startStep(UPLOADING)
+		summary, detail, err := job.uploadFilesWithSummary()
+		finish(err)
+		return summary, detail, err
+	}
+	err = job.notification.wrapWithSummary(job.message.MessageId(), UPLOADING, job.message.raw.Message.Attributes, upload)()
 	if err != nil {
 		return err
 	}
 
+	files, err := job.outboxFiles()
+	if err != nil {
+		return err
+	}
+	if len(files) > 0 && job.responseByResult(ACK, nil) != ACK {
+		// The follow-up messages would be published again when the job message is delivered again
+		log.WithFields(logrus.Fields{"files": len(files)}).Infoln("Skipped publishing the outbox because the response isn't ack")
+	} else if len(files) > 0 {
+		publish := func() (map[string]string, string, error) {
+			finish := job.startStep(PUBLISHING)
+			summary, detail, err := job.publishOutbox(files)
+			finish(err)
+			return summary, detail, err
+		}
+		err = job.notification.wrapWithSummary(job.message.MessageId(), PUBLISHING, job.message.raw.Message.Attributes, publish)()
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
 func (job *Job) withNotify(step JobStep, f func() error) func() error {
-	return job.notification.wrap(job.message.MessageId(), step, job.message.raw.Message.Attributes, f)
+	return job.notification.wrap(job.message.MessageId(), step, job.message.raw.Message.Attributes, job.observe(step, f))
+}
+
+// observe records the step of the job for the health, the metrics and the tracing.
+func (job *Job) observe(step JobStep, f func() error) func() error {
+	return func() error {
+		finish := job.startStep(step)
+		err := f()
+		finish(err)
+		return err
+	}
+}
+
+// startStep records the start of the step and returns the function to record its finish.
+func (job *Job) startStep(step JobStep) func(error) {
+	job.health.JobStepStarted(job.execUUID, job.message.MessageId(), step)
+	ctx, span := job.tracing.Start(job.traceContext(), step.String(), nil)
+	job.stepCtx = ctx
+	started := time.Now()
+	return func(err error) {
+		job.metrics.StepFinished(job.optionKey, step, time.Since(started), err)
+		endSpan(span, err)
+		job.stepCtx = nil
+	}
+}
+
+// startTrace starts the span of the job which continues the trace given by traceparent attribute.
+func (job *Job) startTrace() *Span {
+	parent := traceContextFromAttributes(job.message.raw.Message.Attributes)
+	ctx, span := job.tracing.Start(parent, "Job.run", map[string]interface{}{
+		"job.message_id": job.message.MessageId(),
+		"job.exec_uuid":  job.execUUID,
+	})
+	if span != nil {
+		span.Kind = SpanKindConsumer
+	}
+	job.traceCtx = ctx
+	return span
+}
+
+func (job *Job) traceContext() context.Context {
+	if job.traceCtx != nil {
+		return job.traceCtx
+	}
+	return context.Background()
+}
+
+// stepContext returns the context of the span of the running step for its child spans.
+func (job *Job) stepContext() context.Context {
+	if job.stepCtx != nil {
+		return job.stepCtx
+	}
+	return job.traceContext()
+}
+
+func (job *Job) startTargetSpan(name string, t *Target) *Span {
+	_, span := job.tracing.Start(job.stepContext(), name, map[string]interface{}{
+		"target.url":        t.URL(),
+		"target.local_path": t.LocalPath,
+	})
+	return span
 }
 
 func (job *Job) prepare() error {
-	log := log.WithFields(logrus.Fields{"job_message_id": job.message.MessageId()})
+	log := job.logEntry().WithFields(logrus.Fields{"job_message_id": job.message.MessageId()})
 	err := job.message.Validate()
 	if err != nil {
 		logAttrs := logrus.Fields{
@@ -196,6 +460,11 @@ func (job *Job) prepare() error {
 		return err
 	}
 
+	err = job.writeMessageFiles()
+	if err != nil {
+		return err
+	}
+
 	err = job.build()
 	if err != nil {
 		logAttrs := logrus.Fields{
@@ -220,13 +489,14 @@ func (job *Job) setupWorkspace() error {
 		var err error
 		dir, err = ioutil.TempDir("", "workspace")
 		if err != nil {
-			log.Fatal(err)
+			job.logEntry().Fatal(err)
 			return err
 		}
 	}
 	subdirs := []string{
 		filepath.Join(dir, "downloads"),
 		filepath.Join(dir, "uploads"),
+		filepath.Join(dir, "outbox"),
 	}
 	for _, subdir := range subdirs {
 		err := os.MkdirAll(subdir, 0700)
@@ -237,6 +507,7 @@ func (job *Job) setupWorkspace() error {
 	job.workspace = dir
 	job.downloads_dir = subdirs[0]
 	job.uploads_dir = subdirs[1]
+	job.outbox_dir = subdirs[2]
 	return nil
 }
 
@@ -252,6 +523,7 @@ const UseDataAsAttributesKey = "use-data-as-attributes"
 var UseDataAsAttributesRegexp = regexp.MustCompile("(?i)true|yes|on|1")
 
 func (job *Job) useDataAsAttributesIfPossible() error {
+	log := job.logEntry()
 	attrs := job.message.raw.Message.Attributes
 	flg := attrs[UseDataAsAttributesKey]
 	if !UseDataAsAttributesRegexp.MatchString(flg) {
@@ -290,6 +562,12 @@ func (job *Job) useDataAsAttributesIfPossible() error {
 }
 
 func (job *Job) setupDownloadFiles() error {
+	log := job.logEntry()
+	expanded, err := job.expandDownloadFiles(job.remoteDownloadFiles)
+	if err != nil {
+		return err
+	}
+	job.remoteDownloadFiles = expanded
 	job.downloadFileMap = map[string]string{}
 	objects := job.flatten(job.remoteDownloadFiles)
 	remoteUrls := []string{}
@@ -310,14 +588,122 @@ func (job *Job) setupDownloadFiles() error {
 			log.WithFields(logrus.Fields{"url": remote_url}).Errorln("Invalid download file URL")
 			return err
 		}
+		if job.downloadConfig != nil && !job.downloadConfig.Allows(url.Scheme) {
+			msg := fmt.Sprintf("Unsupported scheme %q of download file %s. It must be one of %v", url.Scheme, remote_url, job.downloadConfig.Schemes)
+			log.Errorln(msg)
+			return &InvalidJobError{msg: msg}
+		}
 		urlstr := fmt.Sprintf("gs://%v%v", url.Host, url.Path)
 		destPath := filepath.Join(job.downloads_dir, url.Host, url.Path)
+		if url.Scheme != DownloadSchemeGs && url.Scheme != "" {
+			// Keep the query of HTTP
+			urlstr = remote_url
+			if url.RawQuery != "" {
+				// The URLs which differ only in the query are downloaded to the different files
+				destPath = filepath.Join(job.downloads_dir, url.Host, queryDir(url.RawQuery), url.Path)
+			}
+		}
 		job.downloadFileMap[urlstr] = destPath
 	}
 	job.localDownloadFiles = job.copyWithFileMap(job.remoteDownloadFiles)
 	return nil
 }
 
+// queryDir returns the name of the directory for the files downloaded by the URLs with the query.
+func queryDir(rawQuery string) string {
+	sum := sha256.Sum256([]byte(rawQuery))
+	return "query-" + hex.EncodeToString(sum[:])[:8]
+}
+
+// DownloadFilesWildcardPattern matches the URLs which have a wildcard.
+var DownloadFilesWildcardPattern = regexp.MustCompile(`[*?\[]`)
+
+// expandDownloadFiles replaces the URLs which end with "/" or have wildcards
+// with the lists of the URLs of the objects found.
+func (job *Job) expandDownloadFiles(obj interface{}) (interface{}, error) {
+	switch obj.(type) {
+	case map[string]interface{}:
+		result := map[string]interface{}{}
+		for k, v := range obj.(map[string]interface{}) {
+			r, err := job.expandDownloadFiles(v)
+			if err != nil {
+				return nil, err
+			}
+			result[k] = r
+		}
+		return result, nil
+	case []interface{}:
+		result := []interface{}{}
+		for _, v := range obj.([]interface{}) {
+			r, err := job.expandDownloadFiles(v)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, r)
+		}
+		return result, nil
+	case string:
+		s := obj.(string)
+		// Only the objects on GCS can be listed
+		if !strings.HasPrefix(s, DownloadSchemeGs+"://") {
+			return s, nil
+		}
+		if !strings.HasSuffix(s, "/") && !DownloadFilesWildcardPattern.MatchString(s) {
+			return s, nil
+		}
+		return job.listDownloadFiles(s)
+	default:
+		return obj, nil
+	}
+}
+
+func (job *Job) listDownloadFiles(remoteUrl string) ([]interface{}, error) {
+	log := job.logEntry().WithFields(logrus.Fields{"url": remoteUrl})
+	url, err := job.parseUrl(remoteUrl)
+	if err != nil {
+		log.Errorln("Invalid download file URL")
+		return nil, err
+	}
+	if job.storage == nil {
+		return nil, &InvalidJobError{msg: fmt.Sprintf("No storage to list %s", remoteUrl)}
+	}
+	// The path of gs://bucket/ is "/"
+	pattern := strings.TrimPrefix(url.Path, "/")
+	prefix := pattern
+	if loc := DownloadFilesWildcardPattern.FindStringIndex(pattern); loc != nil {
+		prefix = pattern[:loc[0]]
+	} else {
+		pattern = ""
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, &InvalidJobError{msg: fmt.Sprintf("Invalid wildcard %s", remoteUrl), cause: err}
+	}
+
+	objs, err := job.storage.List(url.Host, prefix)
+	if err != nil {
+		return nil, err
+	}
+	result := []interface{}{}
+	for _, obj := range objs {
+		// Skip the placeholders of directories
+		if strings.HasSuffix(obj.Name, "/") {
+			continue
+		}
+		if pattern != "" {
+			matched, _ := path.Match(pattern, obj.Name)
+			if !matched {
+				continue
+			}
+		}
+		result = append(result, fmt.Sprintf("gs://%s/%s", url.Host, obj.Name))
+	}
+	if len(result) == 0 {
+		return nil, &InvalidJobError{msg: fmt.Sprintf("No object matches %s", remoteUrl)}
+	}
+	log.WithFields(logrus.Fields{"objects": len(result)}).Debugln("Download files expanded")
+	return result, nil
+}
+
 func (job *Job) copyWithFileMap(obj interface{}) interface{} {
 	switch obj.(type) {
 	case map[string]interface{}:
@@ -340,22 +726,34 @@ func (job *Job) copyWithFileMap(obj interface{}) interface{} {
 }
 
 func (job *Job) buildVariable() *bvariable.Variable {
-	return &bvariable.Variable{
+	v := &bvariable.Variable{
 		Data: map[string]interface{}{
 			"workspace":             job.workspace,
 			"downloads_dir":         job.downloads_dir,
 			"uploads_dir":           job.uploads_dir,
+			"outbox_dir":            job.outbox_dir,
 			"download_files":        job.localDownloadFiles,
 			"local_download_files":  job.localDownloadFiles,
 			"remote_download_files": job.remoteDownloadFiles,
 			"attrs":                 job.message.raw.Message.Attributes,
 			"attributes":            job.message.raw.Message.Attributes,
 			"data":                  job.message.raw.Message.Data,
+			"message_id":            job.message.raw.Message.MessageId,
+			"exec_uuid":             job.execUUID,
 		},
 	}
+	if job.workspace != "" {
+		v.Data["result_file"] = job.resultFile()
+	}
+	if job.messageFile != "" {
+		v.Data["message_file"] = job.messageFile
+		v.Data["download_files_file"] = job.downloadFilesFile
+	}
+	return v
 }
 
 func (job *Job) build() error {
+	log := job.logEntry()
 	v := job.buildVariable()
 	values, err := job.extract(v, job.config.Template)
 	if len(job.config.Options) > 0 {
@@ -385,6 +783,7 @@ func (job *Job) build() error {
 		if key == "" {
 			key = "default"
 		}
+		job.optionKey = key
 		t := job.config.Options[key]
 		log = log.WithFields(logrus.Fields{
 			"options_key":      key,
@@ -408,6 +807,11 @@ func (job *Job) build() error {
 			return err
 		}
 	}
+	err = job.setupTimeout()
+	if err != nil {
+		return err
+	}
+
 	job.outputBuffer = &bytes.Buffer{}
 	w := &LogrusWriter{Dest: log, Severity: job.commandSeverityLevel}
 	w.Setup()
@@ -415,11 +819,40 @@ func (job *Job) build() error {
 	cmd := exec.Command(values[0], values[1:]...)
 	cmd.Stdout = out
 	cmd.Stderr = out
+	cmd.Env, err = job.commandEnv(v)
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Errorln("env extract error")
+		return err
+	}
+	// Run the command in its own process group to send signals to its children too
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 	job.cmd = cmd
 	log.WithFields(logrus.Fields{"job.cmd": job.cmd}).Debugln("Job#build has done")
 	return nil
 }
 
+func (job *Job) setupTimeout() error {
+	job.timeout = job.config.timeout
+	str, ok := job.message.raw.Message.Attributes[CommandTimeoutKey]
+	if !ok || str == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(str)
+	if err != nil {
+		msg := fmt.Sprintf("Invalid %s attribute: %q", CommandTimeoutKey, str)
+		job.logEntry().WithFields(logrus.Fields{"error": err}).Errorln(msg)
+		return &InvalidJobError{msg: msg, cause: err}
+	}
+	// The timeout must not be disabled by the message
+	if d <= 0 {
+		msg := fmt.Sprintf("Invalid %s attribute: %q must be positive", CommandTimeoutKey, str)
+		job.logEntry().Errorln(msg)
+		return &InvalidJobError{msg: msg}
+	}
+	job.timeout = d
+	return nil
+}
+
 func (job *Job) extract(v *bvariable.Variable, values []string) ([]string, error) {
 	result := []string{}
 	errors := []error{}
@@ -452,6 +885,8 @@ func (job *Job) convertError(src error) error {
 }
 
 func (job *Job) downloadFiles() error {
+	log := job.logEntry()
+	job.downloadResults = nil
 	targets := []*Target{}
 	for remoteURL, destPath := range job.downloadFileMap {
 		url, err := job.parseUrl(remoteURL)
@@ -468,9 +903,12 @@ func (job *Job) downloadFiles() error {
 
 		t := Target{
 			Bucket:    url.Host,
-			Object:    url.Path[1:],
+			Object:    strings.TrimPrefix(url.Path, "/"),
 			LocalPath: destPath,
 		}
+		if url.Scheme != DownloadSchemeGs {
+			t.Remote = url
+		}
 		targets = append(targets, &t)
 	}
 	log.WithFields(logrus.Fields{"targets": targets}).Debugln("Download Prepared")
@@ -482,15 +920,30 @@ func (job *Job) downloadFiles() error {
 
 	rf := &RetryableFunc{
 		name:     "downoad",
+		log:      log,
 		maxTries: job.downloadConfig.Worker.MaxTries,
 		interval: 30 * time.Second,
+		onRetry:  func() { job.metrics.Retried(job.optionKey, "download") },
+		cancel:   job.cancelled(),
 	}
 	f := rf.WithLog(rf.Wrap(func(j *concurrent.Job) error {
 		t, ok := j.Payload.(*Target)
 		if !ok {
 			return fmt.Errorf("Unknown Payload: %v\n", j.Payload)
 		}
-		return job.storage.Download(t.Bucket, t.Object, t.LocalPath)
+		span := job.startTargetSpan("download", t)
+		err := job.downloadTarget(t)
+		if err != nil {
+			endSpan(span, err)
+			return err
+		}
+		if info, err := os.Stat(t.LocalPath); err == nil {
+			job.metrics.Downloaded(job.optionKey, info.Size())
+			span.SetAttribute("target.size", info.Size())
+		}
+		err = job.addDownloadResult(t)
+		endSpan(span, err)
+		return err
 	}))
 
 	downloaders := concurrent.NewWorkers(f, job.downloadConfig.Worker.Workers)
@@ -501,21 +954,197 @@ func (job *Job) downloadFiles() error {
 	return jobs.Error()
 }
 
+func (job *Job) downloadTarget(t *Target) error {
+	if t.Remote != nil {
+		d := job.downloadConfig.Downloader(t.Remote.Scheme)
+		if d == nil {
+			return &InvalidJobError{msg: fmt.Sprintf("Unsupported scheme %q of download file %s", t.Remote.Scheme, t.Remote)}
+		}
+		return d.Download(t.Remote, t.LocalPath)
+	}
+	return job.storage.Download(t.Bucket, t.Object, t.LocalPath)
+}
+
 func (job *Job) execute() error {
 	if job.config.Dryrun {
 		return nil
 	}
-	log := log.WithFields(logrus.Fields{"cmd": job.cmd})
+	log := job.logEntry().WithFields(logrus.Fields{"cmd": job.cmd})
 	log.Debugln("EXECUTING")
-	err := job.cmd.Run()
+	ctx, span := job.tracing.Start(job.stepContext(), "command", map[string]interface{}{
+		"command.args": job.cmd.Args,
+	})
+	if env := traceEnv(ctx); len(env) > 0 {
+		if job.cmd.Env == nil {
+			job.cmd.Env = os.Environ()
+		}
+		job.cmd.Env = append(job.cmd.Env, env...)
+	}
+	err := job.runCommand()
+	job.readResult()
+	defer func() {
+		if job.exitCode != nil {
+			span.SetAttribute("command.exit_code", *job.exitCode)
+		}
+		endSpan(span, err)
+	}()
+	if err == nil {
+		exitCode := 0
+		job.exitCode = &exitCode
+		job.metrics.CommandExited(job.optionKey, 0)
+	} else {
+		if e, ok := err.(*CommandTimeoutError); ok {
+			e.output = job.outputBuffer.String()
+			log.WithFields(logrus.Fields{"timeout": e.Timeout}).Errorln("Command timed out")
+			job.metrics.CommandTimedOut(job.optionKey)
+			return e
+		}
+		exitCode := -1
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Exited() {
+				exitCode = status.ExitStatus()
+			}
+		}
+		log.WithFields(logrus.Fields{"error": err, "exit_code": exitCode}).Errorln("Command returned error")
+		if exitCode >= 0 {
+			job.exitCode = &exitCode
+		}
+		job.metrics.CommandExited(job.optionKey, exitCode)
+		return &CommandError{ExitCode: exitCode, cause: err, output: job.outputBuffer.String()}
+	}
+	return nil
+}
+
+// runCommand waits for the command in the timeout.
+// When the timeout passes, SIGTERM is sent to the process group of the command
+// and then SIGKILL is sent if it doesn't stop in kill_after.
+func (job *Job) runCommand() error {
+	err := job.startCommand()
 	if err != nil {
-		log.WithFields(logrus.Fields{"error": err}).Errorln("Command returned error")
-		return fmt.Errorf("[%T] %v\noutput:\n%s", err, err.Error(), job.outputBuffer.String())
+		return err
 	}
+
+	done := make(chan error, 1)
+	go func() {
+		err := job.cmd.Wait()
+		job.cmdMux.Lock()
+		job.cmdFinished = true
+		job.cmdMux.Unlock()
+		done <- err
+	}()
+
+	if job.timeout <= 0 {
+		return <-done
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(job.timeout):
+	}
+
+	log := job.logEntry().WithFields(logrus.Fields{"timeout": job.timeout})
+	log.Warnln("Command timed out. Sending SIGTERM")
+	job.signalCommand(syscall.SIGTERM)
+	select {
+	case <-done:
+	case <-time.After(job.config.killAfter):
+		log.WithFields(logrus.Fields{"kill_after": job.config.killAfter}).Warnln("Command didn't stop. Sending SIGKILL")
+		job.signalCommand(syscall.SIGKILL)
+		<-done
+	}
+	return &CommandTimeoutError{Timeout: job.timeout}
+}
+
+func (job *Job) signalCommand(sig os.Signal) error {
+	job.cmdMux.Lock()
+	defer job.cmdMux.Unlock()
+	return job.sendSignal(sig)
+}
+
+func (job *Job) startCommand() error {
+	job.cmdMux.Lock()
+	defer job.cmdMux.Unlock()
+	if job.interrupted {
+		return fmt.Errorf("Job was interrupted before starting the command")
+	}
+	return job.cmd.Start()
+}
+
+func (job *Job) isInterrupted() bool {
+	job.cmdMux.Lock()
+	defer job.cmdMux.Unlock()
+	return job.interrupted
+}
+
+// interruptedSignal returns the first signal which interrupted the job or nil.
+func (job *Job) interruptedSignal() os.Signal {
+	job.cmdMux.Lock()
+	defer job.cmdMux.Unlock()
+	return job.interruptedBy
+}
+
+// signal marks the job as interrupted and sends the signal to the command if it's running.
+func (job *Job) signal(sig os.Signal) error {
+	job.cmdMux.Lock()
+	defer job.cmdMux.Unlock()
+	job.interrupted = true
+	if job.interruptedBy == nil {
+		job.interruptedBy = sig
+	}
+	return job.sendSignal(sig)
+}
+
+// sendSignal sends the signal to the process group of the command.
+// cmdMux must be locked by the caller.
+func (job *Job) sendSignal(sig os.Signal) error {
+	if job.cmd == nil || job.cmd.Process == nil || job.cmdFinished {
+		return nil
+	}
+	log := job.logEntry().WithFields(logrus.Fields{"signal": sig, "pid": job.cmd.Process.Pid})
+	var err error
+	if s, ok := sig.(syscall.Signal); ok && job.cmd.SysProcAttr != nil && job.cmd.SysProcAttr.Setpgid {
+		err = syscall.Kill(-job.cmd.Process.Pid, s)
+	} else {
+		err = job.cmd.Process.Signal(sig)
+	}
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Warnln("Failed to send signal to the command")
+		return err
+	}
+	log.Infoln("Signal sent to the command")
 	return nil
 }
 
+// cancelled returns the channel which is closed when the job is interrupted.
+func (job *Job) cancelled() <-chan struct{} {
+	job.cmdMux.Lock()
+	defer job.cmdMux.Unlock()
+	if job.cancel == nil {
+		job.cancel = make(chan struct{})
+	}
+	return job.cancel
+}
+
+// interrupt cancels the downloads and uploads and kills the command of the job which didn't finish in the grace period.
+// It doesn't respond to the message because run sends NACK after the job stops.
+func (job *Job) interrupt() error {
+	job.logEntry().Warnln("Interrupting job")
+	job.cmdMux.Lock()
+	if job.cancel == nil {
+		job.cancel = make(chan struct{})
+	}
+	select {
+	case <-job.cancel:
+	default:
+		close(job.cancel)
+	}
+	job.cmdMux.Unlock()
+	return job.signal(os.Kill)
+}
+
 func (job *Job) uploadFiles() error {
+	log := job.logEntry()
+	job.uploadResults = nil
 	localPaths, err := job.listFiles(job.uploads_dir)
 	if err != nil {
 		return err
@@ -528,14 +1157,12 @@ func (job *Job) uploadFiles() error {
 			log.WithFields(logrus.Fields{"error": err, "localPath": localPath, "uploads_dir": job.uploads_dir}).Errorln("Failed to get relative path")
 			return err
 		}
-		sep := string([]rune{os.PathSeparator})
-		parts := strings.Split(relPath, sep)
-		t := Target{
-			Bucket:    parts[0],
-			Object:    strings.Join(parts[1:], sep),
-			LocalPath: localPath,
+		t, err := job.uploadTarget(relPath, localPath)
+		if err != nil {
+			log.WithFields(logrus.Fields{"error": err, "localPath": localPath}).Errorln("Failed to get upload destination")
+			return err
 		}
-		targets = append(targets, &t)
+		targets = append(targets, t)
 	}
 	log.WithFields(logrus.Fields{"targets": targets}).Debugln("Upload Prepared")
 
@@ -546,24 +1173,203 @@ func (job *Job) uploadFiles() error {
 
 	rf := &RetryableFunc{
 		name:     "upload",
+		log:      log,
 		maxTries: job.uploadConfig.Worker.MaxTries,
 		interval: 30 * time.Second,
+		onRetry:  func() { job.metrics.Retried(job.optionKey, "upload") },
+		cancel:   job.cancelled(),
 	}
 	f := rf.WithLog(rf.Wrap(func(j *concurrent.Job) error {
 		t, ok := j.Payload.(*Target)
 		if !ok {
 			return fmt.Errorf("Unknown Payload: %v\n", j.Payload)
 		}
-		return job.storage.Upload(t.Bucket, t.Object, t.LocalPath)
+		span := job.startTargetSpan("upload", t)
+		err := job.uploadFile(t)
+		endSpan(span, err)
+		return err
 	}))
 
 	uploaders := concurrent.NewWorkers(f, job.uploadConfig.Worker.Workers)
 	log.WithFields(logrus.Fields{"uploaders": len(uploaders)}).Debugln("Uploaders are running")
 
 	uploaders.Process(jobs)
+	for _, j := range jobs {
+		if j.Error != nil {
+			job.deleteCompositeParts(j.Payload.(*Target))
+		}
+	}
 	return jobs.Error()
 }
 
+// deleteCompositeParts deletes the parts which are left by parallel composite upload
+// of the target after all of the tries failed.
+func (job *Job) deleteCompositeParts(t *Target) {
+	threshold := job.uploadConfig.compositeThreshold
+	if threshold == 0 {
+		return
+	}
+	if info, err := os.Stat(t.LocalPath); err != nil || info.Size() < threshold {
+		return
+	}
+	log := job.logEntry().WithFields(logrus.Fields{"url": t.URL()})
+	parts, err := job.storage.List(t.Bucket, compositePartsPrefix(job.uploadConfig.CompositeTempPrefix, t.Object))
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Warnln("Failed to list the parts of composite upload")
+		return
+	}
+	for _, part := range parts {
+		if err := job.storage.Delete(t.Bucket, part.Name); err != nil {
+			log.WithFields(logrus.Fields{"part": part.Name, "error": err}).Warnln("Failed to delete the part of composite upload")
+		}
+	}
+}
+
+func (job *Job) uploadFile(t *Target) error {
+	log := job.logEntry().WithFields(logrus.Fields{"url": t.URL(), "localPath": t.LocalPath})
+	if job.uploadConfig.Mode == UploadModeSkipIfSame {
+		same, err := job.sameObjectExists(t)
+		if err != nil {
+			return err
+		}
+		if same {
+			log.WithFields(logrus.Fields{"result": UploadSkippedSame}).Infoln("Upload skipped because the same object exists")
+			job.addUploadResult(t, UploadSkippedSame)
+			return nil
+		}
+	}
+	attrs := &storage.Object{}
+	if t.Attrs != nil {
+		*attrs = *t.Attrs
+	}
+	attrs.Name = t.Object
+	// The precondition is only for the outputs of the job
+	opts := &UploadOptions{NoClobber: job.uploadConfig.Mode == UploadModeNoClobber}
+	err := job.storage.UploadObject(t.Bucket, attrs, t.LocalPath, opts)
+	if _, ok := err.(*ObjectExistsError); ok {
+		log.WithFields(logrus.Fields{"result": UploadSkippedExisting}).Infoln("Upload skipped because the object exists")
+		job.addUploadResult(t, UploadSkippedExisting)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	log.WithFields(logrus.Fields{"result": UploadUploaded}).Infoln("Uploaded")
+	if info, err := os.Stat(t.LocalPath); err == nil {
+		job.metrics.Uploaded(job.optionKey, info.Size())
+	}
+	job.addUploadResult(t, UploadUploaded)
+	return nil
+}
+
+// sameObjectExists returns true if the object has the same size and hashes as the local file.
+func (job *Job) sameObjectExists(t *Target) (bool, error) {
+	obj, err := job.storage.Get(t.Bucket, t.Object)
+	if err != nil || obj == nil {
+		return false, err
+	}
+	h, err := HashFile(t.LocalPath)
+	if err != nil {
+		return false, err
+	}
+	return h.Verify(t.URL(), obj) == nil, nil
+}
+
+func (job *Job) addUploadResult(t *Target, result string) {
+	r := &UploadResult{URL: t.URL(), Result: result}
+	if job.manifestRequired() {
+		if h, err := HashFile(t.LocalPath); err == nil {
+			r.Size, r.Md5Hash, r.Crc32c = h.size, h.Md5Hash(), h.Crc32c()
+		}
+	}
+	job.uploadMux.Lock()
+	defer job.uploadMux.Unlock()
+	job.uploadResults = append(job.uploadResults, r)
+}
+
+// uploadFilesWithSummary returns the number of files for each result and
+// the lines of the result and URL of the files.
+func (job *Job) uploadFilesWithSummary() (map[string]string, string, error) {
+	err := job.uploadFiles()
+	if err != nil {
+		return nil, "", err
+	}
+	counts := map[string]int{UploadUploaded: 0, UploadSkippedSame: 0, UploadSkippedExisting: 0}
+	lines := []string{}
+	for _, r := range job.uploadResults {
+		counts[r.Result]++
+		lines = append(lines, r.Result+" "+r.URL)
+	}
+	sort.Strings(lines)
+	summary := map[string]string{}
+	for result, count := range counts {
+		summary["upload."+result] = strconv.Itoa(count)
+	}
+	return summary, strings.Join(lines, "\n"), nil
+}
+
+// uploadTarget returns the Target by the first destination which matches relPath.
+// The first directory of relPath is used as the bucket if no destination matches.
+// All of the attributes which match relPath are applied in order.
+func (job *Job) uploadTarget(relPath, localPath string) (*Target, error) {
+	slashPath := filepath.ToSlash(relPath)
+	v := uploadFileVariable(job.uploadVariable(), slashPath)
+	t, err := job.uploadDestination(v, slashPath, localPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range job.uploadConfig.Attributes {
+		if !a.Match(slashPath) {
+			continue
+		}
+		if t.Attrs == nil {
+			t.Attrs = &storage.Object{}
+		}
+		if err := a.Apply(v, t.Attrs); err != nil {
+			return nil, &InvalidJobError{cause: job.convertError(err)}
+		}
+	}
+	return t, nil
+}
+
+func (job *Job) uploadDestination(v *bvariable.Variable, slashPath, localPath string) (*Target, error) {
+	for _, d := range job.uploadConfig.Destinations {
+		if !d.Match(slashPath) {
+			continue
+		}
+		t, err := d.Target(v, slashPath, localPath)
+		if err != nil {
+			return nil, &InvalidJobError{cause: job.convertError(err)}
+		}
+		return t, nil
+	}
+	parts := strings.Split(slashPath, "/")
+	if len(parts) < 2 {
+		return nil, &InvalidJobError{msg: fmt.Sprintf("No upload destination found for %s", slashPath)}
+	}
+	return &Target{
+		Bucket:    parts[0],
+		Object:    strings.Join(parts[1:], "/"),
+		LocalPath: localPath,
+	}, nil
+}
+
+// uploadVariable returns the variable for upload destinations.
+// It has no attributes nor data when the job has no message like the upload command.
+func (job *Job) uploadVariable() *bvariable.Variable {
+	if job.message != nil {
+		return job.buildVariable()
+	}
+	return &bvariable.Variable{
+		Data: map[string]interface{}{
+			"workspace":     job.workspace,
+			"downloads_dir": job.downloads_dir,
+			"uploads_dir":   job.uploads_dir,
+			"exec_uuid":     job.execUUID,
+		},
+	}
+}
+
 func (job *Job) listFiles(dir string) ([]string, error) {
 	result := []string{}
 	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
@@ -573,7 +1379,7 @@ func (job *Job) listFiles(dir string) ([]string, error) {
 		return nil
 	})
 	if err != nil {
-		log.WithFields(logrus.Fields{"error": err}).Errorln("Error to list upload files")
+		job.logEntry().WithFields(logrus.Fields{"error": err}).Errorln("Error to list upload files")
 		return nil, err
 	}
 	return result, nil
@@ -1,15 +1,32 @@
 package main
 
 import (
+	"strconv"
+	"sync"
+
+	logrus "github.com/sirupsen/logrus"
 	"github.com/tidwall/buntdb"
 )
 
 type JobCheckByBuntDB struct {
 	File   string
 	Prefix string
+
+	log *logrus.Entry
+}
+
+// jobCheckByBuntDBMux serializes the access to the database file from concurrent jobs
+var jobCheckByBuntDBMux sync.Mutex
+
+func (jc *JobCheckByBuntDB) logEntry() *logrus.Entry {
+	if jc.log != nil {
+		return jc.log
+	}
+	return log
 }
 
 func (jc *JobCheckByBuntDB) Check(job_id string, ack func() error, f func() error) error {
+	log := jc.logEntry()
 	skip := false
 	key := jc.Prefix + job_id
 	err := jc.Open(func(tx *buntdb.Tx) error {
@@ -54,11 +71,52 @@ func (jc *JobCheckByBuntDB) Check(job_id string, ack func() error, f func() erro
 	})
 }
 
+const DeliveryCountKeyPrefix = "deliveries:"
+
+func (jc *JobCheckByBuntDB) Increment(msg_id string) (int, error) {
+	key := DeliveryCountKeyPrefix + msg_id
+	count := 0
+	err := jc.Open(func(tx *buntdb.Tx) error {
+		val, err := jc.GetStatus(tx, key)
+		if err != nil {
+			return err
+		}
+		if val != "" {
+			count, err = strconv.Atoi(val)
+			if err != nil {
+				jc.logEntry().Warnf("Invalid delivery count %q for %s\n", val, key)
+				count = 0
+			}
+		}
+		count++
+		return jc.SetStatus(tx, key, strconv.Itoa(count), jc.logEntry().Errorf)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (jc *JobCheckByBuntDB) Clear(msg_id string) error {
+	key := DeliveryCountKeyPrefix + msg_id
+	return jc.Open(func(tx *buntdb.Tx) error {
+		_, err := tx.Delete(key)
+		if err != nil && err != buntdb.ErrNotFound {
+			jc.logEntry().Errorf("Failed to delete %s because of %v\n", key, err)
+			return err
+		}
+		return nil
+	})
+}
+
 func (jc *JobCheckByBuntDB) Open(f func(tx *buntdb.Tx) error) error {
+	jobCheckByBuntDBMux.Lock()
+	defer jobCheckByBuntDBMux.Unlock()
+
 	// Open the data.db file. It will be created if it doesn't exist.
 	db, err := buntdb.Open(jc.File)
 	if err != nil {
-		log.Fatal(err)
+		jc.logEntry().Fatal(err)
 	}
 	defer db.Close()
 
@@ -71,7 +129,7 @@ func (jc *JobCheckByBuntDB) GetStatus(tx *buntdb.Tx, key string) (string, error)
 		return "", nil
 	}
 	if err != nil {
-		log.Errorf("Failed to get value for %s because of %v\n", key, err)
+		jc.logEntry().Errorf("Failed to get value for %s because of %v\n", key, err)
 		return "", err
 	}
 	return val, nil
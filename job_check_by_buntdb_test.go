@@ -56,3 +56,27 @@ func TestJobCheckByBuntDB(t *testing.T) {
 		assert.Equal(t, true, main.Called)
 	})()
 }
+
+func TestJobCheckByBuntDBIncrement(t *testing.T) {
+	c := &JobCheckByBuntDB{
+		File:   "test-buntdb-deliveries.db",
+		Prefix: "jobs",
+	}
+	defer os.Remove(c.File)
+
+	for i := 1; i <= 3; i++ {
+		count, err := c.Increment("msg1")
+		assert.NoError(t, err)
+		assert.Equal(t, i, count)
+	}
+
+	count, err := c.Increment("msg2")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	assert.NoError(t, c.Clear("msg1"))
+	assert.NoError(t, c.Clear("unknown"))
+	count, err = c.Increment("msg1")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
@@ -21,9 +23,37 @@ type JobCheckByGcslock struct {
 
 	working bool
 	mux     sync.Mutex
+
+	log *logrus.Entry
+}
+
+// LockerStorage is implemented by the Storage which can't be locked by gcslock.
+type LockerStorage interface {
+	NewLocker(bucket, object string) (gcslock.ContextLocker, error)
+}
+
+// ConditionalStorage is implemented by the Storage which can update the object only if it isn't changed.
+type ConditionalStorage interface {
+	// UpdateIfMatch returns the error whose code is 412 if the generation or the metageneration doesn't match.
+	UpdateIfMatch(bucket, object string, generation, metageneration int64, body *storage.Object) (*storage.Object, error)
+}
+
+func (jc *JobCheckByGcslock) newLocker(object string) (gcslock.ContextLocker, error) {
+	if s, ok := jc.Storage.(LockerStorage); ok {
+		return s.NewLocker(jc.Bucket, object)
+	}
+	return gcslock.New(nil, jc.Bucket, object)
+}
+
+func (jc *JobCheckByGcslock) logEntry() *logrus.Entry {
+	if jc.log != nil {
+		return jc.log
+	}
+	return log
 }
 
 func (jc *JobCheckByGcslock) Check(job_id string, ack func() error, f func() error) error {
+	log := jc.logEntry()
 	object := jc.DirPath + "/" + job_id + ".gcslock"
 	url := fmt.Sprintf("gs://%s/%s", jc.Bucket, object)
 
@@ -41,7 +71,7 @@ func (jc *JobCheckByGcslock) Check(job_id string, ack func() error, f func() err
 		return nil
 	}
 
-	m, err := gcslock.New(nil, jc.Bucket, object)
+	m, err := jc.newLocker(object)
 	if err != nil {
 		log.Errorf("Failed to gcslock.New because of %v\n", err)
 		return err
@@ -78,6 +108,9 @@ func (jc *JobCheckByGcslock) Check(job_id string, ack func() error, f func() err
 		return nil
 	}
 
+	jc.mux.Lock()
+	jc.working = true
+	jc.mux.Unlock()
 	go jc.StartTouching(object, time.Duration(int64(jc.Timeout)/10))
 
 	logger.Debugln("JobCheckByGcslock handler starting")
@@ -98,7 +131,78 @@ func (jc *JobCheckByGcslock) Check(job_id string, ack func() error, f func() err
 	return err
 }
 
+const (
+	DeliveryCountMetadataKey = "deliveries"
+	// DeliveryCountMaxTries is the max number of tries to update the count which another process is updating
+	DeliveryCountMaxTries = 5
+)
+
+func (jc *JobCheckByGcslock) deliveriesObject(msg_id string) string {
+	return jc.DirPath + "/" + msg_id + ".deliveries"
+}
+
+// Increment counts the deliveries with the metadata of the object in the bucket.
+// The count is updated only if the object isn't changed after it's read,
+// and it's read again if another process updated it.
+func (jc *JobCheckByGcslock) Increment(msg_id string) (int, error) {
+	object := jc.deliveriesObject(msg_id)
+	logger := jc.logEntry().WithFields(logrus.Fields{"url": fmt.Sprintf("gs://%s/%s", jc.Bucket, object)})
+
+	var err error
+	for i := 0; i < DeliveryCountMaxTries; i++ {
+		var count int
+		count, err = jc.incrementOnce(object, logger)
+		if err == nil {
+			return count, nil
+		}
+		if !IsGoogleApiError(err, http.StatusPreconditionFailed) {
+			break
+		}
+		logger.Debugf("Delivery count was updated by another process\n")
+	}
+	logger.Errorf("Failed to update delivery count because of %v\n", err)
+	return 0, err
+}
+
+func (jc *JobCheckByGcslock) incrementOnce(object string, logger *logrus.Entry) (int, error) {
+	f, err := jc.Storage.Get(jc.Bucket, object)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	if f == nil {
+		f, err = jc.Storage.CreateEmptyFile(jc.Bucket, object)
+		if err != nil {
+			return 0, err
+		}
+	} else if val, ok := f.Metadata[DeliveryCountMetadataKey]; ok {
+		count, err = strconv.Atoi(val)
+		if err != nil {
+			logger.Warnf("Invalid delivery count %q\n", val)
+			count = 0
+		}
+	}
+	count++
+
+	body := &storage.Object{Metadata: map[string]string{DeliveryCountMetadataKey: strconv.Itoa(count)}}
+	if s, ok := jc.Storage.(ConditionalStorage); ok {
+		_, err = s.UpdateIfMatch(jc.Bucket, object, f.Generation, f.Metageneration, body)
+	} else {
+		_, err = jc.Storage.Update(jc.Bucket, object, body)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// Clear deletes the object of the delivery count.
+func (jc *JobCheckByGcslock) Clear(msg_id string) error {
+	return jc.Storage.Delete(jc.Bucket, jc.deliveriesObject(msg_id))
+}
+
 func (jc *JobCheckByGcslock) DeleteIfTimedout(object string) (bool, error) {
+	log := jc.logEntry()
 	prefix := "JobCheckByGcslock.DeleteIfTimedout"
 	logger := log.WithFields(logrus.Fields{"lock": fmt.Sprintf("gs://%s/%s", jc.Bucket, object)})
 	logger.Debugf("%s Start\n", prefix)
@@ -138,6 +242,7 @@ func (jc *JobCheckByGcslock) DeleteIfTimedout(object string) (bool, error) {
 }
 
 func (jc *JobCheckByGcslock) Lock(m gcslock.ContextLocker) error {
+	log := jc.logEntry()
 	log.Debugln("JobCheckByGcslock.Lock start")
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
@@ -154,6 +259,7 @@ func (jc *JobCheckByGcslock) Lock(m gcslock.ContextLocker) error {
 }
 
 func (jc *JobCheckByGcslock) Unlock(m gcslock.ContextLocker, f func() error) error {
+	log := jc.logEntry()
 	log.Debugln("JobCheckByGcslock.Unlock start")
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
@@ -173,11 +279,11 @@ func (jc *JobCheckByGcslock) Unlock(m gcslock.ContextLocker, f func() error) err
 }
 
 func (jc *JobCheckByGcslock) StartTouching(object string, interval time.Duration) error {
+	log := jc.logEntry()
 	logger := log.WithFields(logrus.Fields{"lock": fmt.Sprintf("gs://%s/%s", jc.Bucket, object), "interval": interval})
 	logger.Infoln("JobCheckByGcslock.StartTouching Start")
 	defer logger.Infoln("JobCheckByGcslock.StartTouching Finished")
 
-	jc.working = true
 	for {
 		nextLimit := time.Now().Add(interval)
 		err := jc.WaitAndTouch(object, nextLimit)
@@ -185,17 +291,24 @@ func (jc *JobCheckByGcslock) StartTouching(object string, interval time.Duration
 			log.WithFields(logrus.Fields{"error": err}).Errorln("Error in StartTouching")
 			return err
 		}
-		if !jc.working {
+		if !jc.isWorking() {
 			return nil
 		}
 	}
 	// return nil
 }
 
+func (jc *JobCheckByGcslock) isWorking() bool {
+	jc.mux.Lock()
+	defer jc.mux.Unlock()
+	return jc.working
+}
+
 func (jc *JobCheckByGcslock) WaitAndTouch(object string, nextLimit time.Time) error {
+	log := jc.logEntry()
 	ticker := time.NewTicker(100 * time.Millisecond)
 	for now := range ticker.C {
-		if !jc.working {
+		if !jc.isWorking() {
 			ticker.Stop()
 			return nil
 		}
@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"time"
+
+	logrus "github.com/sirupsen/logrus"
 )
 
 type JobCheckConfig struct {
@@ -77,7 +79,25 @@ func (c *JobCheckConfig) Validate() *ConfigError {
 	}
 }
 
-func (c *JobCheckConfig) Checker() func(string, func() error, func() error) error {
+func (c *JobCheckConfig) DeliveryCounter() DeliveryCounter {
+	switch c.Method {
+	case JobCheckMethodBuntDB:
+		return &JobCheckByBuntDB{
+			File:   c.Database,
+			Prefix: c.Bucket,
+		}
+	case JobCheckMethodGcslock:
+		return &JobCheckByGcslock{
+			Bucket:  c.Bucket,
+			DirPath: c.Database,
+			Storage: c.storage,
+		}
+	default:
+		return &DeliveryCounterInMemory{}
+	}
+}
+
+func (c *JobCheckConfig) Checker(log *logrus.Entry) func(string, func() error, func() error) error {
 	switch c.Method {
 	case JobCheckMethodNone:
 		return func(job_id string, ack, f func() error) error {
@@ -87,6 +107,7 @@ func (c *JobCheckConfig) Checker() func(string, func() error, func() error) erro
 		checker := &JobCheckByBuntDB{
 			File:   c.Database,
 			Prefix: c.Bucket,
+			log:    log,
 		}
 		return checker.Check
 	case JobCheckMethodGcslock:
@@ -101,6 +122,7 @@ func (c *JobCheckConfig) Checker() func(string, func() error, func() error) erro
 			DirPath: c.Database,
 			Timeout: d,
 			Storage: c.storage,
+			log:     log,
 		}
 		return checker.Check
 	default:
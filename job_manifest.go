@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sort"
+
+	storage "google.golang.org/api/storage/v1"
+
+	logrus "github.com/sirupsen/logrus"
+)
+
+const ManifestKey = "job.manifest"
+
+type (
+	// JobManifest is the record of the job uploaded as JSON to upload/manifest.
+	JobManifest struct {
+		MessageId  string            `json:"message_id"`
+		ExecUUID   string            `json:"exec_uuid"`
+		Attributes map[string]string `json:"attributes"`
+		Command    []string          `json:"command"`
+		// ExitCode is null if the command didn't run or exit
+		ExitCode   *int              `json:"exit_code"`
+		StartTime  string            `json:"start_time"`
+		FinishTime string            `json:"finish_time"`
+		Response   string            `json:"response"`
+		Error      string            `json:"error,omitempty"`
+		Downloads  []*DownloadResult `json:"downloads"`
+		Uploads    []*UploadResult   `json:"uploads"`
+		// Published has the follow-up messages published from the outbox
+		Published []*PublishResult `json:"published,omitempty"`
+		// Result is given if the command wrote result.json
+		Result *JobResult `json:"result,omitempty"`
+	}
+
+	// DownloadResult is the file downloaded from URL.
+	DownloadResult struct {
+		URL       string `json:"url"`
+		LocalPath string `json:"local_path"`
+		Size      uint64 `json:"size"`
+		Md5Hash   string `json:"md5_hash"`
+		Crc32c    string `json:"crc32c"`
+	}
+)
+
+func (job *Job) manifestRequired() bool {
+	return job.uploadConfig != nil && job.uploadConfig.Manifest != ""
+}
+
+// addDownloadResult records the downloaded file with its hashes for the manifest.
+func (job *Job) addDownloadResult(t *Target) error {
+	if !job.manifestRequired() {
+		return nil
+	}
+	h, err := HashFile(t.LocalPath)
+	if err != nil {
+		return err
+	}
+	job.downloadMux.Lock()
+	defer job.downloadMux.Unlock()
+	job.downloadResults = append(job.downloadResults, &DownloadResult{
+		URL:       t.URL(),
+		LocalPath: t.LocalPath,
+		Size:      h.size,
+		Md5Hash:   h.Md5Hash(),
+		Crc32c:    h.Crc32c(),
+	})
+	return nil
+}
+
+func (job *Job) manifest(rt ResponseType, cause error) *JobManifest {
+	attrs := map[string]string{}
+	for k, v := range job.message.raw.Message.Attributes {
+		attrs[k] = v
+	}
+	m := &JobManifest{
+		MessageId:  job.message.MessageId(),
+		ExecUUID:   job.execUUID,
+		Attributes: attrs,
+		Command:    []string{},
+		ExitCode:   job.exitCode,
+		StartTime:  attrs[StartTimeKey],
+		FinishTime: attrs[FinishTimeKey],
+		Response:   rt.String(),
+		Downloads:  append([]*DownloadResult{}, job.downloadResults...),
+		Uploads:    append([]*UploadResult{}, job.uploadResults...),
+		Published:  append([]*PublishResult{}, job.publishResults...),
+		Result:     job.result,
+	}
+	if job.cmd != nil {
+		m.Command = job.cmd.Args
+	}
+	if cause != nil {
+		m.Error = cause.Error()
+	}
+	// The files are downloaded and uploaded concurrently
+	sort.Slice(m.Downloads, func(i, j int) bool { return m.Downloads[i].URL < m.Downloads[j].URL })
+	sort.Slice(m.Uploads, func(i, j int) bool { return m.Uploads[i].URL < m.Uploads[j].URL })
+	return m
+}
+
+// uploadManifest uploads the manifest to upload/manifest and sets its URL to the attribute job.manifest.
+// The failure to upload doesn't change the response for the job.
+func (job *Job) uploadManifest(rt ResponseType, cause error) {
+	if !job.manifestRequired() {
+		return
+	}
+	log := job.logEntry()
+	u, err := job.uploadManifestTo(job.manifest(rt, cause))
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err, "manifest": job.uploadConfig.Manifest}).Errorln("Failed to upload manifest")
+		return
+	}
+	log.WithFields(logrus.Fields{"url": u}).Infoln("Manifest uploaded")
+	job.message.raw.Message.Attributes[ManifestKey] = u
+}
+
+func (job *Job) uploadManifestTo(m *JobManifest) (string, error) {
+	dest, err := job.uploadVariable().Expand(job.uploadConfig.Manifest)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(dest)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "gs" || u.Host == "" || len(u.Path) < 2 {
+		return "", fmt.Errorf("Invalid manifest URL %q", dest)
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	f, err := ioutil.TempFile("", "manifest")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return "", err
+	}
+
+	obj := &storage.Object{Name: u.Path[1:], ContentType: "application/json"}
+	err = job.storage.UploadObject(u.Host, obj, f.Name(), nil)
+	if err != nil {
+		return "", err
+	}
+	return dest, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadConfigManifest(t *testing.T) {
+	c := &UploadConfig{Manifest: "gs://bucket1/manifests/%{exec_uuid}.json"}
+	assert.Nil(t, c.setup())
+
+	c = &UploadConfig{Manifest: "/tmp/manifest.json"}
+	assert.NotNil(t, c.setup())
+}
+
+func TestProcessRunWithManifest(t *testing.T) {
+	tp := newTestProcess(t, "mkdir -p $1/bucket1 && cp $2 $1/bucket1/out.txt && exit $3\n",
+		[]string{"%{uploads_dir}", "%{download_files.0}", "%{attrs.exit}"},
+		func(c *ProcessConfig) {
+			c.Upload = &UploadConfig{Manifest: "gs://bucket1/manifests/%{message_id}.json"}
+		})
+	defer tp.close()
+	root := tp.root
+	script := tp.script
+
+	tp.add("msg1", map[string]string{"download_files": `["gs://bucket1/in.txt"]`, "exit": "0"})
+	tp.add("msg2", map[string]string{"download_files": `["gs://bucket1/in.txt"]`, "exit": "3"})
+	tp.run(nil)
+
+	load := func(msgId string) *JobManifest {
+		data, err := ioutil.ReadFile(filepath.Join(root, "bucket1", "manifests", msgId+".json"))
+		assert.NoError(t, err)
+		m := &JobManifest{}
+		assert.NoError(t, json.Unmarshal(data, m))
+		return m
+	}
+	fooMd5 := "rL0Y20zC+Fzt72VPzMSk2A=="
+	fooCrc32c := "z8SuHQ=="
+
+	m := load("msg1")
+	assert.Equal(t, "msg1", m.MessageId)
+	assert.NotEqual(t, "", m.ExecUUID)
+	assert.Equal(t, "0", m.Attributes["exit"])
+	assert.Equal(t, script, m.Command[0])
+	if assert.NotNil(t, m.ExitCode) {
+		assert.Equal(t, 0, *m.ExitCode)
+	}
+	assert.NotEqual(t, "", m.StartTime)
+	assert.NotEqual(t, "", m.FinishTime)
+	assert.Equal(t, "ack", m.Response)
+	assert.Equal(t, "", m.Error)
+	if assert.Equal(t, 1, len(m.Downloads)) {
+		d := m.Downloads[0]
+		assert.Equal(t, "gs://bucket1/in.txt", d.URL)
+		assert.Equal(t, uint64(3), d.Size)
+		assert.Equal(t, fooMd5, d.Md5Hash)
+		assert.Equal(t, fooCrc32c, d.Crc32c)
+	}
+	if assert.Equal(t, 1, len(m.Uploads)) {
+		u := m.Uploads[0]
+		assert.Equal(t, "gs://bucket1/out.txt", u.URL)
+		assert.Equal(t, UploadUploaded, u.Result)
+		assert.Equal(t, uint64(3), u.Size)
+		assert.Equal(t, fooMd5, u.Md5Hash)
+		assert.Equal(t, fooCrc32c, u.Crc32c)
+	}
+
+	m = load("msg2")
+	if assert.NotNil(t, m.ExitCode) {
+		assert.Equal(t, 3, *m.ExitCode)
+	}
+	assert.Equal(t, "ack", m.Response)
+	assert.NotEqual(t, "", m.Error)
+	assert.Equal(t, 0, len(m.Uploads))
+
+	completed := map[string]string{}
+	for _, msg := range tp.progresses() {
+		if msg.Attributes["step"] == ACKSENDING.String() || msg.Attributes["step"] == CANCELLING.String() {
+			completed[msg.Attributes["job_message_id"]] = msg.Attributes[ManifestKey]
+		}
+	}
+	assert.Equal(t, map[string]string{
+		"msg1": "gs://bucket1/manifests/msg1.json",
+		"msg2": "gs://bucket1/manifests/msg2.json",
+	}, completed)
+}
+
+func TestProcessRunWithManifestOnRedelivery(t *testing.T) {
+	tp := newTestProcess(t, "mkdir -p $1/bucket1 && echo new > $1/bucket1/out.txt\n",
+		[]string{"%{uploads_dir}"},
+		func(c *ProcessConfig) {
+			c.Upload = &UploadConfig{Mode: UploadModeNoClobber, Manifest: "gs://bucket1/manifests/%{message_id}.json"}
+		})
+	defer tp.close()
+
+	// The outputs and the manifest uploaded by the previous delivery
+	ls := &LocalStorage{Root: tp.root}
+	old := filepath.Join(tp.dir, "old.txt")
+	assert.NoError(t, ioutil.WriteFile(old, []byte("old\n"), 0644))
+	assert.NoError(t, ls.Upload("bucket1", "out.txt", old))
+	assert.NoError(t, ls.Upload("bucket1", "manifests/msg1.json", old))
+
+	tp.add("msg1", nil)
+	tp.run(nil)
+
+	data, err := ioutil.ReadFile(filepath.Join(tp.root, "bucket1", "out.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "old\n", string(data))
+
+	// no_clobber isn't applied to the manifest
+	data, err = ioutil.ReadFile(filepath.Join(tp.root, "bucket1", "manifests", "msg1.json"))
+	assert.NoError(t, err)
+	m := &JobManifest{}
+	if assert.NoError(t, json.Unmarshal(data, m)) {
+		assert.Equal(t, "msg1", m.MessageId)
+		assert.Equal(t, "ack", m.Response)
+		if assert.Equal(t, 1, len(m.Uploads)) {
+			assert.Equal(t, UploadSkippedExisting, m.Uploads[0].Result)
+		}
+	}
+}
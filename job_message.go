@@ -41,11 +41,23 @@ type (
 		puller Puller
 		status JobMessageStatus
 		mux    sync.Mutex
+
+		// log is the logger with the fields of the job. The global log is used if it's nil.
+		log *logrus.Entry
+
+		metrics *Metrics
 	}
 )
 
 const ExecUUIDKey = "concurrent-batch.exec-uuid"
 
+func (m *JobMessage) logEntry() *logrus.Entry {
+	if m.log != nil {
+		return m.log
+	}
+	return log
+}
+
 func (m *JobMessage) Validate() error {
 	if m.MessageId() == "" {
 		return &InvalidJobError{msg: "no MessageId is given"}
@@ -107,6 +119,8 @@ func (m *JobMessage) parseJson(str string) interface{} {
 }
 
 func (m *JobMessage) Ack() error {
+	log := m.logEntry()
+
 	m.mux.Lock()
 	defer m.mux.Unlock()
 
@@ -129,13 +143,20 @@ func (m *JobMessage) Ack() error {
 }
 
 func (m *JobMessage) Nack() error {
+	return m.NackAfter(0)
+}
+
+// NackAfter modifies the ack deadline of the message to delay so that it's delivered again after delay.
+func (m *JobMessage) NackAfter(delay time.Duration) error {
+	log := m.logEntry()
+
 	m.mux.Lock()
 	defer m.mux.Unlock()
 
-	logAttrs := logrus.Fields{"job_message_id": m.MessageId(), "ack_id": m.raw.AckId}
+	logAttrs := logrus.Fields{"job_message_id": m.MessageId(), "ack_id": m.raw.AckId, "delay": delay}
 	log.WithFields(logAttrs).Debugln("JobMessage.Nack")
 
-	_, err := m.puller.ModifyAckDeadline(m.sub, []string{m.raw.AckId}, 0)
+	_, err := m.puller.ModifyAckDeadline(m.sub, []string{m.raw.AckId}, int64(delay/time.Second))
 	if err != nil {
 		logAttrs["raw"] = fmt.Sprintf("%v", m.raw)
 		logAttrs["error"] = err
@@ -151,6 +172,11 @@ func (m *JobMessage) Nack() error {
 }
 
 func (m *JobMessage) Done() {
+	log := m.logEntry()
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
 	logAttrs := logrus.Fields{"job_message_id": m.MessageId(), "status": m.status}
 	log.WithFields(logAttrs).Debugln("JobMessage.Done")
 	if m.status == running {
@@ -159,6 +185,8 @@ func (m *JobMessage) Done() {
 }
 
 func (m *JobMessage) running() bool {
+	m.mux.Lock()
+	defer m.mux.Unlock()
 	return m.status == running
 }
 
@@ -166,6 +194,7 @@ func (m *JobMessage) sendMADPeriodically(notification *ProgressNotification) err
 	if m.config.Disabled {
 		return nil
 	}
+	log := m.logEntry()
 	log.Infof("sendMADPeriodically start\n")
 	for {
 		nextLimit := time.Now().Add(time.Duration(m.config.Interval) * time.Second)
@@ -183,6 +212,7 @@ func (m *JobMessage) sendMADPeriodically(notification *ProgressNotification) err
 }
 
 func (m *JobMessage) waitAndSendMAD(notification *ProgressNotification, nextLimit time.Time) error {
+	log := m.logEntry()
 	log.Debugln("waitAndSendMAD starting")
 	ticker := time.NewTicker(100 * time.Millisecond)
 	for now := range ticker.C {
@@ -216,6 +246,7 @@ func (m *JobMessage) waitAndSendMAD(notification *ProgressNotification, nextLimi
 
 	log.WithFields(logAttrs).Debugln("waitAndSendMAD sending ModifyAckDeadline")
 	_, err := m.puller.ModifyAckDeadline(m.sub, []string{m.raw.AckId}, int64(m.config.Delay))
+	m.metrics.ModifyAckDeadlineSent(err)
 	if err != nil {
 		logAttrs["error"] = err
 		logAttrs["subscription"] = m.sub
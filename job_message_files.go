@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+
+	logrus "github.com/sirupsen/logrus"
+)
+
+const (
+	MessageFileName       = "message.json"
+	DownloadFilesFileName = "download_files.json"
+)
+
+// MessageFile is the content of message.json.
+type MessageFile struct {
+	MessageId   string            `json:"message_id"`
+	PublishTime string            `json:"publish_time"`
+	Attributes  map[string]string `json:"attributes"`
+	// Data is decoded from base64
+	Data string `json:"data"`
+}
+
+// writeMessageFiles writes message.json and download_files.json into the workspace
+// if command/message_files is true.
+func (job *Job) writeMessageFiles() error {
+	if !job.config.MessageFiles {
+		return nil
+	}
+	log := job.logEntry()
+	msg := job.message.raw.Message
+	data, err := base64.StdEncoding.DecodeString(msg.Data)
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err, "data": msg.Data}).Errorln("Failed to decode by base64")
+		return err
+	}
+	mf := &MessageFile{
+		MessageId:   msg.MessageId,
+		PublishTime: msg.PublishTime,
+		Attributes:  msg.Attributes,
+		Data:        string(data),
+	}
+	if mf.Attributes == nil {
+		mf.Attributes = map[string]string{}
+	}
+	messageFile := filepath.Join(job.workspace, MessageFileName)
+	if err := writeJSONFile(messageFile, mf); err != nil {
+		log.WithFields(logrus.Fields{"error": err, "path": messageFile}).Errorln("Failed to write message file")
+		return err
+	}
+
+	fileMap := job.downloadFileMap
+	if fileMap == nil {
+		fileMap = map[string]string{}
+	}
+	downloadFilesFile := filepath.Join(job.workspace, DownloadFilesFileName)
+	if err := writeJSONFile(downloadFilesFile, fileMap); err != nil {
+		log.WithFields(logrus.Fields{"error": err, "path": downloadFilesFile}).Errorln("Failed to write download files file")
+		return err
+	}
+
+	job.messageFile = messageFile
+	job.downloadFilesFile = downloadFilesFile
+	return nil
+}
+
+func writeJSONFile(p string, obj interface{}) error {
+	b, err := json.MarshalIndent(obj, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p, b, 0600)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	pubsub "google.golang.org/api/pubsub/v1"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJobPrepareWithMessageFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "message_files")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	newJob := func(messageFiles bool) *Job {
+		return &Job{
+			config: &CommandConfig{
+				Template:     []string{"./app.sh", "%{message_file}", "%{download_files_file}"},
+				MessageFiles: messageFiles,
+			},
+			workspace: dir,
+			message: &JobMessage{
+				raw: &pubsub.ReceivedMessage{
+					Message: &pubsub.PubsubMessage{
+						MessageId:   "msg1",
+						PublishTime: "2018-04-01T12:00:00Z",
+						Attributes: map[string]string{
+							"download_files": `["gs://bucket1/foo.txt"]`,
+						},
+						Data: base64.StdEncoding.EncodeToString([]byte(`{"key1":"value1"}`)),
+					},
+				},
+			},
+		}
+	}
+
+	job := newJob(true)
+	assert.NoError(t, job.prepare())
+	messageFile := filepath.Join(dir, MessageFileName)
+	downloadFilesFile := filepath.Join(dir, DownloadFilesFileName)
+	assert.Equal(t, []string{"./app.sh", messageFile, downloadFilesFile}, job.cmd.Args)
+	assert.Contains(t, job.cmd.Env, "BLOCKS_MESSAGE_FILE="+messageFile)
+	assert.Contains(t, job.cmd.Env, "BLOCKS_DOWNLOAD_FILES_FILE="+downloadFilesFile)
+
+	data, err := ioutil.ReadFile(messageFile)
+	assert.NoError(t, err)
+	mf := &MessageFile{}
+	assert.NoError(t, json.Unmarshal(data, mf))
+	assert.Equal(t, &MessageFile{
+		MessageId:   "msg1",
+		PublishTime: "2018-04-01T12:00:00Z",
+		Attributes:  map[string]string{"download_files": `["gs://bucket1/foo.txt"]`},
+		Data:        `{"key1":"value1"}`,
+	}, mf)
+
+	data, err = ioutil.ReadFile(downloadFilesFile)
+	assert.NoError(t, err)
+	fileMap := map[string]string{}
+	assert.NoError(t, json.Unmarshal(data, &fileMap))
+	assert.Equal(t, map[string]string{"gs://bucket1/foo.txt": filepath.Join(dir, "downloads", "bucket1", "foo.txt")}, fileMap)
+
+	// The variables aren't given without command/message_files
+	assert.NoError(t, os.Remove(messageFile))
+	job = newJob(false)
+	err = job.prepare()
+	if assert.Error(t, err) {
+		AssertCompositeErrorWithInvalidJobError(t, err)
+	}
+	_, err = os.Stat(messageFile)
+	assert.True(t, os.IsNotExist(err))
+}
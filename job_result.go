@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	logrus "github.com/sirupsen/logrus"
+)
+
+const ResultFileName = "result.json"
+
+// MaxRetryAfter is the max ack deadline of Pub/Sub
+const MaxRetryAfter = 10 * time.Minute
+
+// JobResult is what the command declares by result.json in the workspace.
+type JobResult struct {
+	Response   string            `json:"response,omitempty"`
+	RetryAfter string            `json:"retry_after,omitempty"`
+	Message    string            `json:"message,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+
+	response   *ResponseType
+	retryAfter time.Duration
+}
+
+func (r *JobResult) setup() error {
+	if r.Response != "" {
+		rt, err := ParseResponseType(r.Response)
+		if err != nil {
+			return err
+		}
+		r.response = &rt
+	}
+	if r.RetryAfter != "" {
+		d, err := time.ParseDuration(r.RetryAfter)
+		if err != nil {
+			return fmt.Errorf("Invalid retry_after %q", r.RetryAfter)
+		}
+		if d < 0 || d > MaxRetryAfter {
+			return fmt.Errorf("Invalid retry_after %q. It must be between 0s and %v", r.RetryAfter, MaxRetryAfter)
+		}
+		if r.response == nil {
+			rt := NACK
+			r.response = &rt
+		}
+		if *r.response != NACK {
+			return fmt.Errorf("retry_after can't be used with response %q", r.Response)
+		}
+		r.retryAfter = d
+	}
+	return nil
+}
+
+func (job *Job) resultFile() string {
+	return filepath.Join(job.workspace, ResultFileName)
+}
+
+// readResult reads result.json if the command wrote it.
+// The invalid result is ignored with the error log not to lose the result of the command.
+func (job *Job) readResult() {
+	log := job.logEntry().WithFields(logrus.Fields{"path": job.resultFile()})
+	data, err := ioutil.ReadFile(job.resultFile())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.WithFields(logrus.Fields{"error": err}).Errorln("Failed to read result file")
+		}
+		return
+	}
+	r := &JobResult{}
+	if err := json.Unmarshal(data, r); err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Errorln("Invalid result file")
+		return
+	}
+	if err := r.setup(); err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Errorln("Invalid result file")
+		return
+	}
+	log.WithFields(logrus.Fields{"result": r}).Debugln("Result file found")
+	job.result = r
+}
+
+// responseByResult returns the response declared by the command.
+// It's ignored if the job was interrupted or failed after the command.
+func (job *Job) responseByResult(rt ResponseType, err error) ResponseType {
+	if job.result == nil || job.result.response == nil || job.isInterrupted() {
+		return rt
+	}
+	switch err.(type) {
+	case nil, *CommandError, *CommandTimeoutError:
+		return *job.result.response
+	default:
+		return rt
+	}
+}
+
+// reactionFor returns the function to respond to the message by rt.
+// NACK with retry_after modifies the ack deadline so that the message is delivered again after it.
+func (job *Job) reactionFor(rt ResponseType) func() error {
+	if rt == NACK && job.result != nil && job.result.retryAfter > 0 {
+		return func() error {
+			return job.message.NackAfter(job.result.retryAfter)
+		}
+	}
+	return rt.ResponseMethod(job)
+}
+
+// resultSummary returns the attributes and the message declared by the command.
+func (job *Job) resultSummary() (map[string]string, string) {
+	if job.result == nil {
+		return nil, ""
+	}
+	return job.result.Attributes, job.result.Message
+}
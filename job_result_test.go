@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJobResultSetup(t *testing.T) {
+	type pattern struct {
+		result     *JobResult
+		valid      bool
+		response   string
+		retryAfter time.Duration
+	}
+	patterns := []pattern{
+		{&JobResult{}, true, "", 0},
+		{&JobResult{Response: "ack"}, true, "ack", 0},
+		{&JobResult{Response: "NACK", RetryAfter: "5m"}, true, "nack", 5 * time.Minute},
+		{&JobResult{RetryAfter: "30s"}, true, "nack", 30 * time.Second},
+		{&JobResult{Response: "maybe"}, false, "", 0},
+		{&JobResult{Response: "ack", RetryAfter: "5m"}, false, "", 0},
+		{&JobResult{RetryAfter: "1h"}, false, "", 0},
+		{&JobResult{RetryAfter: "soon"}, false, "", 0},
+	}
+	for _, ptn := range patterns {
+		err := ptn.result.setup()
+		if !ptn.valid {
+			assert.Error(t, err, "result %v", ptn.result)
+			continue
+		}
+		assert.NoError(t, err, "result %v", ptn.result)
+		if ptn.response == "" {
+			assert.Nil(t, ptn.result.response)
+		} else if assert.NotNil(t, ptn.result.response) {
+			assert.Equal(t, ptn.response, ptn.result.response.String())
+		}
+		assert.Equal(t, ptn.retryAfter, ptn.result.retryAfter)
+	}
+}
+
+func TestJobResponseByResult(t *testing.T) {
+	nack := NACK
+	job := &Job{result: &JobResult{response: &nack}}
+	assert.Equal(t, NACK, job.responseByResult(ACK, nil))
+	assert.Equal(t, NACK, job.responseByResult(ACK, &CommandError{ExitCode: 1}))
+	assert.Equal(t, NACK, job.responseByResult(ACK, &CommandTimeoutError{}))
+	// Failed after the command
+	assert.Equal(t, ACK, job.responseByResult(ACK, &ChecksumError{}))
+
+	job.interrupted = true
+	assert.Equal(t, ACK, job.responseByResult(ACK, nil))
+
+	job = &Job{result: &JobResult{}}
+	assert.Equal(t, ACK, job.responseByResult(ACK, nil))
+}
+
+func TestJobStepFor(t *testing.T) {
+	assert.Equal(t, ACKSENDING, stepFor(ACK, nil))
+	// Only result.json can make the job which succeeded nack
+	assert.Equal(t, NACKSENDING, stepFor(NACK, nil))
+	assert.Equal(t, CANCELLING, stepFor(NONE, nil))
+	// The failed job is CANCELLING whatever the response is
+	assert.Equal(t, CANCELLING, stepFor(NACK, &CommandError{ExitCode: 1}))
+	assert.Equal(t, CANCELLING, stepFor(ACK, &CommandError{ExitCode: 1}))
+}
+
+func TestProcessRunWithResultFile(t *testing.T) {
+	script := `case $1 in
+  retry)
+    echo '{"retry_after":"5m","message":"not ready","attributes":{"reason":"waiting"}}' > $BLOCKS_RESULT_FILE ;;
+  failed)
+    echo '{"attributes":{"reason":"broken"}}' > $BLOCKS_RESULT_FILE
+    exit 3 ;;
+  invalid)
+    echo '{"response":"maybe"}' > $BLOCKS_RESULT_FILE ;;
+esac
+`
+	tp := newTestProcess(t, script, []string{"%{attrs.case}"}, nil)
+	defer tp.close()
+	ps := tp.ps
+
+	for _, c := range []string{"retry", "failed", "invalid"} {
+		tp.add(c, map[string]string{"case": c})
+	}
+
+	completions := func() map[string]*FilePubsubPublished {
+		res := map[string]*FilePubsubPublished{}
+		for _, msg := range tp.progresses() {
+			switch msg.Attributes["step"] {
+			case ACKSENDING.String(), NACKSENDING.String(), CANCELLING.String():
+			default:
+				continue
+			}
+			if msg.Attributes["step_status"] == SUCCESS.String() {
+				res[msg.Attributes["job_message_id"]] = msg
+			}
+		}
+		return res
+	}
+	started := time.Now()
+	tp.run(func() bool { return len(completions()) == 3 })
+
+	completed := completions()
+
+	// The step is NACKSENDING because the result file declared nack though the command succeeded
+	retry := completed["retry"]
+	assert.Equal(t, "NACKSENDING", retry.Attributes["step"])
+	assert.Equal(t, "nack", retry.Attributes[ResponseKey])
+	assert.Equal(t, "waiting", retry.Attributes["reason"])
+	data, err := base64.StdEncoding.DecodeString(retry.Data)
+	assert.NoError(t, err)
+	assert.Equal(t, "NACKSENDING SUCCESS\nnot ready", string(data))
+
+	failed := completed["failed"]
+	assert.Equal(t, "CANCELLING", failed.Attributes["step"])
+	assert.Equal(t, "ack", failed.Attributes[ResponseKey])
+	assert.Equal(t, "broken", failed.Attributes["reason"])
+
+	invalid := completed["invalid"]
+	assert.Equal(t, "ACKSENDING", invalid.Attributes["step"])
+	assert.Equal(t, "", invalid.Attributes[ResponseKey])
+
+	// Only the message to retry remains until its deadline
+	if assert.Equal(t, 1, ps.Remaining()) {
+		m := ps.messages[0]
+		assert.Equal(t, "retry", m.message.MessageId)
+		assert.True(t, m.deadline.After(started.Add(4*time.Minute)))
+	}
+}
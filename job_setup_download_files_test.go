@@ -3,6 +3,9 @@ package main
 import (
 	"encoding/base64"
 	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -413,3 +416,62 @@ func TestJobSetupWithUseDataAsAttributes(t *testing.T) {
 
 	assert.Equal(t, []interface{}{url2, url3}, job.message.DownloadFiles())
 }
+
+func TestJobSetupDownloadFilesWithPrefixAndWildcard(t *testing.T) {
+	root, err := ioutil.TempDir("", "local-storage")
+	assert.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	ls := &LocalStorage{Root: root}
+	src := filepath.Join(root, "src.txt")
+	assert.NoError(t, ioutil.WriteFile(src, []byte("foo"), 0644))
+	for _, obj := range []string{"run-42/a.txt", "run-42/sub/b.txt", "run-43/c.txt", "logs/1.csv", "logs/2.csv", "logs/3.json", "logs/old/4.csv"} {
+		assert.NoError(t, ls.Upload("bucket1", obj, src))
+	}
+
+	workspace := "/tmp/workspace"
+	downloads_dir := workspace + "/downloads"
+	newJob := func(downloadFiles string) *Job {
+		return &Job{
+			config: &CommandConfig{
+				Template: []string{"cmd1", "%{download_files}"},
+			},
+			message: &JobMessage{
+				raw: &pubsub.ReceivedMessage{
+					AckId: "test-ack1",
+					Message: &pubsub.PubsubMessage{
+						Attributes: map[string]string{"download_files": downloadFiles},
+						MessageId:  "test-message1",
+					},
+				},
+			},
+			storage:       ls,
+			workspace:     workspace,
+			downloads_dir: downloads_dir,
+			uploads_dir:   workspace + "/uploads",
+		}
+	}
+
+	job := newJob(`{"run":"gs://bucket1/run-42/","logs":"gs://bucket1/logs/*.csv","one":"gs://bucket1/run-43/c.txt"}`)
+	job.remoteDownloadFiles = job.message.DownloadFiles()
+	err = job.setupDownloadFiles()
+	assert.NoError(t, err)
+
+	assert.Equal(t, map[string]interface{}{
+		"run":  []interface{}{"gs://bucket1/run-42/a.txt", "gs://bucket1/run-42/sub/b.txt"},
+		"logs": []interface{}{"gs://bucket1/logs/1.csv", "gs://bucket1/logs/2.csv"},
+		"one":  "gs://bucket1/run-43/c.txt",
+	}, job.remoteDownloadFiles)
+	assert.Equal(t, map[string]interface{}{
+		"run":  []interface{}{downloads_dir + "/bucket1/run-42/a.txt", downloads_dir + "/bucket1/run-42/sub/b.txt"},
+		"logs": []interface{}{downloads_dir + "/bucket1/logs/1.csv", downloads_dir + "/bucket1/logs/2.csv"},
+		"one":  downloads_dir + "/bucket1/run-43/c.txt",
+	}, job.localDownloadFiles)
+	assert.Equal(t, 5, len(job.downloadFileMap))
+
+	// No object found
+	job = newJob(`["gs://bucket1/unknown/*.csv"]`)
+	job.remoteDownloadFiles = job.message.DownloadFiles()
+	err = job.setupDownloadFiles()
+	assert.IsType(t, &InvalidJobError{}, err)
+}
@@ -44,6 +44,7 @@ const (
 	NACKSENDING
 	CANCELLING
 	ACKSENDING
+	PUBLISHING
 )
 
 var (
@@ -56,6 +57,7 @@ var (
 		NACKSENDING:  JobStepDef{"NACKSENDING", logrus.WarnLevel, logrus.ErrorLevel, RETRYING},
 		CANCELLING:   JobStepDef{"CANCELLING", logrus.ErrorLevel, logrus.FatalLevel, INVALID_JOB},
 		ACKSENDING:   JobStepDef{"ACKSENDING", logrus.InfoLevel, logrus.FatalLevel, COMPLETED},
+		PUBLISHING:   JobStepDef{"PUBLISHING", logrus.DebugLevel, logrus.ErrorLevel, WORKING},
 	}
 )
 
@@ -89,7 +91,7 @@ func (js JobStep) logLevelFor(st JobStepStatus) logrus.Level {
 }
 func (js JobStep) progressFor(st JobStepStatus) Progress {
 	switch js {
-	case INITIALIZING, DOWNLOADING, EXECUTING, UPLOADING, CLEANUP:
+	case INITIALIZING, DOWNLOADING, EXECUTING, UPLOADING, PUBLISHING, CLEANUP:
 		return js.baseProgress()
 	case NACKSENDING, CANCELLING, ACKSENDING:
 		switch st {
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"sync"
 	"time"
 
 	pubsub "google.golang.org/api/pubsub/v1"
@@ -11,29 +12,160 @@ import (
 type JobSubscription struct {
 	config *JobSubscriptionConfig
 	puller Puller
+	health *Health
+
+	// slots limits the number of jobs running at the same time
+	slots    chan struct{}
+	errors   chan error
+	stopping chan struct{}
+	wg       sync.WaitGroup
+
+	setupOnce sync.Once
+	stopOnce  sync.Once
 }
 
+// listen returns nil without waiting for the running jobs when stop is called.
 func (s *JobSubscription) listen(f func(*JobMessage) error) error {
+	s.setup()
 	for {
+		if s.stopped() {
+			s.health.LoopChanged(LoopStopped)
+			log.WithFields(logrus.Fields{"subscription": s.config.Subscription}).Infoln("Stop listening")
+			return nil
+		}
 		executed, err := s.process(f)
 		if err != nil {
+			s.health.LoopChanged(LoopFailed)
+			s.wg.Wait()
 			return err
 		}
 		if !executed {
-			time.Sleep(time.Duration(s.config.PullInterval) * time.Second)
+			s.health.LoopChanged(LoopSleeping)
+			select {
+			case <-s.stopping:
+			case <-time.After(time.Duration(s.config.PullInterval) * time.Second):
+			}
 		}
 	}
 }
 
+func (s *JobSubscription) setup() {
+	s.setupOnce.Do(func() {
+		concurrency := s.config.Concurrency
+		if concurrency < 1 {
+			concurrency = 1
+		}
+		s.slots = make(chan struct{}, concurrency)
+		s.errors = make(chan error, concurrency)
+		s.stopping = make(chan struct{})
+	})
+}
+
+// stop makes listen quit pulling new messages.
+func (s *JobSubscription) stop() {
+	s.setup()
+	s.stopOnce.Do(func() {
+		close(s.stopping)
+	})
+}
+
+func (s *JobSubscription) stopped() bool {
+	select {
+	case <-s.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// wait returns true if all of the running jobs finish in timeout.
+func (s *JobSubscription) wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// waitAll waits for all of the running jobs without timeout.
+func (s *JobSubscription) waitAll() {
+	s.wg.Wait()
+}
+
+// process waits for at least one free slot, pulls messages as many as
+// the free slots and starts a goroutine for each message.
 func (s *JobSubscription) process(f func(*JobMessage) error) (bool, error) {
-	msg, err := s.waitForMessage()
+	s.setup()
+
+	s.health.LoopChanged(LoopWaitingForSlots)
+	n, err := s.reserveSlots()
+	if err != nil {
+		return false, err
+	}
+	if n == 0 {
+		return false, nil
+	}
+
+	s.health.LoopChanged(LoopPulling)
+	msgs, err := s.waitForMessages(n)
 	if err != nil {
+		s.releaseSlots(n)
 		return false, err
 	}
-	if msg == nil {
+	s.health.Pulled()
+	if s.stopped() {
+		s.releaseSlots(n)
+		s.nack(msgs)
+		return false, nil
+	}
+	s.releaseSlots(n - len(msgs))
+	if len(msgs) == 0 {
 		return false, nil
 	}
 
+	for _, msg := range msgs {
+		s.wg.Add(1)
+		go s.handle(f, msg)
+	}
+	return true, nil
+}
+
+func (s *JobSubscription) reserveSlots() (int, error) {
+	select {
+	case err := <-s.errors:
+		return 0, err
+	case <-s.stopping:
+		return 0, nil
+	case s.slots <- struct{}{}:
+	}
+	n := 1
+	for n < cap(s.slots) {
+		select {
+		case s.slots <- struct{}{}:
+			n++
+		default:
+			return n, nil
+		}
+	}
+	return n, nil
+}
+
+func (s *JobSubscription) releaseSlots(n int) {
+	for i := 0; i < n; i++ {
+		<-s.slots
+	}
+}
+
+func (s *JobSubscription) handle(f func(*JobMessage) error, msg *pubsub.ReceivedMessage) {
+	defer s.wg.Done()
+	defer s.releaseSlots(1)
+
 	logger := log.WithFields(logrus.Fields{"job_message_id": msg.Message.MessageId, "message": msg.Message})
 	logger.Infoln("Message received")
 	defer logger.Infoln("Message processed")
@@ -46,24 +178,70 @@ func (s *JobSubscription) process(f func(*JobMessage) error) (bool, error) {
 		status: running,
 	}
 
-	return true, f(jobMsg)
+	err := f(jobMsg)
+	if err != nil {
+		// Only the first error is needed to stop listening
+		select {
+		case s.errors <- err:
+		default:
+		}
+	}
+}
+
+// nack returns the messages pulled while stopping to the subscription.
+func (s *JobSubscription) nack(msgs []*pubsub.ReceivedMessage) {
+	if len(msgs) == 0 {
+		return
+	}
+	ackIds := []string{}
+	for _, msg := range msgs {
+		ackIds = append(ackIds, msg.AckId)
+	}
+	logAttrs := logrus.Fields{"subscription": s.config.Subscription, "ack_ids": ackIds}
+	_, err := s.puller.ModifyAckDeadline(s.config.Subscription, ackIds, 0)
+	if err != nil {
+		logAttrs["error"] = err
+		log.WithFields(logAttrs).Errorln("Failed to nack messages pulled while stopping")
+		return
+	}
+	log.WithFields(logAttrs).Infoln("Nacked messages pulled while stopping")
 }
 
-func (s *JobSubscription) waitForMessage() (*pubsub.ReceivedMessage, error) {
+func (s *JobSubscription) waitForMessages(max int) ([]*pubsub.ReceivedMessage, error) {
+	s.setup()
 	pullRequest := &pubsub.PullRequest{
 		ReturnImmediately: false,
-		MaxMessages:       1,
+		MaxMessages:       int64(max),
 	}
-	res, err := s.puller.Pull(s.config.Subscription, pullRequest)
-	if err != nil {
-		log.WithFields(logrus.Fields{"subscription": s.config.Subscription, "error": err}).Errorln("Failed to pull")
-		return nil, err
+	type pulled struct {
+		res *pubsub.PullResponse
+		err error
 	}
-	if res == nil {
+	done := make(chan pulled, 1)
+	go func() {
+		res, err := s.puller.Pull(s.config.Subscription, pullRequest)
+		done <- pulled{res, err}
+	}()
+
+	var r pulled
+	select {
+	case r = <-done:
+	case <-s.stopping:
+		// Pull can't be cancelled, so the messages pulled after stopping are sent back later
+		go func() {
+			r := <-done
+			if r.err == nil && r.res != nil {
+				s.nack(r.res.ReceivedMessages)
+			}
+		}()
 		return nil, nil
 	}
-	if len(res.ReceivedMessages) == 0 {
+	if r.err != nil {
+		log.WithFields(logrus.Fields{"subscription": s.config.Subscription, "error": r.err}).Errorln("Failed to pull")
+		return nil, r.err
+	}
+	if r.res == nil {
 		return nil, nil
 	}
-	return res.ReceivedMessages[0], nil
+	return r.res.ReceivedMessages, nil
 }
@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"strconv"
+	"time"
 
 	logrus "github.com/sirupsen/logrus"
 )
@@ -9,12 +11,25 @@ import (
 type JobSubscriptionConfig struct {
 	Subscription     string              `json:"subscription,omitempty"`
 	PullInterval     int                 `json:"pull_interval,omitempty"`
+	Concurrency      int                 `json:"concurrency,omitempty"`
+	GracePeriod      *int                `json:"grace_period,omitempty"`
+	MaxDeliveries    int                 `json:"max_deliveries,omitempty"`
+	DeadLetterTopic  string              `json:"dead_letter_topic,omitempty"`
+	DeadLetterOnAck  bool                `json:"dead_letter_on_ack,omitempty"`
 	Sustainer        *JobSustainerConfig `json:"sustainer,omitempty"`
 	IntervalOnError  int                 `json:"interval_on_error,omitempty"`
 	ErrorResponseStr string              `json:"error_response,omitempty"`
 	ErrorResponse    ResponseType        `json:"-"`
+
+	TimeoutResponseStr string       `json:"timeout_response,omitempty"`
+	TimeoutResponse    ResponseType `json:"-"`
+
+	ExitCodeResponsesStr map[string]string       `json:"exit_code_responses,omitempty"`
+	ExitCodeResponses    map[string]ResponseType `json:"-"`
 }
 
+const DefaultExitCodeResponseKey = "default"
+
 func (c *JobSubscriptionConfig) setup() *ConfigError {
 	if c.Subscription == "" {
 		c.Subscription = fmt.Sprintf("projects/%s/subscriptions/%s-job-subscription", GcpProjectId, Pipeline)
@@ -22,6 +37,17 @@ func (c *JobSubscriptionConfig) setup() *ConfigError {
 	if c.PullInterval == 0 {
 		c.PullInterval = 10
 	}
+	if c.Concurrency < 1 {
+		c.Concurrency = 1
+	}
+	// grace_period can be 0 to interrupt the jobs right after the signal
+	if c.GracePeriod == nil {
+		grace := 30
+		c.GracePeriod = &grace
+	}
+	if *c.GracePeriod < 0 {
+		return &ConfigError{Name: "grace_period", Message: fmt.Sprintf("%d is invalid. It must not be negative", *c.GracePeriod)}
+	}
 	if c.Sustainer == nil {
 		c.Sustainer = &JobSustainerConfig{}
 	}
@@ -34,9 +60,46 @@ func (c *JobSubscriptionConfig) setup() *ConfigError {
 	}
 	c.ErrorResponse = rt
 
+	if c.TimeoutResponseStr == "" {
+		c.TimeoutResponseStr = c.ErrorResponseStr
+	}
+	rt, err = ParseResponseType(c.TimeoutResponseStr)
+	if err != nil {
+		return &ConfigError{Name: "timeout_response", Message: fmt.Sprintf("%q is invalid because of %v", c.TimeoutResponseStr, err)}
+	}
+	c.TimeoutResponse = rt
+
+	c.ExitCodeResponses = map[string]ResponseType{}
+	for code, str := range c.ExitCodeResponsesStr {
+		// The keys like "02" and "+2" are stored as "2" to match the exit code
+		key := code
+		if code != DefaultExitCodeResponseKey {
+			n, err := strconv.Atoi(code)
+			if err != nil {
+				return &ConfigError{Name: "exit_code_responses", Message: fmt.Sprintf("%q is invalid exit code. It must be an integer or %q", code, DefaultExitCodeResponseKey)}
+			}
+			key = strconv.Itoa(n)
+		}
+		if _, ok := c.ExitCodeResponses[key]; ok {
+			return &ConfigError{Name: "exit_code_responses", Message: fmt.Sprintf("%q is duplicated exit code", code)}
+		}
+		rt, err := ParseResponseType(str)
+		if err != nil {
+			return &ConfigError{Name: "exit_code_responses", Message: fmt.Sprintf("%q for %q is invalid because of %v", str, code, err)}
+		}
+		c.ExitCodeResponses[key] = rt
+	}
+
 	return nil
 }
 
+func (c *JobSubscriptionConfig) gracePeriod() time.Duration {
+	if c.GracePeriod == nil {
+		return 0
+	}
+	return time.Duration(*c.GracePeriod) * time.Second
+}
+
 func (c *JobSubscriptionConfig) setupSustainer(puller Puller) error {
 	flds := logrus.Fields{"subscription": c.Subscription}
 	if c.Sustainer == nil {
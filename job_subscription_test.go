@@ -1,7 +1,9 @@
 package main
 
 import (
+	"sync"
 	"testing"
+	"time"
 
 	pubsub "google.golang.org/api/pubsub/v1"
 
@@ -165,3 +167,211 @@ func TestJobSubscriptionProcess(t *testing.T) {
 	assert.False(t, executed)
 	assert.NoError(t, error)
 }
+
+type RecordingPuller struct {
+	DummyPuller
+	maxMessages []int64
+}
+
+func (p *RecordingPuller) Pull(subscription string, pullrequest *pubsub.PullRequest) (*pubsub.PullResponse, error) {
+	p.maxMessages = append(p.maxMessages, pullrequest.MaxMessages)
+	return p.DummyPuller.Pull(subscription, pullrequest)
+}
+
+func TestJobSubscriptionProcessConcurrently(t *testing.T) {
+	newMsg := func(id string) *pubsub.ReceivedMessage {
+		return &pubsub.ReceivedMessage{
+			AckId:   "dummy-ack-" + id,
+			Message: &pubsub.PubsubMessage{MessageId: id},
+		}
+	}
+	puller := &RecordingPuller{
+		DummyPuller: DummyPuller{
+			responses: []*pubsub.PullResponse{
+				&pubsub.PullResponse{
+					ReceivedMessages: []*pubsub.ReceivedMessage{newMsg("dummy-msg-id1"), newMsg("dummy-msg-id2")},
+				},
+				&pubsub.PullResponse{
+					ReceivedMessages: []*pubsub.ReceivedMessage{newMsg("dummy-msg-id3")},
+				},
+			},
+		},
+	}
+
+	s := &JobSubscription{
+		config: &JobSubscriptionConfig{
+			Subscription: "projects/dummy-proj-999/subscriptions/test01-job-subscription",
+			PullInterval: 10,
+			Concurrency:  3,
+			Sustainer:    &JobSustainerConfig{Disabled: true},
+		},
+		puller: puller,
+	}
+
+	started := make(chan string, 3)
+	finish := make(chan struct{})
+	f := func(msg *JobMessage) error {
+		started <- msg.MessageId()
+		<-finish
+		return nil
+	}
+
+	executed, err := s.process(f)
+	assert.True(t, executed)
+	assert.NoError(t, err)
+	// Both jobs are running at the same time
+	ids := []string{<-started, <-started}
+	assert.ElementsMatch(t, []string{"dummy-msg-id1", "dummy-msg-id2"}, ids)
+
+	// Only one slot is left
+	executed, err = s.process(f)
+	assert.True(t, executed)
+	assert.NoError(t, err)
+	assert.Equal(t, "dummy-msg-id3", <-started)
+	assert.Equal(t, []int64{3, 1}, puller.maxMessages)
+
+	close(finish)
+	s.wg.Wait()
+}
+
+type NackRecordingPuller struct {
+	DummyPuller
+	// Pull blocks until release is closed if it's given
+	release      chan struct{}
+	mux          sync.Mutex
+	nackedAckIds []string
+}
+
+func (p *NackRecordingPuller) Pull(subscription string, pullrequest *pubsub.PullRequest) (*pubsub.PullResponse, error) {
+	if p.release != nil {
+		<-p.release
+	}
+	return p.DummyPuller.Pull(subscription, pullrequest)
+}
+
+func (p *NackRecordingPuller) ModifyAckDeadline(subscription string, ackIds []string, ackDeadlineSeconds int64) (*pubsub.Empty, error) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if ackDeadlineSeconds == 0 {
+		p.nackedAckIds = append(p.nackedAckIds, ackIds...)
+	}
+	return nil, nil
+}
+
+func (p *NackRecordingPuller) nacked() []string {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	return append([]string{}, p.nackedAckIds...)
+}
+
+func TestJobSubscriptionStop(t *testing.T) {
+	release := make(chan struct{})
+	puller := &NackRecordingPuller{
+		DummyPuller: DummyPuller{
+			responses: []*pubsub.PullResponse{
+				&pubsub.PullResponse{
+					ReceivedMessages: []*pubsub.ReceivedMessage{
+						&pubsub.ReceivedMessage{
+							AckId:   "dummy-ack-id1",
+							Message: &pubsub.PubsubMessage{MessageId: "dummy-msg-id1"},
+						},
+					},
+				},
+			},
+		},
+		release: release,
+	}
+
+	s := &JobSubscription{
+		config: &JobSubscriptionConfig{
+			Subscription: "projects/dummy-proj-999/subscriptions/test01-job-subscription",
+			PullInterval: 10,
+			Sustainer:    &JobSustainerConfig{Disabled: true},
+		},
+		puller: puller,
+	}
+
+	called := false
+	f := func(msg *JobMessage) error {
+		called = true
+		return nil
+	}
+
+	// stop doesn't wait for the pull which is blocking
+	pulled := make(chan []*pubsub.ReceivedMessage, 1)
+	go func() {
+		msgs, err := s.waitForMessages(1)
+		assert.NoError(t, err)
+		pulled <- msgs
+	}()
+	s.stop()
+	assert.True(t, s.stopped())
+	select {
+	case msgs := <-pulled:
+		assert.Empty(t, msgs)
+	case <-time.After(time.Second):
+		assert.Fail(t, "waitForMessages didn't return after stop")
+	}
+
+	// The message pulled after stopping is sent back without running the job
+	close(release)
+	for i := 0; i < 100 && len(puller.nacked()) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, []string{"dummy-ack-id1"}, puller.nacked())
+
+	err := s.listen(f)
+	assert.NoError(t, err)
+	assert.False(t, called)
+	assert.True(t, s.wait(time.Second))
+}
+
+func TestJobSubscriptionConfigSetupGracePeriod(t *testing.T) {
+	jc := &JobSubscriptionConfig{}
+	assert.Nil(t, jc.setup())
+	assert.Equal(t, 30*time.Second, jc.gracePeriod())
+
+	// 0 isn't replaced with the default
+	grace := 0
+	jc = &JobSubscriptionConfig{GracePeriod: &grace}
+	assert.Nil(t, jc.setup())
+	assert.Equal(t, time.Duration(0), jc.gracePeriod())
+
+	grace = -1
+	jc = &JobSubscriptionConfig{GracePeriod: &grace}
+	assert.NotNil(t, jc.setup())
+}
+
+func TestJobSubscriptionConfigSetupExitCodeResponses(t *testing.T) {
+	jc := &JobSubscriptionConfig{
+		ExitCodeResponsesStr: map[string]string{"2": "ack", "default": "nack"},
+	}
+	assert.Nil(t, jc.setup())
+	assert.Equal(t, map[string]ResponseType{"2": ACK, "default": NACK}, jc.ExitCodeResponses)
+
+	jc = &JobSubscriptionConfig{
+		ExitCodeResponsesStr: map[string]string{"foo": "ack"},
+	}
+	assert.NotNil(t, jc.setup())
+
+	jc = &JobSubscriptionConfig{
+		ExitCodeResponsesStr: map[string]string{"1": "retry"},
+	}
+	assert.NotNil(t, jc.setup())
+
+	jc = &JobSubscriptionConfig{
+		ExitCodeResponsesStr: map[string]string{"02": "ack", "+3": "nack"},
+	}
+	assert.Nil(t, jc.setup())
+	assert.Equal(t, map[string]ResponseType{"2": ACK, "3": NACK}, jc.ExitCodeResponses)
+
+	jc = &JobSubscriptionConfig{
+		ExitCodeResponsesStr: map[string]string{"2": "ack", "02": "nack"},
+	}
+	assert.NotNil(t, jc.setup())
+
+	jc = &JobSubscriptionConfig{
+		ExitCodeResponsesStr: map[string]string{" 2": "ack"},
+	}
+	assert.NotNil(t, jc.setup())
+}
@@ -2,9 +2,14 @@ package main
 
 import (
 	"bytes"
+	"fmt"
+	"os"
 	"os/exec"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/groovenauts/concurrent-go"
 	"github.com/stretchr/testify/assert"
 
 	pubsub "google.golang.org/api/pubsub/v1"
@@ -14,6 +19,7 @@ const (
 	workspace     = "/tmp/workspace"
 	downloads_dir = workspace + "/downloads"
 	uploads_dir   = workspace + "/uploads"
+	outbox_dir    = workspace + "/outbox"
 )
 
 func NewBasicJob() *Job {
@@ -24,6 +30,7 @@ func NewBasicJob() *Job {
 		workspace:           workspace,
 		downloads_dir:       downloads_dir,
 		uploads_dir:         uploads_dir,
+		outbox_dir:          outbox_dir,
 		localDownloadFiles:  []string{downloads_dir + "/bucket1/foo"},
 		remoteDownloadFiles: []string{"gs://bucket1/foo"},
 		message: &JobMessage{
@@ -119,6 +126,56 @@ func TestJobBuildWithInvalidDownloadFilesReference(t *testing.T) {
 	}
 }
 
+func TestJobBuildWithEnv(t *testing.T) {
+	job := NewBasicJob()
+	job.execUUID = "uuid1"
+	job.message.raw.Message.MessageId = "msg1"
+	job.message.raw.Message.Attributes[ConcurrentBatchJobIdKey] = "job1"
+	job.config.AttributesEnvPrefix = "ATTR_"
+	job.config.Env = map[string]string{
+		"INPUT":    "%{download_files.0}",
+		"FOO":      "%{attrs.map.foo}",
+		"ATTR_MAP": "overridden",
+	}
+	assert.Nil(t, job.config.setup())
+	err := job.build()
+	assert.NoError(t, err)
+
+	env := job.cmd.Env
+	n := len(os.Environ())
+	assert.Equal(t, os.Environ(), env[:n])
+	assert.Equal(t, []string{
+		"BLOCKS_WORKSPACE=" + workspace,
+		"BLOCKS_DOWNLOADS_DIR=" + downloads_dir,
+		"BLOCKS_UPLOADS_DIR=" + uploads_dir,
+		"BLOCKS_OUTBOX_DIR=" + outbox_dir,
+		"BLOCKS_MESSAGE_ID=msg1",
+		"BLOCKS_EXEC_UUID=uuid1",
+		"BLOCKS_JOB_ID=job1",
+		"BLOCKS_RESULT_FILE=" + workspace + "/result.json",
+		"ATTR_ARRAY=[100,200,300]",
+		"ATTR_CONCURRENT_BATCH_JOB_ID=job1",
+		`ATTR_MAP={"foo":"A"}`,
+		"ATTR_MAP=overridden",
+		"FOO=A",
+		"INPUT=" + downloads_dir + "/bucket1/foo",
+	}, env[n:])
+}
+
+func TestJobBuildWithInvalidEnv(t *testing.T) {
+	job := NewBasicJob()
+	job.config.Env = map[string]string{"FOO": "%{attrs.unknown}"}
+	err := job.build()
+	if assert.Error(t, err) {
+		AssertCompositeErrorWithInvalidJobError(t, err)
+	}
+
+	c := &CommandConfig{Env: map[string]string{"FOO-BAR": "baz"}}
+	assert.NotNil(t, c.setup())
+	c = &CommandConfig{AttributesEnvPrefix: "ATTR-"}
+	assert.NotNil(t, c.setup())
+}
+
 func TestJobExecuteWithDryrun(t *testing.T) {
 	patterns := []struct {
 		dryrun   bool
@@ -143,3 +200,160 @@ func TestJobExecuteWithDryrun(t *testing.T) {
 		assert.Equal(t, ptn.expected, b.String())
 	}
 }
+
+func TestJobExecuteAfterSignal(t *testing.T) {
+	b := new(bytes.Buffer)
+	cmd := exec.Command("echo", "foo")
+	cmd.Stdout = b
+	cmd.Stderr = b
+	job := &Job{
+		cmd:          cmd,
+		config:       &CommandConfig{},
+		outputBuffer: b,
+	}
+	assert.False(t, job.isInterrupted())
+	err := job.signal(syscall.SIGTERM)
+	assert.NoError(t, err)
+	assert.True(t, job.isInterrupted())
+
+	// The command doesn't start after the job is interrupted
+	err = job.execute()
+	assert.Error(t, err)
+	assert.Nil(t, cmd.Process)
+	assert.Equal(t, "", b.String())
+}
+
+func TestJobInterruptCancelsTransfers(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	type testcase struct {
+		name string
+		f    func(*concurrent.Job) error
+	}
+	cases := []testcase{
+		// The try doesn't finish by itself
+		{"running", func(*concurrent.Job) error {
+			<-release
+			return nil
+		}},
+		// The retry waits for the interval
+		{"sleeping", func(*concurrent.Job) error {
+			return fmt.Errorf("Temporary error")
+		}},
+	}
+	for _, c := range cases {
+		job := &Job{}
+		rf := &RetryableFunc{
+			name:     "download",
+			maxTries: 3,
+			interval: time.Minute,
+			cancel:   job.cancelled(),
+		}
+		errs := make(chan error, 1)
+		go func(f func(*concurrent.Job) error) {
+			errs <- rf.Wrap(f)(&concurrent.Job{Payload: &Target{}})
+		}(c.f)
+		time.Sleep(50 * time.Millisecond)
+		assert.NoError(t, job.interrupt())
+		assert.True(t, job.isInterrupted())
+		select {
+		case err := <-errs:
+			assert.IsType(t, (*TransferCancelledError)(nil), err, c.name)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: the transfer isn't cancelled", c.name)
+		}
+	}
+}
+
+func TestJobExecuteWithTimeout(t *testing.T) {
+	config := &CommandConfig{Timeout: "100ms", KillAfter: "100ms"}
+	assert.Nil(t, config.setup())
+
+	b := new(bytes.Buffer)
+	// The command ignores SIGTERM so SIGKILL is sent after kill_after
+	cmd := exec.Command("sh", "-c", "trap '' TERM; echo started; sleep 10")
+	cmd.Stdout = b
+	cmd.Stderr = b
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	job := &Job{
+		cmd:          cmd,
+		config:       config,
+		outputBuffer: b,
+		timeout:      config.timeout,
+	}
+	start := time.Now()
+	err := job.execute()
+	assert.True(t, time.Since(start) < 5*time.Second)
+	if assert.IsType(t, (*CommandTimeoutError)(nil), err) {
+		assert.Regexp(t, "timed out after 100ms", err.Error())
+		assert.Regexp(t, "started", err.Error())
+	}
+}
+
+func TestJobSetupTimeout(t *testing.T) {
+	config := &CommandConfig{Timeout: "30m"}
+	assert.Nil(t, config.setup())
+
+	job := NewBasicJob()
+	job.config = config
+	assert.NoError(t, job.setupTimeout())
+	assert.Equal(t, 30*time.Minute, job.timeout)
+
+	// Overridden by the message attribute
+	job.message.raw.Message.Attributes[CommandTimeoutKey] = "90s"
+	assert.NoError(t, job.setupTimeout())
+	assert.Equal(t, 90*time.Second, job.timeout)
+
+	job.message.raw.Message.Attributes[CommandTimeoutKey] = "invalid"
+	err := job.setupTimeout()
+	assert.IsType(t, (*InvalidJobError)(nil), err)
+
+	// The message can't disable the timeout
+	for _, str := range []string{"0s", "0", "-1m"} {
+		job.message.raw.Message.Attributes[CommandTimeoutKey] = str
+		err = job.setupTimeout()
+		assert.IsType(t, (*InvalidJobError)(nil), err, str)
+	}
+}
+
+func TestJobResponseFor(t *testing.T) {
+	jc := &JobSubscriptionConfig{
+		ErrorResponseStr: "ack",
+		ExitCodeResponsesStr: map[string]string{
+			"2":       "ack",
+			"75":      "nack",
+			"default": "none",
+		},
+	}
+	assert.Nil(t, jc.setup())
+
+	job := &Job{
+		ErrorResponse:     jc.ErrorResponse,
+		TimeoutResponse:   jc.TimeoutResponse,
+		ExitCodeResponses: jc.ExitCodeResponses,
+	}
+	assert.Equal(t, ACK, job.responseFor(&CommandError{ExitCode: 2}))
+	assert.Equal(t, NACK, job.responseFor(&CommandError{ExitCode: 75}))
+	assert.Equal(t, NONE, job.responseFor(&CommandError{ExitCode: 1}))
+	// Errors except for the command exit use error_response
+	assert.Equal(t, ACK, job.responseFor(fmt.Errorf("download error")))
+	assert.Equal(t, ACK, job.responseFor(&CommandTimeoutError{}))
+}
+
+func TestJobExecuteWithExitCode(t *testing.T) {
+	b := new(bytes.Buffer)
+	cmd := exec.Command("sh", "-c", "echo failed; exit 75")
+	cmd.Stdout = b
+	cmd.Stderr = b
+	job := &Job{
+		cmd:          cmd,
+		config:       &CommandConfig{},
+		outputBuffer: b,
+	}
+	err := job.execute()
+	if assert.IsType(t, (*CommandError)(nil), err) {
+		assert.Equal(t, 75, err.(*CommandError).ExitCode)
+		assert.Regexp(t, "failed", err.Error())
+	}
+}
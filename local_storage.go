@@ -0,0 +1,468 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/api/googleapi"
+	storage "google.golang.org/api/storage/v1"
+
+	"github.com/marcacohen/gcslock"
+	logrus "github.com/sirupsen/logrus"
+)
+
+type (
+	// LocalStorage maps gs://bucket/object to Root/bucket/object.
+	// The metadata of the objects are stored in Root/.metadata/bucket/object.json
+	// which can't be a bucket because bucket names must start with a letter or a number.
+	LocalStorage struct {
+		Root             string
+		ContentTypeByExt bool
+
+		// hashes caches the hashes of the files by their paths
+		hashes    map[string]*localFileHash
+		hashesMux sync.Mutex
+	}
+
+	// localFileHash is the hashes of the file which has size and modTime
+	localFileHash struct {
+		size    int64
+		modTime time.Time
+		crc32c  string
+		md5Hash string
+	}
+
+	localObjectAttrs struct {
+		ContentType     string            `json:"contentType,omitempty"`
+		CacheControl    string            `json:"cacheControl,omitempty"`
+		ContentEncoding string            `json:"contentEncoding,omitempty"`
+		Metadata        map[string]string `json:"metadata,omitempty"`
+	}
+)
+
+const LocalStorageMetadataDir = ".metadata"
+
+func (ls *LocalStorage) objectPath(bucket, object string) (string, error) {
+	base := filepath.Join(ls.Root, bucket)
+	p := filepath.Join(base, filepath.FromSlash(object))
+	if bucket == "" || strings.HasPrefix(bucket, ".") || !strings.HasPrefix(p, base+string(filepath.Separator)) {
+		return "", fmt.Errorf("Invalid object gs://%s/%s for local storage", bucket, object)
+	}
+	return p, nil
+}
+
+func (ls *LocalStorage) attrsPath(bucket, object string) string {
+	return filepath.Join(ls.Root, LocalStorageMetadataDir, bucket, filepath.FromSlash(object)+".json")
+}
+
+func (ls *LocalStorage) notFound(bucket, object string) error {
+	return &googleapi.Error{
+		Code:    http.StatusNotFound,
+		Message: fmt.Sprintf("No such object: %s/%s", bucket, object),
+	}
+}
+
+func (ls *LocalStorage) Download(bucket, object, destPath string) error {
+	log := log.WithFields(logrus.Fields{"url": "gs://" + bucket + "/" + object, "destPath": destPath})
+	log.Debugln("Downloading")
+	src, err := ls.objectPath(bucket, object)
+	if err != nil {
+		return err
+	}
+	obj, err := ls.Get(bucket, object)
+	if err != nil {
+		return err
+	}
+	if obj == nil {
+		err = ls.notFound(bucket, object)
+		log.WithFields(logrus.Fields{"error": err}).Warnf("Failed to download")
+		return err
+	}
+	h := NewObjectHash()
+	n, err := ls.copyFile(src, destPath, h)
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Warnf("Failed to download")
+		return err
+	}
+	err = h.Verify("gs://"+bucket+"/"+object, obj)
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Warnf("Failed to verify downloaded file")
+		return err
+	}
+	log.WithFields(logrus.Fields{"size": n}).Debugln("Download successfully")
+	return nil
+}
+
+func (ls *LocalStorage) Upload(bucket, object, srcPath string) error {
+	return ls.UploadObject(bucket, &storage.Object{Name: object}, srcPath, nil)
+}
+
+// UploadObject checks NoClobber of opts before copying the file.
+// Note that it isn't atomic unlike the precondition of GCS.
+func (ls *LocalStorage) UploadObject(bucket string, obj *storage.Object, srcPath string, opts *UploadOptions) error {
+	object := obj.Name
+	logAttrs := logrus.Fields{"url": "gs://" + bucket + "/" + object, "srcPath": srcPath}
+	log.WithFields(logAttrs).Debugln("Uploading")
+	dest, err := ls.objectPath(bucket, object)
+	if err != nil {
+		return err
+	}
+	if opts.noClobber() {
+		existing, err := ls.Get(bucket, object)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			return &ObjectExistsError{URL: "gs://" + bucket + "/" + object}
+		}
+	}
+	attrs := &localObjectAttrs{
+		ContentType:     obj.ContentType,
+		CacheControl:    obj.CacheControl,
+		ContentEncoding: obj.ContentEncoding,
+		Metadata:        obj.Metadata,
+	}
+	if attrs.ContentType == "" && ls.ContentTypeByExt {
+		attrs.ContentType = mime.TypeByExtension(path.Ext(object))
+	}
+	h := NewObjectHash()
+	if _, err := ls.copyFile(srcPath, dest, h); err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Warnf("Failed to upload")
+		return err
+	}
+	if err := ls.writeAttrs(bucket, object, attrs); err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Warnf("Failed to write attributes")
+		return err
+	}
+	res, err := ls.Get(bucket, object)
+	if err != nil {
+		return err
+	}
+	if err := h.Verify("gs://"+bucket+"/"+object, res); err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Warnf("Failed to verify uploaded file")
+		ls.Delete(bucket, object)
+		return err
+	}
+	log.WithFields(logAttrs).Debugln("Upload successfully")
+	return nil
+}
+
+func (ls *LocalStorage) Get(bucket, object string) (*storage.Object, error) {
+	log := log.WithFields(logrus.Fields{"url": "gs://" + bucket + "/" + object})
+	log.Debugln("Getting file info")
+	p, err := ls.objectPath(bucket, object)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		log.WithFields(logrus.Fields{"error": err}).Errorf("Failed to get local file info")
+		return nil, err
+	}
+	attrs, err := ls.readAttrs(bucket, object)
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Errorf("Failed to read attributes")
+		return nil, err
+	}
+	h, err := ls.fileHash(p, info)
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Errorf("Failed to calculate hashes")
+		return nil, err
+	}
+	return &storage.Object{
+		Bucket:          bucket,
+		Name:            object,
+		Size:            uint64(info.Size()),
+		Crc32c:          h.crc32c,
+		Md5Hash:         h.md5Hash,
+		Updated:         info.ModTime().UTC().Format(time.RFC3339Nano),
+		ContentType:     attrs.ContentType,
+		CacheControl:    attrs.CacheControl,
+		ContentEncoding: attrs.ContentEncoding,
+		Metadata:        attrs.Metadata,
+	}, nil
+}
+
+// fileHash returns the hashes of the file at p.
+// The file is hashed again only if its size or modification time is changed.
+func (ls *LocalStorage) fileHash(p string, info os.FileInfo) (*localFileHash, error) {
+	ls.hashesMux.Lock()
+	cached := ls.hashes[p]
+	ls.hashesMux.Unlock()
+	if cached != nil && cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) {
+		return cached, nil
+	}
+	h, err := HashFile(p)
+	if err != nil {
+		return nil, err
+	}
+	res := &localFileHash{
+		size:    info.Size(),
+		modTime: info.ModTime(),
+		crc32c:  h.Crc32c(),
+		md5Hash: h.Md5Hash(),
+	}
+	ls.hashesMux.Lock()
+	if ls.hashes == nil {
+		ls.hashes = map[string]*localFileHash{}
+	}
+	ls.hashes[p] = res
+	ls.hashesMux.Unlock()
+	return res, nil
+}
+
+func (ls *LocalStorage) Delete(bucket, object string) error {
+	log := log.WithFields(logrus.Fields{"url": "gs://" + bucket + "/" + object})
+	log.Debugln("Deleting file")
+	p, err := ls.objectPath(bucket, object)
+	if err != nil {
+		return err
+	}
+	ls.hashesMux.Lock()
+	delete(ls.hashes, p)
+	ls.hashesMux.Unlock()
+	err = os.Remove(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Warningf("File not found")
+			return nil
+		}
+		log.WithFields(logrus.Fields{"error": err}).Errorf("Failed to delete local file")
+		return err
+	}
+	err = os.Remove(ls.attrsPath(bucket, object))
+	if err != nil && !os.IsNotExist(err) {
+		log.WithFields(logrus.Fields{"error": err}).Warnf("Failed to delete attributes")
+	}
+	return nil
+}
+
+// Update replaces the metadata and updates the modification time like
+// the `updated` of GCS objects.
+func (ls *LocalStorage) Update(bucket, object string, body *storage.Object) (*storage.Object, error) {
+	log := log.WithFields(logrus.Fields{"url": "gs://" + bucket + "/" + object})
+	log.Debugln("Updating file")
+	p, err := ls.objectPath(bucket, object)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(p); err != nil {
+		if os.IsNotExist(err) {
+			err = ls.notFound(bucket, object)
+		}
+		log.WithFields(logrus.Fields{"error": err}).Errorf("Failed to update local file")
+		return nil, err
+	}
+	attrs := &localObjectAttrs{
+		ContentType:     body.ContentType,
+		CacheControl:    body.CacheControl,
+		ContentEncoding: body.ContentEncoding,
+		Metadata:        body.Metadata,
+	}
+	if err := ls.writeAttrs(bucket, object, attrs); err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Errorf("Failed to update local file")
+		return nil, err
+	}
+	now := time.Now()
+	if err := os.Chtimes(p, now, now); err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Errorf("Failed to update local file")
+		return nil, err
+	}
+	return ls.Get(bucket, object)
+}
+
+func (ls *LocalStorage) List(bucket, prefix string) ([]*storage.Object, error) {
+	log := log.WithFields(logrus.Fields{"url": "gs://" + bucket + "/" + prefix})
+	log.Debugln("Listing files")
+	base, err := ls.objectPath(bucket, "_")
+	if err != nil {
+		return nil, err
+	}
+	base = filepath.Dir(base)
+	res := []*storage.Object{}
+	// Walk visits the files in lexical order
+	err = filepath.Walk(base, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(base, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+		obj, err := ls.Get(bucket, name)
+		if err != nil {
+			return err
+		}
+		res = append(res, obj)
+		return nil
+	})
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Errorf("Failed to list local files")
+		return nil, err
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res, nil
+}
+
+func (ls *LocalStorage) CreateEmptyFile(bucket, object string) (*storage.Object, error) {
+	logAttrs := logrus.Fields{"url": "gs://" + bucket + "/" + object}
+	err := ls.createEmptyFile(bucket, object, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		logAttrs["error"] = err
+		log.WithFields(logAttrs).Warnf("Failed to create empty file")
+		return nil, err
+	}
+	log.WithFields(logAttrs).Debugln("Upload successfully")
+	return ls.Get(bucket, object)
+}
+
+func (ls *LocalStorage) createEmptyFile(bucket, object string, flag int) error {
+	p, err := ls.objectPath(bucket, object)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(p, flag, 0644)
+	if err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return ls.writeAttrs(bucket, object, &localObjectAttrs{ContentType: "text/plain"})
+}
+
+// copyFile writes the content to h as well as destPath.
+func (ls *LocalStorage) copyFile(srcPath, destPath string, h io.Writer) (int64, error) {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+		return 0, err
+	}
+	dest, err := os.Create(destPath)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(io.MultiWriter(dest, h), src)
+	if err != nil {
+		dest.Close()
+		return n, err
+	}
+	return n, dest.Close()
+}
+
+func (ls *LocalStorage) readAttrs(bucket, object string) (*localObjectAttrs, error) {
+	attrs := &localObjectAttrs{}
+	data, err := ioutil.ReadFile(ls.attrsPath(bucket, object))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return attrs, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, attrs); err != nil {
+		return nil, err
+	}
+	return attrs, nil
+}
+
+func (ls *LocalStorage) writeAttrs(bucket, object string, attrs *localObjectAttrs) error {
+	p := ls.attrsPath(bucket, object)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(attrs)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p, data, 0644)
+}
+
+// NewLocker returns a lock which creates the object exclusively like gcslock.
+func (ls *LocalStorage) NewLocker(bucket, object string) (gcslock.ContextLocker, error) {
+	if _, err := ls.objectPath(bucket, object); err != nil {
+		return nil, err
+	}
+	return &localLock{storage: ls, bucket: bucket, object: object}, nil
+}
+
+type localLock struct {
+	storage *LocalStorage
+	bucket  string
+	object  string
+}
+
+const localLockInterval = 100 * time.Millisecond
+
+func (l *localLock) ContextLock(ctx context.Context) error {
+	for {
+		err := l.storage.createEmptyFile(l.bucket, l.object, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+		if err == nil {
+			return nil
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(localLockInterval):
+		}
+	}
+}
+
+func (l *localLock) ContextUnlock(ctx context.Context) error {
+	p, err := l.storage.objectPath(l.bucket, l.object)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil {
+		return err
+	}
+	os.Remove(l.storage.attrsPath(l.bucket, l.object))
+	return nil
+}
+
+func (l *localLock) Lock() {
+	if err := l.ContextLock(context.Background()); err != nil {
+		panic(err)
+	}
+}
+
+func (l *localLock) Unlock() {
+	if err := l.ContextUnlock(context.Background()); err != nil {
+		panic(err)
+	}
+}
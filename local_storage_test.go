@@ -0,0 +1,202 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+	storage "google.golang.org/api/storage/v1"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalStorage(t *testing.T) {
+	root, err := ioutil.TempDir("", "local-storage")
+	assert.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	ls := &LocalStorage{Root: root, ContentTypeByExt: true}
+
+	obj, err := ls.Get("bucket1", "path/to/file1.txt")
+	assert.NoError(t, err)
+	assert.Nil(t, obj)
+
+	src := filepath.Join(root, "src.txt")
+	assert.NoError(t, ioutil.WriteFile(src, []byte("foo"), 0644))
+
+	// Upload
+	assert.NoError(t, ls.Upload("bucket1", "path/to/file1.txt", src))
+	obj, err = ls.Get("bucket1", "path/to/file1.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "bucket1", obj.Bucket)
+	assert.Equal(t, "path/to/file1.txt", obj.Name)
+	assert.Equal(t, uint64(3), obj.Size)
+	assert.Equal(t, "text/plain; charset=utf-8", obj.ContentType)
+	assert.Equal(t, "rL0Y20zC+Fzt72VPzMSk2A==", obj.Md5Hash)
+	updated, err := time.Parse(time.RFC3339, obj.Updated)
+	assert.NoError(t, err)
+
+	// Download
+	dest := filepath.Join(root, "dest.txt")
+	assert.NoError(t, ls.Download("bucket1", "path/to/file1.txt", dest))
+	data, err := ioutil.ReadFile(dest)
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", string(data))
+
+	err = ls.Download("bucket1", "path/to/unknown.txt", dest)
+	assert.True(t, IsGoogleApiError(err, http.StatusNotFound))
+
+	// Update
+	time.Sleep(10 * time.Millisecond)
+	obj, err = ls.Update("bucket1", "path/to/file1.txt", &storage.Object{Metadata: map[string]string{"foo": "bar"}})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"foo": "bar"}, obj.Metadata)
+	updated2, err := time.Parse(time.RFC3339, obj.Updated)
+	assert.NoError(t, err)
+	assert.True(t, updated2.After(updated))
+
+	_, err = ls.Update("bucket1", "path/to/unknown.txt", &storage.Object{})
+	assert.True(t, IsGoogleApiError(err, http.StatusNotFound))
+
+	// Delete
+	assert.NoError(t, ls.Delete("bucket1", "path/to/file1.txt"))
+	obj, err = ls.Get("bucket1", "path/to/file1.txt")
+	assert.NoError(t, err)
+	assert.Nil(t, obj)
+	assert.NoError(t, ls.Delete("bucket1", "path/to/file1.txt"))
+
+	// CreateEmptyFile
+	obj, err = ls.CreateEmptyFile("bucket1", "path/to/empty")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), obj.Size)
+	assert.Equal(t, "text/plain", obj.ContentType)
+
+	// Invalid paths
+	_, err = ls.Get("bucket1", "../../etc/passwd")
+	assert.Error(t, err)
+	_, err = ls.Get(LocalStorageMetadataDir, "foo")
+	assert.Error(t, err)
+}
+
+func TestLocalStorageHashCache(t *testing.T) {
+	root, err := ioutil.TempDir("", "local-storage")
+	assert.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	ls := &LocalStorage{Root: root}
+	src := filepath.Join(root, "src.txt")
+	assert.NoError(t, ioutil.WriteFile(src, []byte("foo"), 0644))
+	assert.NoError(t, ls.Upload("bucket1", "file1.txt", src))
+	obj, err := ls.Get("bucket1", "file1.txt")
+	assert.NoError(t, err)
+	fooMd5 := obj.Md5Hash
+
+	// The file isn't hashed again while its size and modification time aren't changed
+	p := filepath.Join(root, "bucket1", "file1.txt")
+	info, err := os.Stat(p)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(p, []byte("bar"), 0644))
+	assert.NoError(t, os.Chtimes(p, info.ModTime(), info.ModTime()))
+	objs, err := ls.List("bucket1", "")
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(objs)) {
+		assert.Equal(t, fooMd5, objs[0].Md5Hash)
+	}
+
+	// The file is hashed again after it's modified
+	later := info.ModTime().Add(time.Second)
+	assert.NoError(t, os.Chtimes(p, later, later))
+	obj, err = ls.Get("bucket1", "file1.txt")
+	assert.NoError(t, err)
+	assert.NotEqual(t, fooMd5, obj.Md5Hash)
+	h, err := HashFile(p)
+	assert.NoError(t, err)
+	assert.Equal(t, h.Md5Hash(), obj.Md5Hash)
+}
+
+func TestJobCheckByGcslockWithLocalStorage(t *testing.T) {
+	root, err := ioutil.TempDir("", "local-storage")
+	assert.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	c := &JobCheckByGcslock{
+		Bucket:  "bucket1",
+		DirPath: "gcslocks",
+		Timeout: 10 * time.Minute,
+		Storage: &LocalStorage{Root: root},
+	}
+
+	// 1st time
+	(func() {
+		ack := &JobCheckCallee{}
+		main := &JobCheckCallee{}
+		err := c.Check("job_id1", ack.Test, main.Test)
+		assert.NoError(t, err)
+		assert.Equal(t, false, ack.Called)
+		assert.Equal(t, true, main.Called)
+	})()
+
+	// 2nd time
+	(func() {
+		ack := &JobCheckCallee{}
+		main := &JobCheckCallee{}
+		err := c.Check("job_id1", ack.Test, main.Test)
+		assert.NoError(t, err)
+		assert.Equal(t, true, ack.Called)
+		assert.Equal(t, false, main.Called)
+	})()
+
+	// The lock is released
+	obj, err := c.Storage.Get("bucket1", "gcslocks/job_id1.gcslock")
+	assert.NoError(t, err)
+	assert.Nil(t, obj)
+
+	for i := 1; i <= 2; i++ {
+		count, err := c.Increment("msg1")
+		assert.NoError(t, err)
+		assert.Equal(t, i, count)
+	}
+
+	// The count is cleared with its object
+	assert.NoError(t, c.Clear("msg1"))
+	obj, err = c.Storage.Get("bucket1", "gcslocks/msg1.deliveries")
+	assert.NoError(t, err)
+	assert.Nil(t, obj)
+}
+
+// racingStorage lets another process update the object before the first conditional update.
+type racingStorage struct {
+	*LocalStorage
+	raced bool
+}
+
+func (rs *racingStorage) UpdateIfMatch(bucket, object string, generation, metageneration int64, body *storage.Object) (*storage.Object, error) {
+	if !rs.raced {
+		rs.raced = true
+		if _, err := rs.Update(bucket, object, &storage.Object{Metadata: map[string]string{DeliveryCountMetadataKey: "5"}}); err != nil {
+			return nil, err
+		}
+		return nil, &googleapi.Error{Code: http.StatusPreconditionFailed}
+	}
+	return rs.Update(bucket, object, body)
+}
+
+func TestJobCheckByGcslockIncrementConflict(t *testing.T) {
+	root, err := ioutil.TempDir("", "local-storage")
+	assert.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	c := &JobCheckByGcslock{
+		Bucket:  "bucket1",
+		DirPath: "gcslocks",
+		Storage: &racingStorage{LocalStorage: &LocalStorage{Root: root}},
+	}
+	// The count updated by another process is read again
+	count, err := c.Increment("msg1")
+	assert.NoError(t, err)
+	assert.Equal(t, 6, count)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const MetricsNamespace = "blocks_gcs_proxy"
+
+// Metrics has the collectors of the proxy. All of the methods do nothing if it's nil.
+type Metrics struct {
+	pipeline string
+	registry *prometheus.Registry
+
+	messagesPulled    *prometheus.CounterVec
+	messagesResponded *prometheus.CounterVec
+	stepDuration      *prometheus.HistogramVec
+	stepFailures      *prometheus.CounterVec
+	downloadedBytes   *prometheus.CounterVec
+	uploadedBytes     *prometheus.CounterVec
+	retries           *prometheus.CounterVec
+	modifyAckDeadline *prometheus.CounterVec
+	exitCodes         *prometheus.CounterVec
+}
+
+func NewMetrics(pipeline string) *Metrics {
+	m := &Metrics{
+		pipeline: pipeline,
+		registry: prometheus.NewRegistry(),
+		messagesPulled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: MetricsNamespace,
+			Name:      "messages_pulled_total",
+			Help:      "The number of job messages pulled.",
+		}, []string{"pipeline"}),
+		messagesResponded: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: MetricsNamespace,
+			Name:      "messages_responded_total",
+			Help:      "The number of job messages responded by ack, nack or none.",
+		}, []string{"pipeline", "option_key", "response"}),
+		stepDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: MetricsNamespace,
+			Name:      "job_step_duration_seconds",
+			Help:      "The duration of each step of jobs.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 4, 10),
+		}, []string{"pipeline", "option_key", "step", "status"}),
+		stepFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: MetricsNamespace,
+			Name:      "job_step_failures_total",
+			Help:      "The number of failures of each step of jobs.",
+		}, []string{"pipeline", "option_key", "step"}),
+		downloadedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: MetricsNamespace,
+			Name:      "downloaded_bytes_total",
+			Help:      "The total size of the files downloaded.",
+		}, []string{"pipeline", "option_key"}),
+		uploadedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: MetricsNamespace,
+			Name:      "uploaded_bytes_total",
+			Help:      "The total size of the files uploaded.",
+		}, []string{"pipeline", "option_key"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: MetricsNamespace,
+			Name:      "retries_total",
+			Help:      "The number of retries to download or upload files.",
+		}, []string{"pipeline", "option_key", "operation"}),
+		modifyAckDeadline: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: MetricsNamespace,
+			Name:      "modify_ack_deadline_total",
+			Help:      "The number of ModifyAckDeadline calls by the sustainer.",
+		}, []string{"pipeline", "result"}),
+		exitCodes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: MetricsNamespace,
+			Name:      "command_exit_codes_total",
+			Help:      "The number of commands finished by each exit code.",
+		}, []string{"pipeline", "option_key", "exit_code"}),
+	}
+	m.registry.MustRegister(
+		m.messagesPulled,
+		m.messagesResponded,
+		m.stepDuration,
+		m.stepFailures,
+		m.downloadedBytes,
+		m.uploadedBytes,
+		m.retries,
+		m.modifyAckDeadline,
+		m.exitCodes,
+		prometheus.NewGoCollector(),
+	)
+	return m
+}
+
+// Handler returns the handler for the metrics in Prometheus text format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+func (m *Metrics) MessagePulled() {
+	if m == nil {
+		return
+	}
+	m.messagesPulled.WithLabelValues(m.pipeline).Inc()
+}
+
+func (m *Metrics) MessageResponded(optionKey string, rt ResponseType) {
+	if m == nil {
+		return
+	}
+	m.messagesResponded.WithLabelValues(m.pipeline, optionKey, rt.String()).Inc()
+}
+
+func (m *Metrics) StepFinished(optionKey string, step JobStep, duration time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	st := SUCCESS
+	if err != nil {
+		st = FAILURE
+		m.stepFailures.WithLabelValues(m.pipeline, optionKey, step.String()).Inc()
+	}
+	m.stepDuration.WithLabelValues(m.pipeline, optionKey, step.String(), st.String()).Observe(duration.Seconds())
+}
+
+func (m *Metrics) Downloaded(optionKey string, size int64) {
+	if m == nil {
+		return
+	}
+	m.downloadedBytes.WithLabelValues(m.pipeline, optionKey).Add(float64(size))
+}
+
+func (m *Metrics) Uploaded(optionKey string, size int64) {
+	if m == nil {
+		return
+	}
+	m.uploadedBytes.WithLabelValues(m.pipeline, optionKey).Add(float64(size))
+}
+
+func (m *Metrics) Retried(optionKey, operation string) {
+	if m == nil {
+		return
+	}
+	m.retries.WithLabelValues(m.pipeline, optionKey, operation).Inc()
+}
+
+func (m *Metrics) ModifyAckDeadlineSent(err error) {
+	if m == nil {
+		return
+	}
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	m.modifyAckDeadline.WithLabelValues(m.pipeline, result).Inc()
+}
+
+func (m *Metrics) CommandExited(optionKey string, exitCode int) {
+	if m == nil {
+		return
+	}
+	m.exitCodes.WithLabelValues(m.pipeline, optionKey, strconv.Itoa(exitCode)).Inc()
+}
+
+// CommandTimedOut counts the command killed by the timeout as the exit code "timeout".
+func (m *Metrics) CommandTimedOut(optionKey string) {
+	if m == nil {
+		return
+	}
+	m.exitCodes.WithLabelValues(m.pipeline, optionKey, "timeout").Inc()
+}
@@ -0,0 +1,22 @@
+package main
+
+type MetricsConfig struct {
+	Listen   string `json:"listen,omitempty"`
+	Path     string `json:"path,omitempty"`
+	Pipeline string `json:"pipeline,omitempty"`
+}
+
+func (c *MetricsConfig) setup() *ConfigError {
+	if c.Path == "" {
+		c.Path = "/metrics"
+	}
+	if c.Pipeline == "" {
+		c.Pipeline = Pipeline
+	}
+	return nil
+}
+
+// Enabled returns true if the metrics endpoint is given.
+func (c *MetricsConfig) Enabled() bool {
+	return c.Listen != ""
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/groovenauts/concurrent-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	m := NewMetrics("pipeline1")
+	m.MessagePulled()
+	m.MessagePulled()
+	m.MessageResponded("key1", ACK)
+	m.MessageResponded("key1", NACK)
+	m.StepFinished("key1", DOWNLOADING, 2*time.Second, nil)
+	m.StepFinished("key1", EXECUTING, time.Second, errors.New("failed"))
+	m.Downloaded("key1", 100)
+	m.Uploaded("key1", 200)
+	m.Retried("key1", "upload")
+	m.ModifyAckDeadlineSent(nil)
+	m.CommandExited("key1", 3)
+	m.CommandTimedOut("key1")
+
+	server := httptest.NewServer(m.Handler())
+	defer server.Close()
+	resp, err := server.Client().Get(server.URL)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	text := string(data)
+
+	expected := []string{
+		`blocks_gcs_proxy_messages_pulled_total{pipeline="pipeline1"} 2`,
+		`blocks_gcs_proxy_messages_responded_total{option_key="key1",pipeline="pipeline1",response="ack"} 1`,
+		`blocks_gcs_proxy_messages_responded_total{option_key="key1",pipeline="pipeline1",response="nack"} 1`,
+		`blocks_gcs_proxy_job_step_duration_seconds_count{option_key="key1",pipeline="pipeline1",status="SUCCESS",step="DOWNLOADING"} 1`,
+		`blocks_gcs_proxy_job_step_failures_total{option_key="key1",pipeline="pipeline1",step="EXECUTING"} 1`,
+		`blocks_gcs_proxy_downloaded_bytes_total{option_key="key1",pipeline="pipeline1"} 100`,
+		`blocks_gcs_proxy_uploaded_bytes_total{option_key="key1",pipeline="pipeline1"} 200`,
+		`blocks_gcs_proxy_retries_total{operation="upload",option_key="key1",pipeline="pipeline1"} 1`,
+		`blocks_gcs_proxy_modify_ack_deadline_total{pipeline="pipeline1",result="success"} 1`,
+		`blocks_gcs_proxy_command_exit_codes_total{exit_code="3",option_key="key1",pipeline="pipeline1"} 1`,
+		`blocks_gcs_proxy_command_exit_codes_total{exit_code="timeout",option_key="key1",pipeline="pipeline1"} 1`,
+	}
+	for _, line := range expected {
+		assert.Contains(t, text, line)
+	}
+}
+
+func TestMetricsNil(t *testing.T) {
+	var m *Metrics
+	m.MessagePulled()
+	m.MessageResponded("", ACK)
+	m.StepFinished("", UPLOADING, time.Second, nil)
+	m.Downloaded("", 1)
+	m.Uploaded("", 1)
+	m.Retried("", "download")
+	m.ModifyAckDeadlineSent(nil)
+	m.CommandExited("", 0)
+	m.CommandTimedOut("")
+}
+
+func TestRetryableFuncOnRetry(t *testing.T) {
+	retries := 0
+	rf := &RetryableFunc{
+		name:     "test",
+		maxTries: 3,
+		interval: time.Millisecond,
+		onRetry:  func() { retries++ },
+	}
+	tries := 0
+	f := rf.Wrap(func(*concurrent.Job) error {
+		tries++
+		if tries < 3 {
+			return errors.New("failed")
+		}
+		return nil
+	})
+	assert.NoError(t, f(nil))
+	assert.Equal(t, 2, retries)
+}
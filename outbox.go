@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+
+	pubsub "google.golang.org/api/pubsub/v1"
+
+	logrus "github.com/sirupsen/logrus"
+)
+
+// Outbox publishes the follow-up messages which the command writes into the outbox directory.
+type Outbox struct {
+	// Topic is the default topic
+	Topic     string
+	publisher Publisher
+}
+
+const (
+	OutboxSourceMessageIdKey = "outbox.source_message_id"
+	OutboxSourceExecUUIDKey  = "outbox.source_exec_uuid"
+	OutboxFileKey            = "outbox.file"
+	// OutboxDedupeKey is the same among the deliveries of the job message
+	// so that the subscribers can ignore the messages published again.
+	OutboxDedupeKey = "outbox.dedupe_key"
+
+	// The number of the published messages in the attributes of PUBLISHING notification
+	OutboxPublishedKey = "outbox.published"
+)
+
+type (
+	// OutboxMessage is the content of a JSON file in the outbox directory.
+	OutboxMessage struct {
+		Topic      string            `json:"topic,omitempty"`
+		Attributes map[string]string `json:"attributes,omitempty"`
+		// Data is encoded by base64 when it's published
+		Data string `json:"data,omitempty"`
+
+		// file is the name of the JSON file
+		file string
+	}
+
+	// PublishResult is the follow-up message published from the outbox.
+	PublishResult struct {
+		File      string `json:"file"`
+		Topic     string `json:"topic"`
+		MessageId string `json:"message_id"`
+	}
+
+	// OutboxError is returned when the follow-up messages can't be published.
+	// The job message must be delivered again not to lose them.
+	OutboxError struct {
+		File  string
+		Topic string
+		cause error
+	}
+)
+
+func (e *OutboxError) Error() string {
+	return fmt.Sprintf("Failed to publish %s to %s because of %v", e.File, e.Topic, e.cause)
+}
+
+// outboxFiles returns the JSON files in the outbox directory sorted by the names.
+// The other files are ignored so that the command can write a file and rename it.
+func (job *Job) outboxFiles() ([]string, error) {
+	if job.outbox == nil || job.outbox_dir == "" {
+		return nil, nil
+	}
+	files, err := filepath.Glob(filepath.Join(job.outbox_dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// loadOutbox reads all the messages in the outbox before publishing
+// so that nothing is published if any of them is invalid.
+func (job *Job) loadOutbox(files []string) ([]*OutboxMessage, error) {
+	msgs := []*OutboxMessage{}
+	errors := []error{}
+	for _, file := range files {
+		name := filepath.Base(file)
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		msg := &OutboxMessage{file: name}
+		if err := json.Unmarshal(data, msg); err != nil {
+			errors = append(errors, &InvalidJobError{msg: fmt.Sprintf("Invalid outbox file %s", name), cause: err})
+			continue
+		}
+		if msg.Topic == "" {
+			msg.Topic = job.outbox.Topic
+		}
+		if msg.Topic == "" {
+			errors = append(errors, &InvalidJobError{msg: fmt.Sprintf("No topic for outbox file %s", name)})
+			continue
+		}
+		if !topicNamePattern.MatchString(msg.Topic) {
+			errors = append(errors, &InvalidJobError{msg: fmt.Sprintf("Invalid topic %q in outbox file %s", msg.Topic, name)})
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+	if len(errors) > 0 {
+		return nil, &CompositeError{errors}
+	}
+	return msgs, nil
+}
+
+// publishOutbox publishes the messages in the outbox in the order of the file names.
+// The messages have the IDs of the source job and the trace context of PUBLISHING step.
+func (job *Job) publishOutbox(files []string) (map[string]string, string, error) {
+	log := job.logEntry()
+	msgs, err := job.loadOutbox(files)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, msg := range msgs {
+		attrs := map[string]string{}
+		if job.stepCtx != nil {
+			injectTraceContext(job.stepCtx, attrs)
+		}
+		for k, v := range msg.Attributes {
+			attrs[k] = v
+		}
+		attrs[OutboxSourceMessageIdKey] = job.message.MessageId()
+		attrs[OutboxSourceExecUUIDKey] = job.execUUID
+		attrs[OutboxFileKey] = msg.file
+		attrs[OutboxDedupeKey] = job.message.MessageId() + "/" + msg.file
+
+		logAttrs := logrus.Fields{"topic": msg.Topic, "file": msg.file}
+		m := &pubsub.PubsubMessage{
+			Attributes: attrs,
+			Data:       base64.StdEncoding.EncodeToString([]byte(msg.Data)),
+		}
+		res, err := job.outbox.publisher.Publish(msg.Topic, m)
+		if err != nil {
+			logAttrs["error"] = err
+			log.WithFields(logAttrs).Errorln("Failed to publish the outbox message")
+			return nil, "", &OutboxError{File: msg.file, Topic: msg.Topic, cause: err}
+		}
+		r := &PublishResult{File: msg.file, Topic: msg.Topic}
+		if res != nil && len(res.MessageIds) > 0 {
+			r.MessageId = res.MessageIds[0]
+		}
+		logAttrs["message_id"] = r.MessageId
+		log.WithFields(logAttrs).Debugln("Published the outbox message")
+		job.publishResults = append(job.publishResults, r)
+	}
+	return map[string]string{OutboxPublishedKey: fmt.Sprintf("%d", len(msgs))}, "", nil
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+type OutboxConfig struct {
+	// Topic is used for the outbox message which doesn't have its own topic
+	Topic string `json:"topic,omitempty"`
+}
+
+var topicNamePattern = regexp.MustCompile(`\Aprojects/[^/]+/topics/[^/]+\z`)
+
+func (c *OutboxConfig) setup() *ConfigError {
+	if c.Topic != "" && !topicNamePattern.MatchString(c.Topic) {
+		return &ConfigError{Name: "topic", Message: fmt.Sprintf("%q is invalid. It must be projects/PROJECT/topics/TOPIC", c.Topic)}
+	}
+	return nil
+}
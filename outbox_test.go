@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	pubsub "google.golang.org/api/pubsub/v1"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	outboxTopic1 = "projects/proj1/topics/next1"
+	outboxTopic2 = "projects/proj1/topics/next2"
+)
+
+func TestOutboxConfig(t *testing.T) {
+	c := &OutboxConfig{}
+	assert.Nil(t, c.setup())
+
+	c = &OutboxConfig{Topic: outboxTopic1}
+	assert.Nil(t, c.setup())
+
+	c = &OutboxConfig{Topic: "next1"}
+	assert.NotNil(t, c.setup())
+}
+
+// brokenPublisher fails to publish to the topic
+type brokenPublisher struct {
+	Publisher
+	topic string
+}
+
+func (bp *brokenPublisher) Publish(topic string, msg *pubsub.PubsubMessage) (*pubsub.PublishResponse, error) {
+	if topic == bp.topic {
+		return nil, fmt.Errorf("Failed to publish to %s", topic)
+	}
+	return bp.Publisher.Publish(topic, msg)
+}
+
+func TestJobPublishOutboxFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "01.json"), []byte(`{"topic":"`+outboxTopic1+`"}`), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "02.json"), []byte(`{"topic":"`+outboxTopic2+`"}`), 0644))
+
+	ps := &FilePubsub{}
+	job := NewBasicJob()
+	job.outbox_dir = dir
+	job.outbox = &Outbox{publisher: &brokenPublisher{Publisher: ps, topic: outboxTopic2}}
+
+	files, err := job.outboxFiles()
+	assert.NoError(t, err)
+	_, _, err = job.publishOutbox(files)
+	if assert.Error(t, err) {
+		assert.IsType(t, &OutboxError{}, err)
+		assert.Equal(t, NACK, job.responseFor(err))
+	}
+	assert.Equal(t, 1, len(ps.Published(outboxTopic1)))
+	if assert.Equal(t, 1, len(job.publishResults)) {
+		assert.Equal(t, "01.json", job.publishResults[0].File)
+	}
+}
+
+func TestProcessRunWithOutbox(t *testing.T) {
+	script := `case $1 in
+  valid)
+    echo '{"attributes":{"foo":"bar"},"data":"first"}' > $BLOCKS_OUTBOX_DIR/01.json
+    echo '{"topic":"` + outboxTopic2 + `","data":"second"}' > $BLOCKS_OUTBOX_DIR/02.json
+    echo '{"data":"ignored"}' > $BLOCKS_OUTBOX_DIR/03.json.tmp ;;
+  invalid)
+    echo '{"data":"first"}' > $BLOCKS_OUTBOX_DIR/01.json
+    echo '{"topic":"next2"}' > $BLOCKS_OUTBOX_DIR/02.json ;;
+  declined)
+    echo '{"data":"declined"}' > $BLOCKS_OUTBOX_DIR/01.json
+    echo '{"retry_after":"5m"}' > $BLOCKS_RESULT_FILE ;;
+esac
+`
+	tp := newTestProcess(t, script, []string{"%{attrs.case}"}, func(c *ProcessConfig) {
+		c.Progress.LogLevel = "debug"
+		c.Outbox = &OutboxConfig{Topic: outboxTopic1}
+	})
+	defer tp.close()
+	ps := tp.ps
+
+	for _, c := range []string{"valid", "invalid", "empty", "declined"} {
+		tp.add(c, map[string]string{"case": c})
+	}
+	// The declined message remains until its deadline
+	tp.run(func() bool {
+		if ps.Remaining() != 1 {
+			return false
+		}
+		for _, msg := range tp.progresses() {
+			if msg.Attributes["job_message_id"] == "declined" && msg.Attributes["step"] == NACKSENDING.String() &&
+				msg.Attributes["step_status"] == SUCCESS.String() {
+				return true
+			}
+		}
+		return false
+	})
+
+	decode := func(data string) string {
+		b, err := base64.StdEncoding.DecodeString(data)
+		assert.NoError(t, err)
+		return string(b)
+	}
+
+	// Only the messages of the valid job are published
+	published1 := ps.Published(outboxTopic1)
+	if assert.Equal(t, 1, len(published1)) {
+		m := published1[0]
+		assert.Equal(t, "first", decode(m.Data))
+		assert.Equal(t, "bar", m.Attributes["foo"])
+		assert.Equal(t, "valid", m.Attributes[OutboxSourceMessageIdKey])
+		assert.NotEqual(t, "", m.Attributes[OutboxSourceExecUUIDKey])
+		assert.Equal(t, "01.json", m.Attributes[OutboxFileKey])
+		assert.Equal(t, "valid/01.json", m.Attributes[OutboxDedupeKey])
+	}
+	published2 := ps.Published(outboxTopic2)
+	if assert.Equal(t, 1, len(published2)) {
+		m := published2[0]
+		assert.Equal(t, "second", decode(m.Data))
+		assert.Equal(t, "02.json", m.Attributes[OutboxFileKey])
+	}
+
+	steps := map[string][]string{}
+	for _, msg := range tp.progresses() {
+		if msg.Attributes["step_status"] == SUCCESS.String() || msg.Attributes["step_status"] == FAILURE.String() {
+			id := msg.Attributes["job_message_id"]
+			steps[id] = append(steps[id], msg.Attributes["step"]+" "+msg.Attributes["step_status"])
+			if msg.Attributes["step"] == PUBLISHING.String() && msg.Attributes["step_status"] == SUCCESS.String() {
+				assert.Equal(t, "2", msg.Attributes[OutboxPublishedKey])
+			}
+		}
+	}
+	assert.Contains(t, steps["valid"], "PUBLISHING SUCCESS")
+	assert.Contains(t, steps["valid"], "ACKSENDING SUCCESS")
+	assert.Contains(t, steps["invalid"], "PUBLISHING FAILURE")
+	assert.Contains(t, steps["invalid"], "CANCELLING SUCCESS")
+	// No PUBLISHING step without outbox files
+	assert.NotContains(t, steps["empty"], "PUBLISHING SUCCESS")
+	assert.Contains(t, steps["empty"], "ACKSENDING SUCCESS")
+	// No PUBLISHING step when the result file declares nack
+	assert.NotContains(t, steps["declined"], "PUBLISHING SUCCESS")
+	assert.Contains(t, steps["declined"], "NACKSENDING SUCCESS")
+}
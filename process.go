@@ -1,6 +1,11 @@
 package main
 
 import (
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"golang.org/x/net/context"
@@ -20,19 +25,39 @@ type (
 		config       *ProcessConfig
 		subscription *JobSubscription
 		notification *ProgressNotification
-		storage      *CloudStorage
+		storage      Storage
+
+		deadLetter      *DeadLetter
+		outbox          *Outbox
+		deliveryCounter DeliveryCounter
+		// deliveryFallback counts the deliveries when deliveryCounter fails
+		deliveryFallback DeliveryCounter
+		metrics          *Metrics
+		health           *Health
+		tracing          *Tracing
+
+		// These are used to stop running jobs by signal
+		jobs   map[*Job]bool
+		signal os.Signal
+		// signaledAt is when the first signal is received. The grace period starts from it.
+		signaledAt time.Time
+		jobsMux    sync.Mutex
 	}
 )
 
 func (p *Process) setup() error {
 	ctx := context.Background()
 
-	// https://github.com/google/google-api-go-client#application-default-credentials-example
-	client, err := google.DefaultClient(ctx, pubsub.PubsubScope, storage.DevstorageReadWriteScope, logging.LoggingWriteScope, errorReporting.CloudPlatformScope)
+	var client *http.Client
+	var err error
+	if p.config.RequiresGoogleClient() {
+		// https://github.com/google/google-api-go-client#application-default-credentials-example
+		client, err = google.DefaultClient(ctx, pubsub.PubsubScope, storage.DevstorageReadWriteScope, logging.LoggingWriteScope, errorReporting.CloudPlatformScope)
 
-	if err != nil {
-		log.Fatalln("Failed to create DefaultClient")
-		return err
+		if err != nil {
+			log.Fatalln("Failed to create DefaultClient")
+			return err
+		}
 	}
 
 	// Add stackdriver logging
@@ -45,32 +70,43 @@ func (p *Process) setup() error {
 		}
 	}
 
-	// Create a storageService
-	storageService, err := storage.New(client)
+	if p.config.Metrics.Enabled() {
+		p.metrics = NewMetrics(p.config.Metrics.Pipeline)
+	}
+	if p.config.Health.Enabled() {
+		p.health = NewHealth(p.config.Health.stallTimeout())
+	}
+	if p.config.Tracing.Enabled() {
+		p.tracing, err = NewTracing(p.config.Tracing)
+		if err != nil {
+			logAttrs := logrus.Fields{"tracing": p.config.Tracing, "error": err}
+			log.WithFields(logAttrs).Fatalln("Failed to setup tracing")
+			return err
+		}
+	}
+
+	err = p.setupStorage(client)
 	if err != nil {
-		logAttrs := logrus.Fields{"client": client, "error": err}
-		log.WithFields(logAttrs).Fatalln("Failed to create storage.Service")
 		return err
 	}
-	p.storage = &CloudStorage{
-		service:          storageService.Objects,
-		ContentTypeByExt: p.config.Upload.ContentTypeByExt,
-	}
-	p.config.JobCheck.storage = p.storage
 
-	// Creates a pubsubService
-	pubsubService, err := pubsub.New(client)
+	// Creates a puller and a publisher
+	impl, publisher, err := p.config.Pubsub.Services(client)
 	if err != nil {
 		logAttrs := logrus.Fields{"client": client, "error": err}
 		log.WithFields(logAttrs).Fatalln("Failed to create pubsub.Service")
 		return err
 	}
+	if p.health != nil {
+		impl = &HealthPuller{Impl: impl, health: p.health}
+		publisher = &HealthPublisher{Impl: publisher, health: p.health}
+	}
 
 	eb := backoff.NewExponentialBackOff()
 	eb.InitialInterval = 10 * time.Second
 	b := backoff.WithMaxRetries(eb, 5)
 	puller := &BackoffPuller{
-		Impl:    &pubsubPuller{pubsubService.Projects.Subscriptions},
+		Impl:    impl,
 		Backoff: b,
 	}
 
@@ -84,6 +120,7 @@ func (p *Process) setup() error {
 	p.subscription = &JobSubscription{
 		config: p.config.Job,
 		puller: puller,
+		health: p.health,
 	}
 
 	p.config.Progress.setup()
@@ -95,9 +132,44 @@ func (p *Process) setup() error {
 	}
 	p.notification = &ProgressNotification{
 		config:    p.config.Progress,
-		publisher: &pubsubPublisher{pubsubService.Projects.Topics},
+		publisher: publisher,
 		logLevel:  level,
 	}
+
+	if p.config.Job.DeadLetterTopic != "" {
+		p.deadLetter = &DeadLetter{
+			Topic:         p.config.Job.DeadLetterTopic,
+			MaxDeliveries: p.config.Job.MaxDeliveries,
+			OnAck:         p.config.Job.DeadLetterOnAck,
+			publisher:     publisher,
+		}
+		p.deliveryCounter = p.config.JobCheck.DeliveryCounter()
+		p.deliveryFallback = &DeliveryCounterInMemory{}
+	}
+	p.outbox = &Outbox{
+		Topic:     p.config.Outbox.Topic,
+		publisher: publisher,
+	}
+	return nil
+}
+
+// setupStorage can be called without setup for the storage which doesn't need client.
+func (p *Process) setupStorage(client *http.Client) error {
+	s, err := p.config.Storage.Storage(client, p.config.Download, p.config.Upload)
+	if err != nil {
+		logAttrs := logrus.Fields{"client": client, "error": err}
+		log.WithFields(logAttrs).Fatalln("Failed to create storage.Service")
+		return err
+	}
+	// The job check uses the storage without cache to use its locker
+	p.config.JobCheck.storage = s
+	if p.health != nil {
+		s = &HealthStorage{Storage: s, health: p.health}
+	}
+	if cache := p.config.Download.DownloadCache(); cache != nil {
+		s = &CachedStorage{Storage: s, cache: cache}
+	}
+	p.storage = s
 	return nil
 }
 
@@ -113,9 +185,19 @@ func (p *Process) run() error {
 			},
 		}
 	log.WithFields(logAttrs).Infoln("Start listening")
+
+	p.serve()
+	defer p.tracing.Shutdown()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(signals)
+	go p.handleSignals(signals)
+
 	err := p.subscription.listen(func(msg *JobMessage) error {
 		log.Debugln("Process subscription handler start")
 		defer log.Debugln("Process subscription handler done")
+		p.metrics.MessagePulled()
 
 		job := &Job{
 			config:               p.config.Command,
@@ -127,53 +209,170 @@ func (p *Process) run() error {
 			storage:              p.storage,
 			IntervalOnError:      p.config.Job.IntervalOnError,
 			ErrorResponse:        p.config.Job.ErrorResponse,
+			TimeoutResponse:      p.config.Job.TimeoutResponse,
+			ExitCodeResponses:    p.config.Job.ExitCodeResponses,
+			deadLetter:           p.deadLetter,
+			outbox:               p.outbox,
+			metrics:              p.metrics,
+			health:               p.health,
+			tracing:              p.tracing,
 		}
-		log.Debugln("Process subscription handler #1")
 		job.setupExecUUID()
-		log.Debugln("Process subscription handler #2")
 		jobLog := logger.WithFields(logrus.Fields{
 			"exec-uuid":                 job.execUUID,
 			"message-id":                msg.MessageId(),
 			ConcurrentBatchJobIdKey4Log: msg.ConcurrentBatchJobId(),
 		})
-		log.Debugln("Process subscription handler #3")
-		err := p.replaceGlobalLog(jobLog, func() error {
-			log.Debugln("Process subscription handler #4 start")
-			defer log.Debugln("Process subscription handler #4 done")
-			err := p.checkJobToExecute(job, job.run)
-			if err != nil {
-				logAttrs := logrus.Fields{"error": err, "msg": msg}
-				log.WithFields(logAttrs).Fatalln("Job Error")
-				return err
-			}
-			return nil
-		})
-		log.Debugln("Process subscription handler #5")
+		// Each job has its own logger because jobs run concurrently
+		job.log = jobLog
+		msg.log = jobLog
+		msg.metrics = p.metrics
+
+		if p.deliveryCounter != nil {
+			p.countDeliveries(job)
+		}
+
+		p.addJob(job)
+		defer p.removeJob(job)
+		defer p.health.JobFinished(job.execUUID)
+
+		err := p.checkJobToExecute(job, job.run)
 		if err != nil {
+			logAttrs := logrus.Fields{"error": err, "msg": msg}
+			// The subscription stops pulling and waits for the other running jobs
+			jobLog.WithFields(logAttrs).Errorln("Job Error")
 			return err
 		}
 		return nil
 	})
-	return err
+	if err != nil {
+		return err
+	}
+	return p.drain()
+}
+
+// countDeliveries sets the number of deliveries of the message to job.
+// The deliveries are counted in memory if deliveryCounter fails because the message
+// would be retried forever if it's regarded as never delivered.
+func (p *Process) countDeliveries(job *Job) {
+	msgId := job.message.MessageId()
+	counter := p.deliveryCounter
+	deliveries, err := counter.Increment(msgId)
+	if err != nil {
+		job.logEntry().WithFields(logrus.Fields{"error": err}).Errorln("Failed to count deliveries. Counting them in memory instead")
+		counter = p.deliveryFallback
+		deliveries, err = counter.Increment(msgId)
+		if err != nil {
+			job.logEntry().WithFields(logrus.Fields{"error": err}).Errorln("Failed to count deliveries in memory")
+			return
+		}
+	}
+	job.deliveries = deliveries
+	job.deliveryCounter = counter
+}
+
+// serve starts the HTTP servers for the metrics and the health in background.
+// They share the server if they have the same listen address.
+func (p *Process) serve() {
+	muxes := map[string]*http.ServeMux{}
+	mux := func(listen string) *http.ServeMux {
+		m, ok := muxes[listen]
+		if !ok {
+			m = http.NewServeMux()
+			muxes[listen] = m
+		}
+		return m
+	}
+	if p.metrics != nil {
+		mux(p.config.Metrics.Listen).Handle(p.config.Metrics.Path, p.metrics.Handler())
+		log.WithFields(logrus.Fields{"listen": p.config.Metrics.Listen, "path": p.config.Metrics.Path}).Infoln("Serving metrics")
+	}
+	if p.health != nil {
+		m := mux(p.config.Health.Listen)
+		m.Handle("/healthz", p.health.LivenessHandler())
+		m.Handle("/readyz", p.health.ReadinessHandler())
+		log.WithFields(logrus.Fields{"listen": p.config.Health.Listen}).Infoln("Serving health")
+	}
+	for listen, m := range muxes {
+		go func(listen string, m *http.ServeMux) {
+			err := http.ListenAndServe(listen, m)
+			if err != nil {
+				log.WithFields(logrus.Fields{"error": err, "listen": listen}).Errorln("Failed to serve")
+			}
+		}(listen, m)
+	}
+}
+
+func (p *Process) handleSignals(signals chan os.Signal) {
+	for sig := range signals {
+		log.WithFields(logrus.Fields{"signal": sig}).Warnln("Signal received. Stop pulling job messages")
+		p.subscription.stop()
+
+		p.jobsMux.Lock()
+		if p.signal == nil {
+			p.signaledAt = time.Now()
+		}
+		p.signal = sig
+		for job := range p.jobs {
+			job.signal(sig)
+		}
+		p.jobsMux.Unlock()
+	}
+}
+
+// drain waits for the running jobs in the grace period and interrupts the jobs which don't finish.
+func (p *Process) drain() error {
+	grace := p.config.Job.gracePeriod()
+	p.jobsMux.Lock()
+	if !p.signaledAt.IsZero() {
+		grace -= time.Since(p.signaledAt)
+	}
+	p.jobsMux.Unlock()
+	if grace < 0 {
+		grace = 0
+	}
+	log.WithFields(logrus.Fields{"grace_period": grace}).Infoln("Waiting for running jobs")
+	if p.subscription.wait(grace) {
+		log.Infoln("All jobs finished")
+		return nil
+	}
+
+	p.jobsMux.Lock()
+	log.WithFields(logrus.Fields{"jobs": len(p.jobs)}).Warnln("Grace period passed. Interrupting running jobs")
+	for job := range p.jobs {
+		job.interrupt()
+	}
+	p.jobsMux.Unlock()
+
+	// The interrupted jobs send NACK by themselves
+	p.subscription.waitAll()
+	log.Infoln("All interrupted jobs finished")
+	return nil
+}
+
+func (p *Process) addJob(job *Job) {
+	p.jobsMux.Lock()
+	defer p.jobsMux.Unlock()
+	if p.jobs == nil {
+		p.jobs = map[*Job]bool{}
+	}
+	p.jobs[job] = true
+	if p.signal != nil {
+		job.signal(p.signal)
+	}
 }
 
-func (p *Process) replaceGlobalLog(newLog *logrus.Entry, f func() error) error {
-	log.Debugln("Process.replaceGlobalLog start")
-	defer log.Debugln("Process.replaceGlobalLog done")
-
-	// `log` is a global variable
-	logBackup := log
-	log = newLog
-	defer func() {
-		log = logBackup
-	}()
-	return f()
+func (p *Process) removeJob(job *Job) {
+	p.jobsMux.Lock()
+	defer p.jobsMux.Unlock()
+	delete(p.jobs, job)
 }
 
 func (p *Process) checkJobToExecute(job *Job, f func() error) error {
+	log := job.logEntry()
 	log.Debugln("Process.checkJobToExecute start")
 	defer log.Debugln("Process.checkJobToExecute done")
 
-	check := p.config.JobCheck.Checker()
+	check := p.config.JobCheck.Checker(log)
 	return check(job.message.ConcurrentBatchJobId(), job.message.Ack, f)
 }
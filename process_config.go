@@ -18,6 +18,12 @@ type (
 		Log      *LogConfig                  `json:"log,omitempty"`
 		Download *DownloadConfig             `json:"download"`
 		Upload   *UploadConfig               `json:"upload"`
+		Storage  *StorageConfig              `json:"storage,omitempty"`
+		Pubsub   *PubsubConfig               `json:"pubsub,omitempty"`
+		Metrics  *MetricsConfig              `json:"metrics,omitempty"`
+		Health   *HealthConfig               `json:"health,omitempty"`
+		Tracing  *TracingConfig              `json:"tracing,omitempty"`
+		Outbox   *OutboxConfig               `json:"outbox,omitempty"`
 	}
 )
 
@@ -32,6 +38,12 @@ func (c *ProcessConfig) setup(args []string) error {
 		"log":       c.setupLog,
 		"download":  c.setupDownload,
 		"upload":    c.setupUpload,
+		"storage":   c.setupStorage,
+		"pubsub":    c.setupPubsub,
+		"metrics":   c.setupMetrics,
+		"health":    c.setupHealth,
+		"tracing":   c.setupTracing,
+		"outbox":    c.setupOutbox,
 	}
 	for key, setup := range setups {
 		err := setup()
@@ -93,6 +105,53 @@ func (c *ProcessConfig) setupUpload() *ConfigError {
 	return c.Upload.setup()
 }
 
+func (c *ProcessConfig) setupStorage() *ConfigError {
+	if c.Storage == nil {
+		c.Storage = &StorageConfig{}
+	}
+	return c.Storage.setup()
+}
+
+func (c *ProcessConfig) setupPubsub() *ConfigError {
+	if c.Pubsub == nil {
+		c.Pubsub = &PubsubConfig{}
+	}
+	return c.Pubsub.setup()
+}
+
+func (c *ProcessConfig) setupMetrics() *ConfigError {
+	if c.Metrics == nil {
+		c.Metrics = &MetricsConfig{}
+	}
+	return c.Metrics.setup()
+}
+
+func (c *ProcessConfig) setupHealth() *ConfigError {
+	if c.Health == nil {
+		c.Health = &HealthConfig{}
+	}
+	return c.Health.setup()
+}
+
+func (c *ProcessConfig) setupTracing() *ConfigError {
+	if c.Tracing == nil {
+		c.Tracing = &TracingConfig{}
+	}
+	return c.Tracing.setup()
+}
+
+func (c *ProcessConfig) setupOutbox() *ConfigError {
+	if c.Outbox == nil {
+		c.Outbox = &OutboxConfig{}
+	}
+	return c.Outbox.setup()
+}
+
+// RequiresGoogleClient returns false if the process can run without the credentials of GCP.
+func (c *ProcessConfig) RequiresGoogleClient() bool {
+	return c.Storage.RequiresGoogleClient() || c.Pubsub.RequiresGoogleClient() || c.Log.Stackdriver != nil
+}
+
 func LoadProcessConfig(path string) (*ProcessConfig, error) {
 	raw, err := ioutil.ReadFile(path)
 	if err != nil {
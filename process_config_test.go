@@ -239,3 +239,76 @@ func TestLoadProcessConfig2(t *testing.T) {
 		assert.Equal(t, prog_topic, config.Progress.Topic)
 	}
 }
+
+func TestProcessConfigSetupEndpoints(t *testing.T) {
+	// Without emulators
+	tempEnv(t, map[string]string{
+		PubsubEmulatorHostKey:  "",
+		StorageEmulatorHostKey: "",
+	}, func() {
+		config := &ProcessConfig{}
+		err := config.setup([]string{"./cmd1"})
+		assert.NoError(t, err)
+		assert.Equal(t, "", config.Pubsub.Endpoint)
+		assert.Equal(t, "", config.Storage.Endpoint)
+		assert.True(t, config.RequiresGoogleClient())
+	})
+
+	// With emulators
+	tempEnv(t, map[string]string{
+		PubsubEmulatorHostKey:  "localhost:8085",
+		StorageEmulatorHostKey: "localhost:4443",
+	}, func() {
+		config := &ProcessConfig{}
+		err := config.setup([]string{"./cmd1"})
+		assert.NoError(t, err)
+		assert.Equal(t, "http://localhost:8085/", config.Pubsub.Endpoint)
+		assert.Equal(t, "http://localhost:4443/storage/v1/", config.Storage.Endpoint)
+		assert.False(t, config.RequiresGoogleClient())
+
+		// The endpoint in the config takes priority over the environment variable
+		config = &ProcessConfig{
+			Storage: &StorageConfig{Endpoint: "http://127.0.0.1:9000/storage/v1"},
+		}
+		err = config.setup([]string{"./cmd1"})
+		assert.NoError(t, err)
+		assert.Equal(t, "http://127.0.0.1:9000/storage/v1/", config.Storage.Endpoint)
+		assert.Equal(t, "http://localhost:8085/", config.Pubsub.Endpoint)
+		assert.False(t, config.RequiresGoogleClient())
+	})
+
+	// The custom endpoints use the credentials without no_auth
+	tempEnv(t, map[string]string{
+		PubsubEmulatorHostKey:  "",
+		StorageEmulatorHostKey: "",
+	}, func() {
+		config := &ProcessConfig{
+			Pubsub:  &PubsubConfig{Endpoint: "https://us-east1-pubsub.googleapis.com/"},
+			Storage: &StorageConfig{Endpoint: "https://storage-psc.p.googleapis.com/storage/v1/"},
+		}
+		err := config.setup([]string{"./cmd1"})
+		assert.NoError(t, err)
+		assert.True(t, config.Pubsub.RequiresGoogleClient())
+		assert.True(t, config.Storage.RequiresGoogleClient())
+
+		config = &ProcessConfig{
+			Pubsub:  &PubsubConfig{Endpoint: "http://localhost:8085/", NoAuth: true},
+			Storage: &StorageConfig{Endpoint: "http://localhost:4443/storage/v1/", NoAuth: true},
+		}
+		err = config.setup([]string{"./cmd1"})
+		assert.NoError(t, err)
+		assert.False(t, config.RequiresGoogleClient())
+	})
+
+	// With the emulators given by URLs
+	tempEnv(t, map[string]string{
+		PubsubEmulatorHostKey:  "https://pubsub-emulator:8085",
+		StorageEmulatorHostKey: "http://gcs-emulator:4443/",
+	}, func() {
+		config := &ProcessConfig{}
+		err := config.setup([]string{"./cmd1"})
+		assert.NoError(t, err)
+		assert.Equal(t, "https://pubsub-emulator:8085/", config.Pubsub.Endpoint)
+		assert.Equal(t, "http://gcs-emulator:4443/storage/v1/", config.Storage.Endpoint)
+	})
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	pubsub "google.golang.org/api/pubsub/v1"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testProcess is Process with the local storage and the file pubsub in a temporary directory.
+// The storage has gs://bucket1/in.txt whose content is "foo".
+type testProcess struct {
+	t      *testing.T
+	dir    string
+	root   string
+	script string
+	config *ProcessConfig
+	p      *Process
+	ps     *FilePubsub
+}
+
+// newTestProcess sets up Process which runs the shell script with args.
+// configure can modify the config before setup.
+func newTestProcess(t *testing.T, script string, args []string, configure func(*ProcessConfig)) *testProcess {
+	dir, err := ioutil.TempDir("", "process")
+	assert.NoError(t, err)
+
+	root := filepath.Join(dir, "storage")
+	ls := &LocalStorage{Root: root}
+	src := filepath.Join(dir, "src.txt")
+	assert.NoError(t, ioutil.WriteFile(src, []byte("foo"), 0644))
+	assert.NoError(t, ls.Upload("bucket1", "in.txt", src))
+
+	config := &ProcessConfig{
+		Job: &JobSubscriptionConfig{
+			Subscription: "projects/proj1/subscriptions/sub1",
+			PullInterval: 1,
+		},
+		Progress: &ProgressNotificationConfig{
+			Topic: "projects/proj1/topics/progress",
+		},
+		Storage: &StorageConfig{Type: StorageTypeLocal, Root: root},
+		Pubsub:  &PubsubConfig{Type: PubsubTypeFile},
+	}
+	if configure != nil {
+		configure(config)
+	}
+	scriptPath := filepath.Join(dir, "app.sh")
+	assert.NoError(t, ioutil.WriteFile(scriptPath, []byte("#!/bin/sh\n"+script), 0755))
+	assert.NoError(t, config.setup(append([]string{scriptPath}, args...)))
+
+	p := &Process{config: config}
+	assert.NoError(t, p.setup())
+
+	return &testProcess{
+		t:      t,
+		dir:    dir,
+		root:   root,
+		script: scriptPath,
+		config: config,
+		p:      p,
+		ps:     p.notification.publisher.(*FilePubsub),
+	}
+}
+
+func (tp *testProcess) close() {
+	os.RemoveAll(tp.dir)
+}
+
+func (tp *testProcess) add(msgId string, attrs map[string]string) {
+	tp.ps.Add(&pubsub.PubsubMessage{MessageId: msgId, Attributes: attrs})
+}
+
+// run runs the process until done returns true.
+// It runs until all of the messages are responded if done is nil.
+func (tp *testProcess) run(done func() bool) {
+	if done == nil {
+		done = func() bool { return tp.ps.Remaining() == 0 }
+	}
+	go func() {
+		for !done() {
+			time.Sleep(10 * time.Millisecond)
+		}
+		tp.p.subscription.stop()
+	}()
+	assert.NoError(tp.t, tp.p.run())
+}
+
+// progresses returns the progress notifications.
+func (tp *testProcess) progresses() []*FilePubsubPublished {
+	return tp.ps.Published(tp.config.Progress.Topic)
+}
+
+func TestProcessRunWithLocalServices(t *testing.T) {
+	tp := newTestProcess(t, "mkdir -p $1/bucket1 && cp $2 $1/bucket1/out.txt\n", []string{"%{uploads_dir}", "%{download_files.0}"}, nil)
+	defer tp.close()
+
+	tp.add("msg1", map[string]string{"download_files": `["gs://bucket1/in.txt"]`})
+	tp.run(nil)
+
+	data, err := ioutil.ReadFile(filepath.Join(tp.root, "bucket1", "out.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", string(data))
+
+	published := tp.progresses()
+	assert.NotEqual(t, 0, len(published))
+	assert.Equal(t, "msg1", published[len(published)-1].Attributes["job_message_id"])
+}
+
+func TestProcessInterruptJobAfterGracePeriod(t *testing.T) {
+	tp := newTestProcess(t, "trap '' TERM\ntouch $1\nsleep 30\n", []string{"%{attrs.marker}"}, func(c *ProcessConfig) {
+		grace := 1
+		c.Job.GracePeriod = &grace
+	})
+	defer tp.close()
+
+	marker := filepath.Join(tp.dir, "started")
+	tp.add("msg1", map[string]string{"marker": marker})
+
+	signals := make(chan os.Signal, 1)
+	go tp.p.handleSignals(signals)
+	defer close(signals)
+	started := time.Now()
+	tp.run(func() bool {
+		if _, err := os.Stat(marker); err != nil {
+			return false
+		}
+		signals <- syscall.SIGTERM
+		return true
+	})
+	assert.True(t, time.Since(started) < 10*time.Second)
+
+	responses := []*FilePubsubPublished{}
+	for _, msg := range tp.progresses() {
+		switch msg.Attributes["step"] {
+		case NACKSENDING.String(), ACKSENDING.String(), CANCELLING.String():
+			if msg.Attributes["step_status"] != STARTING.String() {
+				responses = append(responses, msg)
+			}
+		}
+	}
+	// run sends NACK only once after the command is killed
+	if assert.Equal(t, 1, len(responses)) {
+		msg := responses[0]
+		assert.Equal(t, "CANCELLING", msg.Attributes["step"])
+		assert.Equal(t, "SUCCESS", msg.Attributes["step_status"])
+		assert.Equal(t, "nack", msg.Attributes[ResponseKey])
+		assert.Equal(t, "true", msg.Attributes["interrupted"])
+		assert.Equal(t, syscall.SIGTERM.String(), msg.Attributes["signal"])
+		data, err := base64.StdEncoding.DecodeString(msg.Data)
+		assert.NoError(t, err)
+		assert.Contains(t, string(data), "Job was interrupted by terminated")
+	}
+	if assert.Equal(t, 1, tp.ps.Remaining()) {
+		assert.False(t, tp.ps.messages[0].deadline.After(time.Now()))
+	}
+}
+
+// ackFailingPuller fails to acknowledge the message only once.
+type ackFailingPuller struct {
+	Puller
+	mux    sync.Mutex
+	failed bool
+}
+
+func (p *ackFailingPuller) Acknowledge(subscription, ackId string) (*pubsub.Empty, error) {
+	p.mux.Lock()
+	failing := !p.failed
+	p.failed = true
+	p.mux.Unlock()
+	if failing {
+		return nil, fmt.Errorf("Failed to acknowledge %v", ackId)
+	}
+	return p.Puller.Acknowledge(subscription, ackId)
+}
+
+func TestProcessRunWithConcurrentJobError(t *testing.T) {
+	tp := newTestProcess(t, "if [ -n \"$1\" ]; then sleep 1; touch $1; fi\n", []string{"%{attrs.marker}"}, func(c *ProcessConfig) {
+		c.Job.Concurrency = 2
+	})
+	defer tp.close()
+	tp.p.subscription.puller = &ackFailingPuller{Puller: tp.ps}
+
+	marker := filepath.Join(tp.dir, "finished")
+	tp.add("fast", nil)
+	tp.add("slow", map[string]string{"marker": marker})
+
+	// The error of the fast job stops the process after the slow job finishes
+	err := tp.p.run()
+	assert.Error(t, err)
+	_, err = os.Stat(marker)
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, tp.ps.Remaining()) {
+		assert.Equal(t, "fast", tp.ps.messages[0].message.MessageId)
+	}
+}
@@ -31,6 +31,32 @@ func (pn *ProgressNotification) wrap(msg_id string, step JobStep, attrs map[stri
 	}
 }
 
+// wrapWithSummary works like wrap but adds the attributes and the message returned by f
+// to the notification of SUCCESS.
+func (pn *ProgressNotification) wrapWithSummary(msg_id string, step JobStep, attrs map[string]string, f func() (map[string]string, string, error)) func() error {
+	return func() error {
+		pn.notify(msg_id, step, STARTING, attrs)
+		summary, detail, err := f()
+		if err != nil {
+			pn.notifyWithMessage(msg_id, step, FAILURE, attrs, err.Error())
+			return err
+		}
+		merged := map[string]string{}
+		for k, v := range attrs {
+			merged[k] = v
+		}
+		for k, v := range summary {
+			merged[k] = v
+		}
+		msg := fmt.Sprintf("%v %v", step, SUCCESS)
+		if detail != "" {
+			msg = msg + "\n" + detail
+		}
+		pn.notifyWithMessage(msg_id, step, SUCCESS, merged, msg)
+		return nil
+	}
+}
+
 func (pn *ProgressNotification) notify(job_msg_id string, step JobStep, st JobStepStatus, attrs map[string]string) error {
 	msg := fmt.Sprintf("%v %v", step, st)
 	return pn.notifyWithMessage(job_msg_id, step, st, attrs, msg)
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	pubsub "google.golang.org/api/pubsub/v1"
+)
+
+type PubsubConfig struct {
+	Type        string `json:"type,omitempty"`
+	Input       string `json:"input,omitempty"`
+	Output      string `json:"output,omitempty"`
+	AckDeadline int    `json:"ack_deadline,omitempty"`
+	Endpoint    string `json:"endpoint,omitempty"`
+	// NoAuth sends the requests without the credentials of GCP.
+	// It's set if PUBSUB_EMULATOR_HOST is set.
+	NoAuth bool `json:"no_auth,omitempty"`
+}
+
+const (
+	PubsubTypeCloud = "cloud"
+	PubsubTypeFile  = "file"
+)
+
+var PubsubTypes = []string{
+	PubsubTypeCloud,
+	PubsubTypeFile,
+}
+
+// emulatorURL returns the URL of the emulator given by the environment variable
+// which can be a host and port like localhost:8085 or a URL like https://emulator:8085.
+func emulatorURL(host string) string {
+	if strings.Contains(host, "://") {
+		return strings.TrimRight(host, "/")
+	}
+	return "http://" + host
+}
+
+func (c *PubsubConfig) setup() *ConfigError {
+	if c.Type == "" {
+		c.Type = PubsubTypeCloud
+	}
+	switch c.Type {
+	case PubsubTypeCloud:
+		if host := os.Getenv(PubsubEmulatorHostKey); host != "" {
+			if c.Endpoint == "" {
+				c.Endpoint = emulatorURL(host) + "/"
+			}
+			c.NoAuth = true
+		}
+		if c.Endpoint != "" && !strings.HasSuffix(c.Endpoint, "/") {
+			c.Endpoint = c.Endpoint + "/"
+		}
+		return nil
+	case PubsubTypeFile:
+		if c.AckDeadline == 0 {
+			c.AckDeadline = 10
+		}
+		if c.AckDeadline < 0 {
+			return &ConfigError{Name: "ack_deadline", Message: fmt.Sprintf("Invalid ack_deadline %d", c.AckDeadline)}
+		}
+		return nil
+	default:
+		return &ConfigError{Name: "type", Message: fmt.Sprintf("%q is invalid. It must be one of %v", c.Type, PubsubTypes)}
+	}
+}
+
+// RequiresGoogleClient returns false for the puller and publisher which don't need the credentials of GCP.
+func (c *PubsubConfig) RequiresGoogleClient() bool {
+	return c.Type == PubsubTypeCloud && !c.NoAuth
+}
+
+func (c *PubsubConfig) Services(client *http.Client) (Puller, Publisher, error) {
+	switch c.Type {
+	case PubsubTypeFile:
+		ps, err := LoadFilePubsub(c.Input, c.Output, time.Duration(c.AckDeadline)*time.Second)
+		if err != nil {
+			return nil, nil, err
+		}
+		return ps, ps, nil
+	default:
+		// The emulator doesn't need any authorization
+		if c.NoAuth {
+			client = http.DefaultClient
+		}
+		pubsubService, err := pubsub.New(client)
+		if err != nil {
+			return nil, nil, err
+		}
+		if c.Endpoint != "" {
+			pubsubService.BasePath = c.Endpoint
+		}
+		return &pubsubPuller{pubsubService.Projects.Subscriptions}, &pubsubPublisher{pubsubService.Projects.Topics}, nil
+	}
+}
@@ -7,6 +7,12 @@ import (
 )
 
 func RetryWithSleep(operation backoff.Operation, b backoff.BackOff) error {
+	return RetryWithCancel(operation, b, nil)
+}
+
+// RetryWithCancel stops sleeping and returns the last error when cancel is closed.
+// A nil cancel never stops the retries.
+func RetryWithCancel(operation backoff.Operation, b backoff.BackOff, cancel <-chan struct{}) error {
 	var err error
 	var next time.Duration
 
@@ -24,6 +30,10 @@ func RetryWithSleep(operation backoff.Operation, b backoff.BackOff) error {
 			return err
 		}
 
-		time.Sleep(next)
+		select {
+		case <-time.After(next):
+		case <-cancel:
+			return err
+		}
 	}
 }
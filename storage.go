@@ -2,11 +2,17 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
 	"io"
+	"io/ioutil"
 	"mime"
 	"net/http"
 	"os"
 	"path"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
 
 	"google.golang.org/api/googleapi"
 	storage "google.golang.org/api/storage/v1"
@@ -18,21 +24,75 @@ type (
 	Storage interface {
 		Download(bucket, object, destPath string) error
 		Upload(bucket, object, srcPath string) error
+		// UploadObject uploads the file with the attributes of obj like ContentType and Metadata.
+		// opts can be nil.
+		UploadObject(bucket string, obj *storage.Object, srcPath string, opts *UploadOptions) error
 		Get(bucket, object string) (*storage.Object, error)
 		Delete(bucket, object string) error
 		Update(bucket, object string, body *storage.Object) (*storage.Object, error)
 		CreateEmptyFile(bucket, object string) (*storage.Object, error)
+		// List returns the objects whose names start with prefix in lexicographical order.
+		List(bucket, prefix string) ([]*storage.Object, error)
 	}
 
 	CloudStorage struct {
 		service          *storage.ObjectsService
 		ContentTypeByExt bool
+
+		// client and uploadPath are used to send the resumable upload in the session kept across the tries
+		client             *http.Client
+		uploadPath         string
+		resumableChunkSize int64
+		sessions           map[string]*resumableSession
+		sessionsMux        sync.Mutex
+
+		// The files larger than these thresholds are uploaded by resumable upload
+		// or parallel composite upload. They are disabled if they are 0.
+		ResumableThreshold int64
+		CompositeThreshold int64
+		CompositeParts     int
+		// The parts for parallel composite upload are uploaded under CompositeTempPrefix
+		// so that they don't fire the notifications for the destination
+		CompositeTempPrefix string
+
+		// The files larger than ChunkSize are downloaded in ChunksPerFile parallel ranges.
+		ChunkSize     int64
+		ChunksPerFile int
+	}
+
+	// UploadOptions are the options of each upload
+	UploadOptions struct {
+		// NoClobber makes UploadObject return ObjectExistsError instead of overwriting the object.
+		NoClobber bool
 	}
 )
 
+func (o *UploadOptions) noClobber() bool {
+	return o != nil && o.NoClobber
+}
+
+// uploadBasePath returns the base URL of the upload API for the base URL of the JSON API.
+func uploadBasePath(basePath string) string {
+	if strings.HasSuffix(basePath, "/storage/v1/") {
+		return strings.TrimSuffix(basePath, "storage/v1/") + "upload/storage/v1/"
+	}
+	return basePath
+}
+
 func (ct *CloudStorage) Download(bucket, object, destPath string) error {
-	log := log.WithFields(logrus.Fields{"url": "gs://" + bucket + "/" + object, "destPath": destPath})
+	url := "gs://" + bucket + "/" + object
+	log := log.WithFields(logrus.Fields{"url": url, "destPath": destPath})
 	log.Debugln("Downloading")
+	obj, err := ct.service.Get(bucket, object).Do()
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Warnf("Failed to get GCS file info")
+		return err
+	}
+	// The ranges of the object compressed by gzip can't be decompressed separately
+	if ct.ChunksPerFile > 1 && int64(obj.Size) > ct.ChunkSize && !isGzipEncoded(obj) {
+		return ct.downloadRanges(obj, destPath)
+	}
+
 	dest, err := os.Create(destPath)
 	if err != nil {
 		log.WithFields(logrus.Fields{"error": err}).Warnf("Creating dest file")
@@ -40,43 +100,127 @@ func (ct *CloudStorage) Download(bucket, object, destPath string) error {
 	}
 	defer dest.Close()
 
-	resp, err := ct.service.Get(bucket, object).Download()
+	// Download the generation which has the hashes got above
+	call := ct.service.Get(bucket, object).Generation(obj.Generation)
+	if isGzipEncoded(obj) {
+		// Get the stored bytes without decompressive transcoding to verify them
+		call.Header().Set("Accept-Encoding", "gzip")
+	}
+	resp, err := call.Download()
 	if err != nil {
 		log.WithFields(logrus.Fields{"error": err}).Warnf("Failed to download")
 		return err
 	}
 	defer resp.Body.Close()
 
-	n, err := io.Copy(dest, resp.Body)
+	n, err := copyObject(dest, resp.Body, url, obj)
 	if err != nil {
-		log.WithFields(logrus.Fields{"error": err}).Warnf("Failed to copy")
+		log.WithFields(logrus.Fields{"error": err}).Warnf("Failed to download the content")
 		return err
 	}
 	log.WithFields(logrus.Fields{"size": n}).Debugln("Download successfully")
 	return nil
 }
 
+func isGzipEncoded(obj *storage.Object) bool {
+	return obj.ContentEncoding == "gzip"
+}
+
+// copyObject writes the content of the object from body to dest and verifies it.
+// The object compressed by gzip is verified by the stored bytes and written after decompressed.
+func copyObject(dest io.Writer, body io.Reader, url string, obj *storage.Object) (int64, error) {
+	h := NewObjectHash()
+	var n int64
+	if isGzipEncoded(obj) {
+		src := io.TeeReader(body, h)
+		zr, err := gzip.NewReader(src)
+		if err != nil {
+			return 0, err
+		}
+		n, err = io.Copy(dest, zr)
+		if err != nil {
+			return n, err
+		}
+		// Hash the rest of the body after the gzip stream too
+		if _, err := io.Copy(ioutil.Discard, src); err != nil {
+			return n, err
+		}
+	} else {
+		var err error
+		n, err = io.Copy(io.MultiWriter(dest, h), body)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, h.Verify(url, obj)
+}
+
 func (ct *CloudStorage) Upload(bucket, object, srcPath string) error {
-	logAttrs := logrus.Fields{"url": "gs://" + bucket + "/" + object, "srcPath": srcPath}
+	return ct.UploadObject(bucket, &storage.Object{Name: object}, srcPath, nil)
+}
+
+func (ct *CloudStorage) UploadObject(bucket string, obj *storage.Object, srcPath string, opts *UploadOptions) error {
+	object := obj.Name
+	url := "gs://" + bucket + "/" + object
+	logAttrs := logrus.Fields{"url": url, "srcPath": srcPath}
 	log.WithFields(logAttrs).Debugln("Uploading")
 	f, err := os.Open(srcPath)
 	if err != nil {
 		log.WithFields(logrus.Fields{"error": err}).Warnf("Failed to open the file")
 		return err
 	}
-	obj := &storage.Object{Name: object}
-	if ct.ContentTypeByExt {
+	defer f.Close()
+	if obj.ContentType == "" && ct.ContentTypeByExt {
 		obj.ContentType = mime.TypeByExtension(path.Ext(object))
 	}
-	_, err = ct.service.Insert(bucket, obj).Media(f).Do()
+
+	info, err := f.Stat()
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Warnf("Failed to stat the file")
+		return err
+	}
+	size := info.Size()
+	switch {
+	case ct.CompositeThreshold > 0 && size >= ct.CompositeThreshold:
+		return ct.uploadComposite(bucket, obj, f, size, opts)
+	case ct.ResumableThreshold > 0 && size >= ct.ResumableThreshold:
+		return ct.uploadResumable(bucket, obj, srcPath, f, size, opts)
+	}
+
+	h := NewObjectHash()
+	res, err := ct.insert(bucket, obj, opts).Media(io.TeeReader(f, h)).Do()
 	if err != nil {
 		log.WithFields(logrus.Fields{"error": err}).Warnf("Failed to upload")
+		return objectExistsError(url, err, opts)
+	}
+	err = h.Verify(url, res)
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Warnf("Failed to verify uploaded file")
+		// Don't leave the broken object
+		ct.Delete(bucket, object)
 		return err
 	}
 	log.WithFields(logAttrs).Debugln("Upload successfully")
 	return nil
 }
 
+// insert returns the call which fails if the object exists when NoClobber of opts is true.
+func (ct *CloudStorage) insert(bucket string, obj *storage.Object, opts *UploadOptions) *storage.ObjectsInsertCall {
+	call := ct.service.Insert(bucket, obj)
+	if opts.noClobber() {
+		call = call.IfGenerationMatch(0)
+	}
+	return call
+}
+
+// objectExistsError converts the error of the precondition for NoClobber to ObjectExistsError.
+func objectExistsError(url string, err error, opts *UploadOptions) error {
+	if opts.noClobber() && IsGoogleApiError(err, http.StatusPreconditionFailed) {
+		return &ObjectExistsError{URL: url}
+	}
+	return err
+}
+
 func (ct *CloudStorage) Get(bucket, object string) (*storage.Object, error) {
 	log := log.WithFields(logrus.Fields{"url": "gs://" + bucket + "/" + object})
 	log.Debugln("Getting file info")
@@ -119,6 +263,33 @@ func (ct *CloudStorage) Update(bucket, object string, body *storage.Object) (*st
 	return obj, nil
 }
 
+// UpdateIfMatch updates the object only if its generation and metageneration match.
+func (ct *CloudStorage) UpdateIfMatch(bucket, object string, generation, metageneration int64, body *storage.Object) (*storage.Object, error) {
+	log := log.WithFields(logrus.Fields{"url": "gs://" + bucket + "/" + object, "generation": generation, "metageneration": metageneration})
+	log.Debugln("Updating file")
+	obj, err := ct.service.Update(bucket, object, body).IfGenerationMatch(generation).IfMetagenerationMatch(metageneration).Do()
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Warnf("Failed to update GCS file")
+		return nil, err
+	}
+	return obj, nil
+}
+
+func (ct *CloudStorage) List(bucket, prefix string) ([]*storage.Object, error) {
+	log := log.WithFields(logrus.Fields{"url": "gs://" + bucket + "/" + prefix})
+	log.Debugln("Listing files")
+	res := []*storage.Object{}
+	err := ct.service.List(bucket).Prefix(prefix).Pages(context.Background(), func(objs *storage.Objects) error {
+		res = append(res, objs.Items...)
+		return nil
+	})
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Errorf("Failed to list GCS files")
+		return nil, err
+	}
+	return res, nil
+}
+
 func IsGoogleApiError(err error, code int) bool {
 	if err != nil {
 		apiErr, ok := err.(*googleapi.Error)
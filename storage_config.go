@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	storage "google.golang.org/api/storage/v1"
+)
+
+type StorageConfig struct {
+	Type     string `json:"type,omitempty"`
+	Root     string `json:"root,omitempty"`
+	Endpoint string `json:"endpoint,omitempty"`
+	// NoAuth sends the requests without the credentials of GCP.
+	// It's set if STORAGE_EMULATOR_HOST is set.
+	NoAuth bool `json:"no_auth,omitempty"`
+}
+
+const (
+	StorageTypeGcs   = "gcs"
+	StorageTypeLocal = "local"
+)
+
+var StorageTypes = []string{
+	StorageTypeGcs,
+	StorageTypeLocal,
+}
+
+func (c *StorageConfig) setup() *ConfigError {
+	if c.Type == "" {
+		c.Type = StorageTypeGcs
+	}
+	switch c.Type {
+	case StorageTypeGcs:
+		if host := os.Getenv(StorageEmulatorHostKey); host != "" {
+			if c.Endpoint == "" {
+				c.Endpoint = emulatorURL(host) + "/storage/v1/"
+			}
+			c.NoAuth = true
+		}
+		if c.Endpoint != "" && !strings.HasSuffix(c.Endpoint, "/") {
+			c.Endpoint = c.Endpoint + "/"
+		}
+		return nil
+	case StorageTypeLocal:
+		if c.Root == "" {
+			return &ConfigError{Name: "root", Message: fmt.Sprintf("root is required for type %q", c.Type)}
+		}
+		return nil
+	default:
+		return &ConfigError{Name: "type", Message: fmt.Sprintf("%q is invalid. It must be one of %v", c.Type, StorageTypes)}
+	}
+}
+
+// RequiresGoogleClient returns false for the storage which doesn't need the credentials of GCP.
+func (c *StorageConfig) RequiresGoogleClient() bool {
+	return c.Type == StorageTypeGcs && !c.NoAuth
+}
+
+func (c *StorageConfig) Storage(client *http.Client, download *DownloadConfig, upload *UploadConfig) (Storage, error) {
+	switch c.Type {
+	case StorageTypeLocal:
+		return &LocalStorage{
+			Root:             c.Root,
+			ContentTypeByExt: upload.ContentTypeByExt,
+		}, nil
+	default:
+		// The servers such as fake-gcs-server don't need any authorization
+		if c.NoAuth {
+			client = http.DefaultClient
+		}
+		storageService, err := storage.New(client)
+		if err != nil {
+			return nil, err
+		}
+		if c.Endpoint != "" {
+			storageService.BasePath = c.Endpoint
+		}
+		return &CloudStorage{
+			service:             storageService.Objects,
+			client:              client,
+			uploadPath:          uploadBasePath(storageService.BasePath),
+			ContentTypeByExt:    upload.ContentTypeByExt,
+			ResumableThreshold:  upload.resumableThreshold,
+			CompositeThreshold:  upload.compositeThreshold,
+			CompositeParts:      upload.CompositeParts,
+			CompositeTempPrefix: upload.CompositeTempPrefix,
+			ChunkSize:           download.chunkSize,
+			ChunksPerFile:       download.ChunksPerFile,
+		}, nil
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+
+	storage "google.golang.org/api/storage/v1"
+
+	logrus "github.com/sirupsen/logrus"
+)
+
+// RangedDownload writes the ranges of an object into a preallocated file in parallel.
+// The completed ranges are recorded in the progress file so that the next try
+// downloads only the rest of them.
+type RangedDownload struct {
+	URL         string
+	Object      *storage.Object
+	DestPath    string
+	ChunkSize   int64
+	Parallelism int
+
+	// fetch returns the body of the range from start to end inclusive.
+	fetch func(start, end int64) (io.ReadCloser, error)
+
+	progress *rangedDownloadProgress
+	mux      sync.Mutex
+}
+
+type rangedDownloadProgress struct {
+	Generation int64        `json:"generation"`
+	Size       uint64       `json:"size"`
+	ChunkSize  int64        `json:"chunk_size"`
+	Completed  map[int]bool `json:"completed"`
+}
+
+const RangedDownloadProgressSuffix = ".ranges"
+
+func (d *RangedDownload) progressPath() string {
+	return d.DestPath + RangedDownloadProgressSuffix
+}
+
+func (d *RangedDownload) chunks() int {
+	return int((int64(d.Object.Size) + d.ChunkSize - 1) / d.ChunkSize)
+}
+
+func (d *RangedDownload) Run() error {
+	log := log.WithFields(logrus.Fields{"url": d.URL, "destPath": d.DestPath, "size": d.Object.Size})
+
+	d.loadProgress()
+
+	f, err := os.OpenFile(d.DestPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Warnf("Creating dest file")
+		return err
+	}
+	defer f.Close()
+	err = f.Truncate(int64(d.Object.Size))
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Warnf("Failed to allocate dest file")
+		return err
+	}
+
+	indexes := make(chan int)
+	errs := make(chan error, d.chunks())
+	var wg sync.WaitGroup
+	for i := 0; i < d.Parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				if err := d.downloadChunk(f, index); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	for index := 0; index < d.chunks(); index++ {
+		if d.completed(index) {
+			continue
+		}
+		indexes <- index
+	}
+	close(indexes)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		log.WithFields(logrus.Fields{"error": err}).Warnf("Failed to download ranges")
+		return err
+	}
+
+	h, err := hashSection(f, 0, int64(d.Object.Size))
+	if err != nil {
+		return err
+	}
+	os.Remove(d.progressPath())
+	err = h.Verify(d.URL, d.Object)
+	if err != nil {
+		// Download all of the ranges again on the next try
+		log.WithFields(logrus.Fields{"error": err}).Warnf("Failed to verify downloaded file")
+		return err
+	}
+	log.Debugln("Download ranges successfully")
+	return nil
+}
+
+func (d *RangedDownload) downloadChunk(f io.WriterAt, index int) error {
+	start := int64(index) * d.ChunkSize
+	end := start + d.ChunkSize - 1
+	if end >= int64(d.Object.Size) {
+		end = int64(d.Object.Size) - 1
+	}
+	body, err := d.fetch(start, end)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	n, err := io.Copy(&offsetWriter{w: f, offset: start}, body)
+	if err != nil {
+		return err
+	}
+	if n != end-start+1 {
+		return &ChecksumError{URL: d.URL, Algorithm: "range size", Expected: fmt.Sprintf("%d", end-start+1), Actual: fmt.Sprintf("%d", n)}
+	}
+	return d.complete(index)
+}
+
+func (d *RangedDownload) loadProgress() {
+	d.progress = &rangedDownloadProgress{
+		Generation: d.Object.Generation,
+		Size:       d.Object.Size,
+		ChunkSize:  d.ChunkSize,
+		Completed:  map[int]bool{},
+	}
+	data, err := ioutil.ReadFile(d.progressPath())
+	if err != nil {
+		return
+	}
+	var p rangedDownloadProgress
+	if err := json.Unmarshal(data, &p); err != nil {
+		return
+	}
+	// The ranges of another generation can't be used
+	if p.Generation != d.progress.Generation || p.Size != d.progress.Size || p.ChunkSize != d.progress.ChunkSize || p.Completed == nil {
+		return
+	}
+	log.WithFields(logrus.Fields{"url": d.URL, "completed": len(p.Completed)}).Infoln("Resuming ranged download")
+	d.progress = &p
+}
+
+func (d *RangedDownload) completed(index int) bool {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	return d.progress.Completed[index]
+}
+
+func (d *RangedDownload) complete(index int) error {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.progress.Completed[index] = true
+	data, err := json.Marshal(d.progress)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(d.progressPath(), data, 0644)
+}
+
+type offsetWriter struct {
+	w      io.WriterAt
+	offset int64
+}
+
+func (ow *offsetWriter) Write(p []byte) (int, error) {
+	n, err := ow.w.WriteAt(p, ow.offset)
+	ow.offset += int64(n)
+	return n, err
+}
+
+func (ct *CloudStorage) downloadRanges(obj *storage.Object, destPath string) error {
+	d := &RangedDownload{
+		URL:         "gs://" + obj.Bucket + "/" + obj.Name,
+		Object:      obj,
+		DestPath:    destPath,
+		ChunkSize:   ct.ChunkSize,
+		Parallelism: ct.ChunksPerFile,
+		fetch: func(start, end int64) (io.ReadCloser, error) {
+			call := ct.service.Get(obj.Bucket, obj.Name).Generation(obj.Generation)
+			call.Header().Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+			resp, err := call.Download()
+			if err != nil {
+				return nil, err
+			}
+			if resp.StatusCode != http.StatusPartialContent {
+				resp.Body.Close()
+				return nil, fmt.Errorf("Unexpected status %d for range %d-%d of gs://%s/%s", resp.StatusCode, start, end, obj.Bucket, obj.Name)
+			}
+			return resp.Body, nil
+		},
+	}
+	return d.Run()
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	storage "google.golang.org/api/storage/v1"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRangedDownload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ranged-download")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	content := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	h := NewObjectHash()
+	h.Write(content)
+	obj := &storage.Object{
+		Bucket:     "bucket1",
+		Name:       "path/to/file1",
+		Generation: 100,
+		Size:       uint64(len(content)),
+		Crc32c:     h.Crc32c(),
+		Md5Hash:    h.Md5Hash(),
+	}
+
+	var mux sync.Mutex
+	fetched := []int64{}
+	failAt := int64(10)
+	d := &RangedDownload{
+		URL:         "gs://bucket1/path/to/file1",
+		Object:      obj,
+		DestPath:    filepath.Join(dir, "file1"),
+		ChunkSize:   10,
+		Parallelism: 3,
+		fetch: func(start, end int64) (io.ReadCloser, error) {
+			mux.Lock()
+			defer mux.Unlock()
+			if start == failAt {
+				return nil, errors.New("Something wrong")
+			}
+			fetched = append(fetched, start)
+			return ioutil.NopCloser(bytes.NewReader(content[start : end+1])), nil
+		},
+	}
+
+	// 1st try fails at the 2nd range
+	assert.Error(t, d.Run())
+	assert.Equal(t, 3, len(fetched))
+	_, err = os.Stat(d.DestPath + RangedDownloadProgressSuffix)
+	assert.NoError(t, err)
+
+	// 2nd try downloads only the failed range
+	fetched = []int64{}
+	failAt = -1
+	assert.NoError(t, d.Run())
+	assert.Equal(t, []int64{10}, fetched)
+
+	data, err := ioutil.ReadFile(d.DestPath)
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+	_, err = os.Stat(d.DestPath + RangedDownloadProgressSuffix)
+	assert.True(t, os.IsNotExist(err))
+
+	// Broken range is detected by the checksum
+	d.fetch = func(start, end int64) (io.ReadCloser, error) {
+		b := make([]byte, end-start+1)
+		return ioutil.NopCloser(bytes.NewReader(b)), nil
+	}
+	err = d.Run()
+	assert.IsType(t, &ChecksumError{}, err)
+}
+
+func TestCopyObjectWithGzipEncoding(t *testing.T) {
+	content := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	_, err := zw.Write(content)
+	assert.NoError(t, err)
+	assert.NoError(t, zw.Close())
+
+	// The hashes of the object are for the compressed bytes
+	h := NewObjectHash()
+	h.Write(compressed.Bytes())
+	obj := &storage.Object{
+		Size:            uint64(compressed.Len()),
+		Crc32c:          h.Crc32c(),
+		Md5Hash:         h.Md5Hash(),
+		ContentEncoding: "gzip",
+	}
+
+	var dest bytes.Buffer
+	n, err := copyObject(&dest, bytes.NewReader(compressed.Bytes()), "gs://bucket1/file1.gz", obj)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(content)), n)
+	assert.Equal(t, content, dest.Bytes())
+
+	// Broken stored bytes
+	broken := append([]byte{}, compressed.Bytes()...)
+	broken[len(broken)-1] ^= 0xff
+	_, err = copyObject(&bytes.Buffer{}, bytes.NewReader(broken), "gs://bucket1/file1.gz", obj)
+	assert.Error(t, err)
+
+	// The object without Content-Encoding is written as it is
+	obj.ContentEncoding = ""
+	dest.Reset()
+	_, err = copyObject(&dest, bytes.NewReader(compressed.Bytes()), "gs://bucket1/file1.gz", obj)
+	assert.NoError(t, err)
+	assert.Equal(t, compressed.Bytes(), dest.Bytes())
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"regexp"
+	"strconv"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/api/googleapi"
+	storage "google.golang.org/api/storage/v1"
+
+	logrus "github.com/sirupsen/logrus"
+)
+
+type compositePart struct {
+	name   string
+	offset int64
+	size   int64
+}
+
+// compositePartsPrefix returns the prefix of the names of the parts of the object.
+func compositePartsPrefix(tempPrefix, object string) string {
+	return tempPrefix + object + ".composite-part-"
+}
+
+// compositeParts splits the file into n parts at most.
+// The parts are named under tempPrefix.
+func compositeParts(tempPrefix, object string, size int64, n int) []*compositePart {
+	partSize := (size + int64(n) - 1) / int64(n)
+	if partSize < 1 {
+		partSize = 1
+	}
+	count := int((size + partSize - 1) / partSize)
+	res := []*compositePart{}
+	for offset := int64(0); offset < size; offset += partSize {
+		s := partSize
+		if offset+s > size {
+			s = size - offset
+		}
+		res = append(res, &compositePart{
+			name:   fmt.Sprintf("%s%02d-of-%02d", compositePartsPrefix(tempPrefix, object), len(res)+1, count),
+			offset: offset,
+			size:   s,
+		})
+	}
+	return res
+}
+
+func hashSection(r io.ReaderAt, offset, size int64) (*ObjectHash, error) {
+	h := NewObjectHash()
+	if _, err := io.Copy(h, io.NewSectionReader(r, offset, size)); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// detectContentType returns the content type in the same way as Media does
+// because ResumableMedia doesn't detect it.
+func detectContentType(obj *storage.Object, r io.ReaderAt) string {
+	if obj.ContentType != "" {
+		return obj.ContentType
+	}
+	buf := make([]byte, 512)
+	n, _ := r.ReadAt(buf, 0)
+	return http.DetectContentType(buf[:n])
+}
+
+// resumableSession is the session of the resumable upload which is kept across the tries.
+type resumableSession struct {
+	uri  string
+	size int64
+}
+
+// uploadResumable sends the file in chunks by the resumable upload. The session is kept
+// when the upload fails, and the next try continues from the offset which GCS has committed
+// instead of restarting from the beginning. The session is kept for each pair of the object and srcPath.
+func (ct *CloudStorage) uploadResumable(bucket string, obj *storage.Object, srcPath string, r io.ReaderAt, size int64, opts *UploadOptions) error {
+	url := "gs://" + bucket + "/" + obj.Name
+	log := log.WithFields(logrus.Fields{"url": url, "size": size})
+	log.Debugln("Uploading by resumable upload")
+
+	h, err := hashSection(r, 0, size)
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Warnf("Failed to calculate hashes")
+		return err
+	}
+	obj.ContentType = detectContentType(obj, r)
+
+	key := url + " " + srcPath
+	var offset int64
+	var res *storage.Object
+	session := ct.resumableSession(key, size)
+	if session != nil {
+		offset, res, err = ct.queryResumable(session.uri, size)
+		if err != nil {
+			log.WithFields(logrus.Fields{"error": err}).Warnf("Failed to resume the upload session. Restarting")
+			session = nil
+		} else {
+			log.WithFields(logrus.Fields{"offset": offset}).Infoln("Resuming the upload session")
+		}
+	}
+	if session == nil {
+		uri, err := ct.startResumable(bucket, obj, size, opts)
+		if err != nil {
+			log.WithFields(logrus.Fields{"error": err}).Warnf("Failed to start the upload session")
+			return objectExistsError(url, err, opts)
+		}
+		session = &resumableSession{uri: uri, size: size}
+		ct.setResumableSession(key, session)
+		offset = 0
+	}
+	if res == nil {
+		res, err = ct.sendResumable(session.uri, r, offset, size)
+		if err != nil {
+			log.WithFields(logrus.Fields{"error": err}).Warnf("Failed to upload")
+			err = objectExistsError(url, err, opts)
+			if _, ok := err.(*ObjectExistsError); ok {
+				ct.setResumableSession(key, nil)
+			}
+			return err
+		}
+	}
+	ct.setResumableSession(key, nil)
+
+	err = h.Verify(url, res)
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Warnf("Failed to verify uploaded file")
+		ct.Delete(bucket, obj.Name)
+		return err
+	}
+	log.Debugln("Upload successfully")
+	return nil
+}
+
+// resumableSession returns the session for key which has the same size.
+func (ct *CloudStorage) resumableSession(key string, size int64) *resumableSession {
+	ct.sessionsMux.Lock()
+	defer ct.sessionsMux.Unlock()
+	session := ct.sessions[key]
+	if session == nil || session.size != size {
+		return nil
+	}
+	return session
+}
+
+// setResumableSession removes the session for key if session is nil.
+func (ct *CloudStorage) setResumableSession(key string, session *resumableSession) {
+	ct.sessionsMux.Lock()
+	defer ct.sessionsMux.Unlock()
+	if session == nil {
+		delete(ct.sessions, key)
+		return
+	}
+	if ct.sessions == nil {
+		ct.sessions = map[string]*resumableSession{}
+	}
+	ct.sessions[key] = session
+}
+
+// startResumable returns the URI of the new upload session.
+func (ct *CloudStorage) startResumable(bucket string, obj *storage.Object, size int64, opts *UploadOptions) (string, error) {
+	q := neturl.Values{}
+	q.Set("uploadType", "resumable")
+	q.Set("name", obj.Name)
+	if opts.noClobber() {
+		q.Set("ifGenerationMatch", "0")
+	}
+	body, err := json.Marshal(obj)
+	if err != nil {
+		return "", err
+	}
+	u := ct.uploadPath + "b/" + neturl.PathEscape(bucket) + "/o?" + q.Encode()
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set("X-Upload-Content-Type", obj.ContentType)
+	req.Header.Set("X-Upload-Content-Length", strconv.FormatInt(size, 10))
+	res, err := ct.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if err := googleapi.CheckResponse(res); err != nil {
+		return "", err
+	}
+	uri := res.Header.Get("Location")
+	if uri == "" {
+		return "", fmt.Errorf("No upload session URI for gs://%s/%s", bucket, obj.Name)
+	}
+	return uri, nil
+}
+
+// queryResumable returns the offset to continue the upload from,
+// or the object if the upload has been completed.
+func (ct *CloudStorage) queryResumable(uri string, size int64) (int64, *storage.Object, error) {
+	req, err := http.NewRequest(http.MethodPut, uri, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+	res, err := ct.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer res.Body.Close()
+	return resumableResponse(res)
+}
+
+// sendResumable sends the file from offset in chunks.
+func (ct *CloudStorage) sendResumable(uri string, r io.ReaderAt, offset, size int64) (*storage.Object, error) {
+	chunkSize := ct.resumableChunkSize
+	if chunkSize < 1 {
+		chunkSize = googleapi.DefaultUploadChunkSize
+	}
+	for offset < size {
+		end := offset + chunkSize
+		if end > size {
+			end = size
+		}
+		req, err := http.NewRequest(http.MethodPut, uri, io.NewSectionReader(r, offset, end-offset))
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = end - offset
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, end-1, size))
+		res, err := ct.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		next, obj, err := resumableResponse(res)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if obj != nil {
+			return obj, nil
+		}
+		offset = next
+	}
+	return nil, fmt.Errorf("The upload session %s wasn't completed after %d bytes", uri, size)
+}
+
+// resumableRangePattern matches the Range header of the bytes which GCS has committed.
+var resumableRangePattern = regexp.MustCompile(`\Abytes=0-(\d+)\z`)
+
+// resumableResponse returns the next offset for 308 or the object uploaded for 200 and 201.
+func resumableResponse(res *http.Response) (int64, *storage.Object, error) {
+	switch res.StatusCode {
+	case http.StatusPermanentRedirect:
+		m := resumableRangePattern.FindStringSubmatch(res.Header.Get("Range"))
+		if m == nil {
+			return 0, nil, nil
+		}
+		last, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil {
+			return 0, nil, err
+		}
+		return last + 1, nil, nil
+	case http.StatusOK, http.StatusCreated:
+		obj := &storage.Object{}
+		if err := json.NewDecoder(res.Body).Decode(obj); err != nil {
+			return 0, nil, err
+		}
+		return 0, obj, nil
+	default:
+		return 0, nil, googleapi.CheckResponse(res)
+	}
+}
+
+// uploadComposite uploads the parts of the file in parallel and composes them.
+// The parts uploaded successfully are kept on error so that the next try can skip them.
+// The job deletes them by deleteCompositeParts when it gives up.
+func (ct *CloudStorage) uploadComposite(bucket string, obj *storage.Object, r io.ReaderAt, size int64, opts *UploadOptions) error {
+	url := "gs://" + bucket + "/" + obj.Name
+	log := log.WithFields(logrus.Fields{"url": url, "size": size})
+
+	parts := compositeParts(ct.CompositeTempPrefix, obj.Name, size, ct.CompositeParts)
+	log.WithFields(logrus.Fields{"parts": len(parts)}).Debugln("Uploading by parallel composite upload")
+
+	obj.ContentType = detectContentType(obj, r)
+
+	results := make([]*storage.Object, len(parts))
+	errs := make([]error, len(parts))
+	var wg sync.WaitGroup
+	for i, part := range parts {
+		wg.Add(1)
+		go func(i int, part *compositePart) {
+			defer wg.Done()
+			results[i], errs[i] = ct.uploadPart(bucket, part, r, obj.ContentType)
+		}(i, part)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	h, err := hashSection(r, 0, size)
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Warnf("Failed to calculate hashes")
+		return err
+	}
+
+	req := &storage.ComposeRequest{Destination: obj}
+	for _, res := range results {
+		req.SourceObjects = append(req.SourceObjects, &storage.ComposeRequestSourceObjects{
+			Name:       res.Name,
+			Generation: res.Generation,
+		})
+	}
+	call := ct.service.Compose(bucket, obj.Name, req)
+	if opts.noClobber() {
+		call = call.IfGenerationMatch(0)
+	}
+	res, err := call.Do()
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Warnf("Failed to compose")
+		err = objectExistsError(url, err, opts)
+		if _, ok := err.(*ObjectExistsError); ok {
+			// The parts are never used
+			for _, part := range parts {
+				ct.Delete(bucket, part.name)
+			}
+		}
+		return err
+	}
+
+	for _, part := range parts {
+		ct.Delete(bucket, part.name)
+	}
+
+	// Composite objects have CRC32C but don't have MD5
+	err = h.Verify(url, res)
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Warnf("Failed to verify composed file")
+		ct.Delete(bucket, obj.Name)
+		return err
+	}
+	log.Debugln("Upload successfully")
+	return nil
+}
+
+func (ct *CloudStorage) uploadPart(bucket string, part *compositePart, r io.ReaderAt, contentType string) (*storage.Object, error) {
+	url := "gs://" + bucket + "/" + part.name
+	log := log.WithFields(logrus.Fields{"url": url, "offset": part.offset, "size": part.size})
+
+	h, err := hashSection(r, part.offset, part.size)
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Warnf("Failed to calculate hashes")
+		return nil, err
+	}
+
+	// Skip the part uploaded by the previous try
+	existing, err := ct.Get(bucket, part.name)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil && h.Verify(url, existing) == nil {
+		log.Debugln("Part already uploaded")
+		return existing, nil
+	}
+
+	obj := &storage.Object{Name: part.name, ContentType: contentType}
+	section := io.NewSectionReader(r, part.offset, part.size)
+	res, err := ct.service.Insert(bucket, obj).ResumableMedia(context.Background(), section, part.size, contentType).Do()
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Warnf("Failed to upload part")
+		return nil, err
+	}
+	err = h.Verify(url, res)
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Warnf("Failed to verify uploaded part")
+		ct.Delete(bucket, part.name)
+		return nil, err
+	}
+	log.Debugln("Part uploaded successfully")
+	return res, nil
+}
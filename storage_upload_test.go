@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	storage "google.golang.org/api/storage/v1"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseByteSize(t *testing.T) {
+	patterns := map[string]int64{
+		"0":     0,
+		"100":   100,
+		"100B":  100,
+		"1k":    1000,
+		"64KiB": 64 * 1024,
+		"8MiB":  8 * 1024 * 1024,
+		"10 MB": 10 * 1000 * 1000,
+		"2GiB":  2 * 1024 * 1024 * 1024,
+		" 1gb ": 1000 * 1000 * 1000,
+	}
+	for s, expected := range patterns {
+		n, err := ParseByteSize(s)
+		assert.NoError(t, err, s)
+		assert.Equal(t, expected, n, s)
+	}
+
+	for _, s := range []string{"", "-1", "1.5MB", "10XB", "MB"} {
+		_, err := ParseByteSize(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestCompositeParts(t *testing.T) {
+	parts := compositeParts("tmp/", "path/to/file", 10, 4)
+	if assert.Equal(t, 4, len(parts)) {
+		assert.Equal(t, "tmp/path/to/file.composite-part-01-of-04", parts[0].name)
+		assert.Equal(t, "tmp/path/to/file.composite-part-04-of-04", parts[3].name)
+		offsets := []int64{}
+		sizes := []int64{}
+		for _, p := range parts {
+			offsets = append(offsets, p.offset)
+			sizes = append(sizes, p.size)
+		}
+		assert.Equal(t, []int64{0, 3, 6, 9}, offsets)
+		assert.Equal(t, []int64{3, 3, 3, 1}, sizes)
+	}
+
+	// The number of parts is less than n for small files
+	parts = compositeParts("", "file", 3, 8)
+	assert.Equal(t, 3, len(parts))
+	assert.Equal(t, "file.composite-part-03-of-03", parts[2].name)
+}
+
+func TestUploadConfigSetup(t *testing.T) {
+	c := &UploadConfig{}
+	assert.Nil(t, c.setup())
+	assert.Equal(t, int64(0), c.resumableThreshold)
+	assert.Equal(t, int64(0), c.compositeThreshold)
+	assert.Equal(t, 8, c.CompositeParts)
+	assert.Equal(t, DefaultCompositeTempPrefix, c.CompositeTempPrefix)
+
+	c = &UploadConfig{ResumableThreshold: "1MiB", CompositeThreshold: "1GiB", CompositeParts: 16}
+	assert.Nil(t, c.setup())
+	assert.Equal(t, int64(1024*1024), c.resumableThreshold)
+	assert.Equal(t, int64(1024*1024*1024), c.compositeThreshold)
+
+	c = &UploadConfig{CompositeThreshold: "foo"}
+	err := c.setup()
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "composite_threshold", err.Name)
+	}
+
+	c = &UploadConfig{CompositeParts: 33}
+	err = c.setup()
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "composite_parts", err.Name)
+	}
+
+	c = &UploadConfig{CompositeTempPrefix: "/tmp/"}
+	err = c.setup()
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "composite_temp_prefix", err.Name)
+	}
+}
+
+func TestJobDeleteCompositeParts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "composite")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "big.dat")
+	assert.NoError(t, ioutil.WriteFile(src, []byte("0123456789"), 0644))
+	storage := &LocalStorage{Root: filepath.Join(dir, "storage")}
+	for _, name := range []string{
+		"tmp/out/big.dat.composite-part-01-of-02",
+		"tmp/out/big.dat.composite-part-02-of-02",
+		"tmp/out/big.dat.other",
+		"out/big.dat",
+	} {
+		assert.NoError(t, storage.Upload("bucket1", name, src))
+	}
+
+	config := &UploadConfig{CompositeThreshold: "10", CompositeTempPrefix: "tmp/"}
+	assert.Nil(t, config.setup())
+	job := &Job{uploadConfig: config, storage: storage}
+	job.deleteCompositeParts(&Target{Bucket: "bucket1", Object: "out/big.dat", LocalPath: src})
+
+	objs, err := storage.List("bucket1", "")
+	assert.NoError(t, err)
+	names := []string{}
+	for _, obj := range objs {
+		names = append(names, obj.Name)
+	}
+	assert.Equal(t, []string{"out/big.dat", "tmp/out/big.dat.other"}, names)
+}
+
+// resumableServer accepts the resumable upload like GCS.
+// It fails to receive the chunk at failAt only once.
+type resumableServer struct {
+	failAt   int64
+	mux      sync.Mutex
+	sessions int
+	received []byte
+	// ranges are Content-Range of the requests to the session
+	ranges []string
+}
+
+var chunkRangePattern = regexp.MustCompile(`\Abytes (\d+)-(\d+)/(\d+)\z`)
+
+func (s *resumableServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	switch {
+	case r.Method == http.MethodPost && r.URL.Query().Get("uploadType") == "resumable":
+		s.sessions++
+		w.Header().Set("Location", fmt.Sprintf("http://%s/session/%d", r.Host, s.sessions))
+		return
+	case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/session/"):
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	contentRange := r.Header.Get("Content-Range")
+	s.ranges = append(s.ranges, contentRange)
+	m := chunkRangePattern.FindStringSubmatch(contentRange)
+	if m != nil {
+		start, _ := strconv.ParseInt(m[1], 10, 64)
+		if start == s.failAt {
+			s.failAt = -1
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		s.received = append(s.received[:start], data...)
+		total, _ := strconv.ParseInt(m[3], 10, 64)
+		if int64(len(s.received)) == total {
+			h := NewObjectHash()
+			h.Write(s.received)
+			json.NewEncoder(w).Encode(&storage.Object{Size: uint64(total), Crc32c: h.Crc32c(), Md5Hash: h.Md5Hash()})
+			return
+		}
+	}
+	if len(s.received) > 0 {
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(s.received)-1))
+	}
+	w.WriteHeader(http.StatusPermanentRedirect)
+}
+
+func TestUploadResumableContinuesSession(t *testing.T) {
+	server := &resumableServer{failAt: 4}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	ct := &CloudStorage{
+		client:             http.DefaultClient,
+		uploadPath:         ts.URL + "/upload/storage/v1/",
+		resumableChunkSize: 4,
+	}
+	content := []byte("0123456789")
+	r := bytes.NewReader(content)
+	size := int64(len(content))
+
+	// The second chunk fails
+	err := ct.uploadResumable("bucket1", &storage.Object{Name: "file"}, "/tmp/file", r, size, nil)
+	assert.Error(t, err)
+
+	// The next try continues the same session from the committed offset
+	err = ct.uploadResumable("bucket1", &storage.Object{Name: "file"}, "/tmp/file", r, size, nil)
+	assert.NoError(t, err)
+
+	assert.Equal(t, 1, server.sessions)
+	assert.Equal(t, []string{"bytes 0-3/10", "bytes 4-7/10", "bytes */10", "bytes 4-7/10", "bytes 8-9/10"}, server.ranges)
+	assert.Equal(t, content, server.received)
+	assert.Nil(t, ct.resumableSession("gs://bucket1/file /tmp/file", size))
+}
+
+func TestUploadBasePath(t *testing.T) {
+	assert.Equal(t, "https://www.googleapis.com/upload/storage/v1/", uploadBasePath("https://www.googleapis.com/storage/v1/"))
+	assert.Equal(t, "http://localhost:4443/upload/storage/v1/", uploadBasePath("http://localhost:4443/storage/v1/"))
+}
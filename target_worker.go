@@ -2,8 +2,11 @@ package main
 
 import (
 	"fmt"
+	"net/url"
 	"time"
 
+	storage "google.golang.org/api/storage/v1"
+
 	"github.com/cenkalti/backoff"
 	"github.com/groovenauts/concurrent-go"
 	logrus "github.com/sirupsen/logrus"
@@ -28,9 +31,18 @@ type Target struct {
 	Bucket    string
 	Object    string
 	LocalPath string
+
+	// Attrs has the attributes of the object to upload like ContentType and Metadata
+	Attrs *storage.Object
+
+	// Remote is the URL to download the file which isn't on GCS
+	Remote *url.URL
 }
 
 func (t *Target) URL() string {
+	if t.Remote != nil {
+		return t.Remote.String()
+	}
 	return fmt.Sprintf("gs://%s/%s", t.Bucket, t.Object)
 }
 
@@ -38,24 +50,78 @@ type RetryableFunc struct {
 	name     string
 	maxTries int
 	interval time.Duration
+	log      *logrus.Entry
+	// onRetry is called before each retry if it's given
+	onRetry func()
+	// cancel stops the retries and the running try when it's closed
+	cancel <-chan struct{}
 }
 
+func (w *RetryableFunc) logEntry() *logrus.Entry {
+	if w.log != nil {
+		return w.log
+	}
+	return log
+}
+
+// Wrap retries orig for any error including ChecksumError until cancel is closed.
 func (w *RetryableFunc) Wrap(orig func(*concurrent.Job) error) func(*concurrent.Job) error {
 	return func(job *concurrent.Job) error {
+		tries := 0
 		f := func() error {
-			return orig(job)
+			if w.cancelled() {
+				return backoff.Permanent(&TransferCancelledError{Name: w.name})
+			}
+			tries++
+			if tries > 1 && w.onRetry != nil {
+				w.onRetry()
+			}
+			err := w.try(orig, job)
+			if e, ok := err.(*ChecksumError); ok {
+				w.logEntry().WithFields(logrus.Fields{"error": e}).Warnf("Checksum mismatch on %v. Retrying\n", w.name)
+			}
+			return err
 		}
 
 		eb := backoff.NewExponentialBackOff()
 		eb.InitialInterval = w.interval
 		b := backoff.WithMaxRetries(eb, uint64(w.maxTries))
 		// err := backoff.Retry(f, b)
-		err := RetryWithSleep(f, b)
+		err := RetryWithCancel(f, b, w.cancel)
+		if err != nil && w.cancelled() {
+			return &TransferCancelledError{Name: w.name}
+		}
 
 		return err
 	}
 }
 
+func (w *RetryableFunc) cancelled() bool {
+	select {
+	case <-w.cancel:
+		return true
+	default:
+		return false
+	}
+}
+
+// try returns TransferCancelledError as soon as cancel is closed.
+// The storage calls can't be cancelled, so the abandoned try goes on in the background
+// until it finishes or the process exits.
+func (w *RetryableFunc) try(orig func(*concurrent.Job) error, job *concurrent.Job) error {
+	if w.cancel == nil {
+		return orig(job)
+	}
+	done := make(chan error, 1)
+	go func() { done <- orig(job) }()
+	select {
+	case err := <-done:
+		return err
+	case <-w.cancel:
+		return &TransferCancelledError{Name: w.name}
+	}
+}
+
 func (w *RetryableFunc) WithLog(orig func(*concurrent.Job) error) func(*concurrent.Job) error {
 	return func(job *concurrent.Job) error {
 		t, ok := job.Payload.(*Target)
@@ -63,6 +129,8 @@ func (w *RetryableFunc) WithLog(orig func(*concurrent.Job) error) func(*concurre
 			return fmt.Errorf("Unknown Payload: %v\n", job.Payload)
 		}
 
+		log := w.logEntry()
+
 		flds := logrus.Fields{"target": t}
 		log.WithFields(flds).Debugf("Worker Start to %v\n", w.name)
 
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	logrus "github.com/sirupsen/logrus"
+)
+
+const TracerName = "github.com/groovenauts/blocks-gcs-proxy"
+
+// The keys of the message attributes for W3C Trace Context
+const (
+	TraceParentKey = "traceparent"
+	TraceStateKey  = "tracestate"
+)
+
+const (
+	tracingQueueSize     = 2048
+	tracingBatchSize     = 512
+	tracingBatchInterval = 5 * time.Second
+	tracingShutdownWait  = 10 * time.Second
+)
+
+// Tracing exports the spans of the jobs in batches.
+// Start returns nil span if it's nil.
+type Tracing struct {
+	exporter SpanExporter
+	// sampleRatio is the ratio of the sampled traces started by this process
+	sampleRatio float64
+	spans       chan *Span
+	done        chan struct{}
+	mux         sync.RWMutex
+	closed      bool
+}
+
+func NewTracing(c *TracingConfig) (*Tracing, error) {
+	exporter, err := newSpanExporter(c, map[string]interface{}{
+		"service.name":    c.ServiceName,
+		"service.version": VERSION,
+	})
+	if err != nil {
+		return nil, err
+	}
+	t := newTracingWithExporter(exporter)
+	t.sampleRatio = c.sampleRatio()
+	return t, nil
+}
+
+func newTracingWithExporter(exporter SpanExporter) *Tracing {
+	t := &Tracing{
+		exporter:    exporter,
+		sampleRatio: 1,
+		spans:       make(chan *Span, tracingQueueSize),
+		done:        make(chan struct{}),
+	}
+	go t.batch()
+	return t
+}
+
+// Start starts the span whose parent is the span context in ctx,
+// and returns the context with the span context of the new span.
+// The span follows the sampling decision of the parent, and the root span is sampled by sampleRatio.
+func (t *Tracing) Start(ctx context.Context, name string, attrs map[string]interface{}) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	if attrs == nil {
+		attrs = map[string]interface{}{}
+	}
+	parent := spanContextFrom(ctx)
+	span := &Span{
+		Name:        name,
+		Kind:        SpanKindInternal,
+		SpanContext: newSpanContext(parent, t.sampleRatio),
+		Parent:      parent,
+		StartTime:   time.Now(),
+		Attributes:  attrs,
+		tracing:     t,
+	}
+	return contextWithSpanContext(ctx, span.SpanContext), span
+}
+
+// export queues the span. The span is dropped if the queue is full or after Shutdown.
+func (t *Tracing) export(span *Span) {
+	t.mux.RLock()
+	defer t.mux.RUnlock()
+	if t.closed {
+		return
+	}
+	select {
+	case t.spans <- span:
+	default:
+		log.WithFields(logrus.Fields{"span": span.Name}).Warnln("Dropped the span because the queue is full")
+	}
+}
+
+func (t *Tracing) batch() {
+	defer close(t.done)
+	ticker := time.NewTicker(tracingBatchInterval)
+	defer ticker.Stop()
+
+	spans := []*Span{}
+	flush := func() {
+		if len(spans) == 0 {
+			return
+		}
+		if err := t.exporter.ExportSpans(spans); err != nil {
+			log.WithFields(logrus.Fields{"spans": len(spans), "error": err}).Errorln("Failed to export spans")
+		}
+		spans = []*Span{}
+	}
+	for {
+		select {
+		case span, ok := <-t.spans:
+			if !ok {
+				flush()
+				return
+			}
+			spans = append(spans, span)
+			if len(spans) >= tracingBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// Shutdown exports the remaining spans.
+func (t *Tracing) Shutdown() {
+	if t == nil {
+		return
+	}
+	t.mux.Lock()
+	if t.closed {
+		t.mux.Unlock()
+		return
+	}
+	t.closed = true
+	close(t.spans)
+	t.mux.Unlock()
+
+	select {
+	case <-t.done:
+	case <-time.After(tracingShutdownWait):
+		log.Errorln("Failed to export the remaining spans in time")
+	}
+	if err := t.exporter.Shutdown(); err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Errorln("Failed to shutdown tracing")
+	}
+}
+
+// traceContextFromAttributes returns the context with the span context given by
+// traceparent and tracestate attributes of the message.
+func traceContextFromAttributes(attrs map[string]string) context.Context {
+	sc := parseTraceParent(attrs[TraceParentKey], attrs[TraceStateKey])
+	if !sc.IsValid() {
+		return context.Background()
+	}
+	return contextWithSpanContext(context.Background(), sc)
+}
+
+// injectTraceContext sets traceparent and tracestate of the span in ctx to attrs.
+func injectTraceContext(ctx context.Context, attrs map[string]string) {
+	sc := spanContextFrom(ctx)
+	if !sc.IsValid() {
+		return
+	}
+	attrs[TraceParentKey] = sc.TraceParent()
+	if sc.TraceState != "" {
+		attrs[TraceStateKey] = sc.TraceState
+	}
+}
+
+// traceEnv returns the environment variables TRACEPARENT and TRACESTATE for the span in ctx
+// so that the command can continue the trace.
+func traceEnv(ctx context.Context) []string {
+	attrs := map[string]string{}
+	injectTraceContext(ctx, attrs)
+	keys := []string{}
+	for key := range attrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	env := []string{}
+	for _, key := range keys {
+		env = append(env, strings.ToUpper(key)+"="+attrs[key])
+	}
+	return env
+}
+
+func setSpanError(span *Span, err error) {
+	if err != nil {
+		span.SetError(err)
+	}
+}
+
+// endSpan ends the span with the error status if err isn't nil.
+func endSpan(span *Span, err error) {
+	setSpanError(span, err)
+	span.End()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+)
+
+type TracingConfig struct {
+	// Exporter is one of otlp, stdout and file. Tracing is disabled if it's empty.
+	Exporter    string `json:"exporter,omitempty"`
+	Endpoint    string `json:"endpoint,omitempty"`
+	Insecure    bool   `json:"insecure,omitempty"`
+	Path        string `json:"path,omitempty"`
+	ServiceName string `json:"service_name,omitempty"`
+	// SampleRatio is the ratio of the traces sampled for the messages without traceparent. 1.0 by default.
+	SampleRatio *float64 `json:"sample_ratio,omitempty"`
+}
+
+const (
+	TracingExporterOtlp   = "otlp"
+	TracingExporterStdout = "stdout"
+	TracingExporterFile   = "file"
+)
+
+var TracingExporters = []string{TracingExporterOtlp, TracingExporterStdout, TracingExporterFile}
+
+func (c *TracingConfig) setup() *ConfigError {
+	if c.ServiceName == "" {
+		c.ServiceName = "blocks-gcs-proxy"
+	}
+	if c.SampleRatio == nil {
+		ratio := 1.0
+		c.SampleRatio = &ratio
+	}
+	if *c.SampleRatio < 0 || *c.SampleRatio > 1 {
+		return &ConfigError{Name: "sample_ratio", Message: fmt.Sprintf("%v is invalid. It must be between 0 and 1", *c.SampleRatio)}
+	}
+	switch c.Exporter {
+	case "", TracingExporterOtlp, TracingExporterStdout:
+	case TracingExporterFile:
+		if c.Path == "" {
+			return &ConfigError{Name: "path", Message: "is required for file exporter"}
+		}
+	default:
+		return &ConfigError{Name: "exporter", Message: fmt.Sprintf("%q is invalid. It must be one of %v", c.Exporter, TracingExporters)}
+	}
+	return nil
+}
+
+// Enabled returns true if the exporter is given.
+func (c *TracingConfig) Enabled() bool {
+	return c.Exporter != ""
+}
+
+func (c *TracingConfig) sampleRatio() float64 {
+	if c.SampleRatio == nil {
+		return 1
+	}
+	return *c.SampleRatio
+}
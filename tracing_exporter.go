@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SpanExporter sends the ended spans in batches.
+type SpanExporter interface {
+	ExportSpans(spans []*Span) error
+	Shutdown() error
+}
+
+func newSpanExporter(c *TracingConfig, resource map[string]interface{}) (SpanExporter, error) {
+	switch c.Exporter {
+	case TracingExporterOtlp:
+		return &OtlpHttpExporter{
+			URL:      c.otlpURL(),
+			resource: resource,
+			client:   &http.Client{Timeout: 10 * time.Second},
+		}, nil
+	case TracingExporterFile:
+		f, err := os.OpenFile(c.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		return &WriterExporter{writer: f, closer: f, resource: resource}, nil
+	default:
+		return &WriterExporter{writer: os.Stdout, resource: resource}, nil
+	}
+}
+
+// OtlpHttpExporter sends the spans to the OTLP/HTTP receiver in JSON encoding.
+type OtlpHttpExporter struct {
+	URL      string
+	resource map[string]interface{}
+	client   *http.Client
+}
+
+func (e *OtlpHttpExporter) ExportSpans(spans []*Span) error {
+	data, err := json.Marshal(newOtlpTraceRequest(e.resource, spans))
+	if err != nil {
+		return err
+	}
+	res, err := e.client.Post(e.URL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("Failed to export %d spans to %s because of %s: %s", len(spans), e.URL, res.Status, string(body))
+	}
+	return nil
+}
+
+func (e *OtlpHttpExporter) Shutdown() error {
+	return nil
+}
+
+// WriterExporter writes each batch of the spans as a line of OTLP JSON.
+type WriterExporter struct {
+	writer   io.Writer
+	closer   io.Closer
+	resource map[string]interface{}
+}
+
+func (e *WriterExporter) ExportSpans(spans []*Span) error {
+	data, err := json.Marshal(newOtlpTraceRequest(e.resource, spans))
+	if err != nil {
+		return err
+	}
+	_, err = e.writer.Write(append(data, '\n'))
+	return err
+}
+
+func (e *WriterExporter) Shutdown() error {
+	if e.closer == nil {
+		return nil
+	}
+	return e.closer.Close()
+}
+
+// The types for ExportTraceServiceRequest in OTLP JSON encoding.
+// The IDs are hex strings and the 64 bit integers are decimal strings.
+type (
+	otlpTraceRequest struct {
+		ResourceSpans []*otlpResourceSpans `json:"resourceSpans"`
+	}
+
+	otlpResourceSpans struct {
+		Resource   *otlpResource     `json:"resource"`
+		ScopeSpans []*otlpScopeSpans `json:"scopeSpans"`
+	}
+
+	otlpResource struct {
+		Attributes []*otlpKeyValue `json:"attributes"`
+	}
+
+	otlpScopeSpans struct {
+		Scope *otlpScope  `json:"scope"`
+		Spans []*otlpSpan `json:"spans"`
+	}
+
+	otlpScope struct {
+		Name    string `json:"name"`
+		Version string `json:"version,omitempty"`
+	}
+
+	otlpSpan struct {
+		TraceID           string          `json:"traceId"`
+		SpanID            string          `json:"spanId"`
+		TraceState        string          `json:"traceState,omitempty"`
+		ParentSpanID      string          `json:"parentSpanId,omitempty"`
+		Name              string          `json:"name"`
+		Kind              SpanKind        `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []*otlpKeyValue `json:"attributes,omitempty"`
+		Events            []*otlpEvent    `json:"events,omitempty"`
+		Status            *otlpStatus     `json:"status,omitempty"`
+	}
+
+	otlpEvent struct {
+		TimeUnixNano string          `json:"timeUnixNano"`
+		Name         string          `json:"name"`
+		Attributes   []*otlpKeyValue `json:"attributes,omitempty"`
+	}
+
+	otlpStatus struct {
+		Message string `json:"message,omitempty"`
+		Code    int    `json:"code"`
+	}
+
+	otlpKeyValue struct {
+		Key   string        `json:"key"`
+		Value *otlpAnyValue `json:"value"`
+	}
+
+	otlpAnyValue struct {
+		StringValue *string         `json:"stringValue,omitempty"`
+		BoolValue   *bool           `json:"boolValue,omitempty"`
+		IntValue    *string         `json:"intValue,omitempty"`
+		ArrayValue  *otlpArrayValue `json:"arrayValue,omitempty"`
+	}
+
+	otlpArrayValue struct {
+		Values []*otlpAnyValue `json:"values"`
+	}
+)
+
+const otlpStatusCodeError = 2
+
+func newOtlpTraceRequest(resource map[string]interface{}, spans []*Span) *otlpTraceRequest {
+	otlpSpans := []*otlpSpan{}
+	for _, s := range spans {
+		otlpSpans = append(otlpSpans, newOtlpSpan(s))
+	}
+	return &otlpTraceRequest{
+		ResourceSpans: []*otlpResourceSpans{
+			{
+				Resource: &otlpResource{Attributes: otlpAttributes(resource)},
+				ScopeSpans: []*otlpScopeSpans{
+					{
+						Scope: &otlpScope{Name: TracerName, Version: VERSION},
+						Spans: otlpSpans,
+					},
+				},
+			},
+		},
+	}
+}
+
+func newOtlpSpan(s *Span) *otlpSpan {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	r := &otlpSpan{
+		TraceID:           s.SpanContext.TraceID,
+		SpanID:            s.SpanContext.SpanID,
+		TraceState:        s.SpanContext.TraceState,
+		Name:              s.Name,
+		Kind:              s.Kind,
+		StartTimeUnixNano: strconv.FormatInt(s.StartTime.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.EndTime.UnixNano(), 10),
+		Attributes:        otlpAttributes(s.Attributes),
+	}
+	if s.Parent.IsValid() {
+		r.ParentSpanID = s.Parent.SpanID
+	}
+	if s.Err != nil {
+		msg := s.Err.Error()
+		r.Status = &otlpStatus{Code: otlpStatusCodeError, Message: msg}
+		r.Events = []*otlpEvent{
+			{
+				TimeUnixNano: r.EndTimeUnixNano,
+				Name:         "exception",
+				Attributes: otlpAttributes(map[string]interface{}{
+					"exception.type":    fmt.Sprintf("%T", s.Err),
+					"exception.message": msg,
+				}),
+			},
+		}
+	}
+	return r
+}
+
+// otlpAttributes returns the attributes sorted by the keys.
+func otlpAttributes(attrs map[string]interface{}) []*otlpKeyValue {
+	keys := []string{}
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	r := []*otlpKeyValue{}
+	for _, k := range keys {
+		r = append(r, &otlpKeyValue{Key: k, Value: otlpValue(attrs[k])})
+	}
+	return r
+}
+
+func otlpValue(v interface{}) *otlpAnyValue {
+	switch val := v.(type) {
+	case string:
+		return &otlpAnyValue{StringValue: &val}
+	case bool:
+		return &otlpAnyValue{BoolValue: &val}
+	case int:
+		s := strconv.Itoa(val)
+		return &otlpAnyValue{IntValue: &s}
+	case int64:
+		s := strconv.FormatInt(val, 10)
+		return &otlpAnyValue{IntValue: &s}
+	case []string:
+		values := []*otlpAnyValue{}
+		for _, s := range val {
+			values = append(values, otlpValue(s))
+		}
+		return &otlpAnyValue{ArrayValue: &otlpArrayValue{Values: values}}
+	default:
+		s := fmt.Sprintf("%v", val)
+		return &otlpAnyValue{StringValue: &s}
+	}
+}
+
+// otlpURL returns the URL of OTLP/HTTP receiver to send the spans to.
+func (c *TracingConfig) otlpURL() string {
+	if c.Endpoint == "" {
+		if base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); base != "" {
+			return strings.TrimRight(base, "/") + "/v1/traces"
+		}
+	}
+	endpoint := c.Endpoint
+	if endpoint == "" {
+		endpoint = "localhost:4318"
+	}
+	scheme := "https"
+	if c.Insecure {
+		scheme = "http"
+	}
+	return scheme + "://" + endpoint + "/v1/traces"
+}
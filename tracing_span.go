@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// SpanContext identifies the span in W3C Trace Context.
+type SpanContext struct {
+	// TraceID is 32 lowercase hex digits
+	TraceID string
+	// SpanID is 16 lowercase hex digits
+	SpanID     string
+	Sampled    bool
+	TraceState string
+}
+
+const (
+	invalidTraceID = "00000000000000000000000000000000"
+	invalidSpanID  = "0000000000000000"
+)
+
+// The version ff is invalid and the future versions can have more fields after the flags.
+var traceParentPattern = regexp.MustCompile(`\A([0-9a-f]{2})-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})(-.*)?\z`)
+
+// parseTraceParent returns the span context given by traceparent and tracestate.
+// It returns the invalid span context if traceparent is invalid.
+func parseTraceParent(traceParent, traceState string) SpanContext {
+	m := traceParentPattern.FindStringSubmatch(strings.TrimSpace(traceParent))
+	if m == nil || m[1] == "ff" || (m[1] == "00" && m[5] != "") {
+		return SpanContext{}
+	}
+	flags, err := hex.DecodeString(m[4])
+	if err != nil {
+		return SpanContext{}
+	}
+	return SpanContext{
+		TraceID:    m[2],
+		SpanID:     m[3],
+		Sampled:    flags[0]&1 == 1,
+		TraceState: strings.TrimSpace(traceState),
+	}
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != "" && sc.TraceID != invalidTraceID && sc.SpanID != "" && sc.SpanID != invalidSpanID
+}
+
+// TraceParent returns the value of traceparent in the version 00.
+func (sc SpanContext) TraceParent() string {
+	flags := 0
+	if sc.Sampled {
+		flags = 1
+	}
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, flags)
+}
+
+type spanContextKey struct{}
+
+func contextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+// spanContextFrom returns the span context in ctx or the invalid span context.
+func spanContextFrom(ctx context.Context) SpanContext {
+	if sc, ok := ctx.Value(spanContextKey{}).(SpanContext); ok {
+		return sc
+	}
+	return SpanContext{}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// newSpanContext makes the child of parent, or the root span context sampled by ratio if parent isn't valid.
+func newSpanContext(parent SpanContext, ratio float64) SpanContext {
+	if !parent.IsValid() {
+		traceID := randomHex(16)
+		return SpanContext{TraceID: traceID, SpanID: randomHex(8), Sampled: sampleTraceID(traceID, ratio)}
+	}
+	return SpanContext{
+		TraceID:    parent.TraceID,
+		SpanID:     randomHex(8),
+		Sampled:    parent.Sampled,
+		TraceState: parent.TraceState,
+	}
+}
+
+// sampleTraceID returns true for the ratio of trace IDs in the same way as TraceIDRatioBased sampler of OpenTelemetry.
+func sampleTraceID(traceID string, ratio float64) bool {
+	if ratio >= 1 {
+		return true
+	}
+	if ratio <= 0 || len(traceID) != 32 {
+		return false
+	}
+	n, err := strconv.ParseUint(traceID[16:], 16, 64)
+	if err != nil {
+		return false
+	}
+	return n>>1 < uint64(ratio*(1<<63))
+}
+
+// SpanKind is the kind of the span in OTLP.
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindConsumer SpanKind = 5
+)
+
+// Span is the span of the job, the step, the transfer or the command.
+// The methods do nothing if it's nil so that the job runs without tracing.
+type Span struct {
+	Name        string
+	Kind        SpanKind
+	SpanContext SpanContext
+	Parent      SpanContext
+	StartTime   time.Time
+	EndTime     time.Time
+	Attributes  map[string]interface{}
+	// Err is the error which makes the status of the span error
+	Err error
+
+	tracing *Tracing
+	mux     sync.Mutex
+	ended   bool
+}
+
+// SetAttribute sets the attribute whose value is string, []string, bool, int or int64.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.Attributes[key] = value
+}
+
+func (s *Span) SetError(err error) {
+	if s == nil {
+		return
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.Err = err
+}
+
+// End exports the span only once if it's sampled.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mux.Lock()
+	if s.ended {
+		s.mux.Unlock()
+		return
+	}
+	s.ended = true
+	s.EndTime = time.Now()
+	s.mux.Unlock()
+	if s.SpanContext.Sampled {
+		s.tracing.export(s)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testTraceId     = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testParentId    = "00f067aa0ba902b7"
+	testTraceParent = "00-" + testTraceId + "-" + testParentId + "-01"
+)
+
+func TestTracingConfig(t *testing.T) {
+	c := &TracingConfig{}
+	assert.Nil(t, c.setup())
+	assert.False(t, c.Enabled())
+	assert.Equal(t, "blocks-gcs-proxy", c.ServiceName)
+	assert.Equal(t, 1.0, c.sampleRatio())
+
+	c = &TracingConfig{Exporter: "file"}
+	assert.NotNil(t, c.setup())
+
+	for _, ratio := range []float64{-0.1, 1.5} {
+		r := ratio
+		c = &TracingConfig{SampleRatio: &r}
+		assert.NotNil(t, c.setup())
+	}
+
+	c = &TracingConfig{Exporter: "zipkin"}
+	assert.NotNil(t, c.setup())
+}
+
+func TestTraceContextPropagation(t *testing.T) {
+	ctx := traceContextFromAttributes(map[string]string{TraceParentKey: testTraceParent, TraceStateKey: "foo=bar"})
+	assert.Equal(t, []string{"TRACEPARENT=" + testTraceParent, "TRACESTATE=foo=bar"}, traceEnv(ctx))
+
+	ctx = traceContextFromAttributes(map[string]string{})
+	assert.Equal(t, []string{}, traceEnv(ctx))
+
+	// Invalid traceparent is ignored
+	for _, tp := range []string{"00-" + invalidTraceID + "-" + testParentId + "-01", "ff-" + testTraceId + "-" + testParentId + "-01", "00-" + testTraceId + "-01"} {
+		ctx = traceContextFromAttributes(map[string]string{TraceParentKey: tp})
+		assert.Equal(t, []string{}, traceEnv(ctx), "traceparent %s", tp)
+	}
+
+	var tracing *Tracing
+	tracing.Shutdown()
+	_, span := tracing.Start(ctx, "noop", nil)
+	assert.Nil(t, span)
+	span.SetAttribute("foo", "bar")
+	span.End()
+}
+
+// recordingExporter keeps the exported spans.
+type recordingExporter struct {
+	spans []*Span
+	mux   sync.Mutex
+}
+
+func (e *recordingExporter) ExportSpans(spans []*Span) error {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func (e *recordingExporter) Shutdown() error {
+	return nil
+}
+
+func TestTracingSampled(t *testing.T) {
+	exporter := &recordingExporter{}
+	tracing := newTracingWithExporter(exporter)
+
+	ctx, parent := tracing.Start(traceContextFromAttributes(map[string]string{}), "parent", nil)
+	_, child := tracing.Start(ctx, "child", map[string]interface{}{"foo": "bar"})
+	child.End()
+	child.End()
+	parent.End()
+
+	// Not sampled by the caller
+	unsampled := "00-" + testTraceId + "-" + testParentId + "-00"
+	ctx, span := tracing.Start(traceContextFromAttributes(map[string]string{TraceParentKey: unsampled}), "unsampled", nil)
+	assert.Equal(t, []string{"TRACEPARENT=00-" + testTraceId + "-" + span.SpanContext.SpanID + "-00"}, traceEnv(ctx))
+	span.End()
+	tracing.Shutdown()
+
+	if assert.Equal(t, 2, len(exporter.spans)) {
+		assert.Equal(t, "child", exporter.spans[0].Name)
+		assert.Equal(t, "parent", exporter.spans[1].Name)
+		assert.Equal(t, parent.SpanContext.TraceID, child.SpanContext.TraceID)
+		assert.Equal(t, parent.SpanContext.SpanID, child.Parent.SpanID)
+		assert.False(t, parent.Parent.IsValid())
+	}
+}
+
+func TestTracingSampleRatio(t *testing.T) {
+	exporter := &recordingExporter{}
+	tracing := newTracingWithExporter(exporter)
+	tracing.sampleRatio = 0
+
+	// The root span isn't sampled
+	ctx, root := tracing.Start(traceContextFromAttributes(map[string]string{}), "root", nil)
+	assert.False(t, root.SpanContext.Sampled)
+	_, child := tracing.Start(ctx, "child", nil)
+	assert.False(t, child.SpanContext.Sampled)
+	child.End()
+	root.End()
+
+	// The sampling decision of the caller is used
+	_, span := tracing.Start(traceContextFromAttributes(map[string]string{TraceParentKey: testTraceParent}), "sampled", nil)
+	assert.True(t, span.SpanContext.Sampled)
+	span.End()
+	tracing.Shutdown()
+
+	if assert.Equal(t, 1, len(exporter.spans)) {
+		assert.Equal(t, "sampled", exporter.spans[0].Name)
+	}
+
+	assert.True(t, sampleTraceID(testTraceId, 1))
+	assert.False(t, sampleTraceID(testTraceId, 0))
+	assert.True(t, sampleTraceID("00000000000000000000000000000000", 0.5))
+	assert.False(t, sampleTraceID("0000000000000000ffffffffffffffff", 0.5))
+}
+
+func TestTracingOtlpExporter(t *testing.T) {
+	requests := []map[string]interface{}{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/traces", r.URL.Path)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		req := map[string]interface{}{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		requests = append(requests, req)
+	}))
+	defer server.Close()
+
+	c := &TracingConfig{Exporter: TracingExporterOtlp, Endpoint: strings.TrimPrefix(server.URL, "http://"), Insecure: true}
+	assert.Nil(t, c.setup())
+	tracing, err := NewTracing(c)
+	assert.NoError(t, err)
+	ctx := traceContextFromAttributes(map[string]string{TraceParentKey: testTraceParent})
+	_, span := tracing.Start(ctx, "span1", map[string]interface{}{"args": []string{"a", "b"}, "size": int64(3)})
+	endSpan(span, &InvalidJobError{msg: "broken"})
+	tracing.Shutdown()
+
+	if assert.Equal(t, 1, len(requests)) {
+		data, err := json.Marshal(requests[0])
+		assert.NoError(t, err)
+		s := string(data)
+		assert.Contains(t, s, `"traceId":"`+testTraceId+`"`)
+		assert.Contains(t, s, `"parentSpanId":"`+testParentId+`"`)
+		assert.Contains(t, s, `"name":"span1"`)
+		assert.Contains(t, s, `{"key":"size","value":{"intValue":"3"}}`)
+		assert.Contains(t, s, `"status":{"code":2,"message":"broken"}`)
+		assert.Contains(t, s, `{"key":"service.name","value":{"stringValue":"blocks-gcs-proxy"}}`)
+	}
+}
+
+func TestTracingConfigOtlpURL(t *testing.T) {
+	c := &TracingConfig{Endpoint: "collector:4318"}
+	assert.Equal(t, "https://collector:4318/v1/traces", c.otlpURL())
+	c.Insecure = true
+	assert.Equal(t, "http://collector:4318/v1/traces", c.otlpURL())
+}
+
+func TestTracingFileExporter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tracing")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := &TracingConfig{Exporter: TracingExporterFile, Path: filepath.Join(dir, "spans.json")}
+	assert.Nil(t, c.setup())
+	tracing, err := NewTracing(c)
+	assert.NoError(t, err)
+	_, span := tracing.Start(traceContextFromAttributes(map[string]string{}), "span1", nil)
+	span.End()
+	tracing.Shutdown()
+
+	data, err := ioutil.ReadFile(c.Path)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"name":"span1"`)
+	assert.Contains(t, string(data), `"stringValue":"blocks-gcs-proxy"`)
+}
+
+func TestProcessRunWithTracing(t *testing.T) {
+	tp := newTestProcess(t, "mkdir -p $1/bucket1 && echo $TRACEPARENT > $1/bucket1/traceparent.txt\n",
+		[]string{"%{uploads_dir}", "%{download_files.0}"}, nil)
+	defer tp.close()
+	// The spans are kept after the process shuts down the tracing
+	exporter := &recordingExporter{}
+	tp.p.tracing = newTracingWithExporter(exporter)
+
+	tp.add("msg1", map[string]string{
+		"download_files": `["gs://bucket1/in.txt"]`,
+		TraceParentKey:   testTraceParent,
+	})
+	tp.run(nil)
+
+	spans := map[string]*Span{}
+	for _, s := range exporter.spans {
+		spans[s.Name] = s
+	}
+	for _, name := range []string{"Job.run", "INITIALIZING", "DOWNLOADING", "EXECUTING", "UPLOADING", "ACKSENDING", "CLEANUP", "download", "command", "upload"} {
+		s, ok := spans[name]
+		if assert.True(t, ok, "span %s", name) {
+			assert.Equal(t, testTraceId, s.SpanContext.TraceID, "span %s", name)
+			assert.NoError(t, s.Err, "span %s", name)
+		}
+	}
+	run := spans["Job.run"]
+	assert.Equal(t, testParentId, run.Parent.SpanID)
+	assert.Equal(t, SpanKindConsumer, run.Kind)
+	for _, name := range []string{"INITIALIZING", "DOWNLOADING", "EXECUTING", "UPLOADING", "ACKSENDING", "CLEANUP"} {
+		assert.Equal(t, run.SpanContext.SpanID, spans[name].Parent.SpanID, "span %s", name)
+	}
+	assert.Equal(t, spans["DOWNLOADING"].SpanContext.SpanID, spans["download"].Parent.SpanID)
+	assert.Equal(t, spans["EXECUTING"].SpanContext.SpanID, spans["command"].Parent.SpanID)
+	assert.Equal(t, spans["UPLOADING"].SpanContext.SpanID, spans["upload"].Parent.SpanID)
+
+	// The command continues the trace from its span
+	data, err := ioutil.ReadFile(filepath.Join(tp.root, "bucket1", "traceparent.txt"))
+	assert.NoError(t, err)
+	command := spans["command"].SpanContext
+	assert.Equal(t, "00-"+testTraceId+"-"+command.SpanID+"-01", strings.TrimSpace(string(data)))
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/groovenauts/blocks-variable"
+
+	storage "google.golang.org/api/storage/v1"
+)
+
+// UploadAttributes sets the attributes of the objects uploaded from the files which match Pattern.
+// The values can use the same variables as UploadDestination.
+type UploadAttributes struct {
+	Pattern         string            `json:"pattern,omitempty"`
+	ContentType     string            `json:"content_type,omitempty"`
+	CacheControl    string            `json:"cache_control,omitempty"`
+	ContentEncoding string            `json:"content_encoding,omitempty"`
+	Metadata        map[string]string `json:"metadata,omitempty"`
+}
+
+func (a *UploadAttributes) setup() *ConfigError {
+	if a.Pattern == "" {
+		a.Pattern = "**"
+	}
+	if _, err := path.Match(strings.Replace(a.Pattern, "**", "*", -1), ""); err != nil {
+		return &ConfigError{Name: "pattern", Message: fmt.Sprintf("%q is invalid: %v", a.Pattern, err)}
+	}
+	return nil
+}
+
+// Match returns true if relPath matches Pattern in the same way as UploadDestination.
+func (a *UploadAttributes) Match(relPath string) bool {
+	return matchPathSegments(strings.Split(a.Pattern, "/"), strings.Split(relPath, "/"))
+}
+
+// Apply overwrites the attributes of obj with the ones given.
+func (a *UploadAttributes) Apply(v *bvariable.Variable, obj *storage.Object) error {
+	fields := []struct {
+		src  string
+		dest *string
+	}{
+		{a.ContentType, &obj.ContentType},
+		{a.CacheControl, &obj.CacheControl},
+		{a.ContentEncoding, &obj.ContentEncoding},
+	}
+	for _, f := range fields {
+		if f.src == "" {
+			continue
+		}
+		val, err := v.Expand(f.src)
+		if err != nil {
+			return err
+		}
+		*f.dest = val
+	}
+	for key, src := range a.Metadata {
+		val, err := v.Expand(src)
+		if err != nil {
+			return err
+		}
+		if obj.Metadata == nil {
+			obj.Metadata = map[string]string{}
+		}
+		obj.Metadata[key] = val
+	}
+	return nil
+}
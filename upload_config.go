@@ -1,13 +1,109 @@
 package main
 
+import (
+	"fmt"
+	"strings"
+)
+
 type UploadConfig struct {
-	Worker           *WorkerConfig `json:"worker,omitempty"`
-	ContentTypeByExt bool          `json:"content_type_by_ext,omitempty"`
+	Worker             *WorkerConfig `json:"worker,omitempty"`
+	ContentTypeByExt   bool          `json:"content_type_by_ext,omitempty"`
+	ResumableThreshold string        `json:"resumable_threshold,omitempty"`
+	CompositeThreshold string        `json:"composite_threshold,omitempty"`
+	CompositeParts     int           `json:"composite_parts,omitempty"`
+	// CompositeTempPrefix is the prefix of the names of the parts for parallel composite upload
+	CompositeTempPrefix string `json:"composite_temp_prefix,omitempty"`
+	Mode                string `json:"mode,omitempty"`
+
+	Destinations []*UploadDestination `json:"destinations,omitempty"`
+	Attributes   []*UploadAttributes  `json:"attributes,omitempty"`
+
+	// Manifest is the template of gs://bucket/object to upload the JSON manifest of the job to
+	Manifest string `json:"manifest,omitempty"`
+
+	resumableThreshold int64
+	compositeThreshold int64
 }
 
+const (
+	// GCS can compose up to 32 objects at once
+	MaxCompositeParts = 32
+
+	DefaultCompositeTempPrefix = ".blocks-gcs-proxy/composite-parts/"
+
+	UploadModeOverwrite  = "overwrite"
+	UploadModeSkipIfSame = "skip_if_same"
+	UploadModeNoClobber  = "no_clobber"
+)
+
+var UploadModes = []string{UploadModeOverwrite, UploadModeSkipIfSame, UploadModeNoClobber}
+
 func (c *UploadConfig) setup() *ConfigError {
 	if c.Worker == nil {
 		c.Worker = &WorkerConfig{}
 	}
+	if c.CompositeParts == 0 {
+		c.CompositeParts = 8
+	}
+	if c.CompositeTempPrefix == "" {
+		c.CompositeTempPrefix = DefaultCompositeTempPrefix
+	}
+	switch c.Mode {
+	case "":
+		c.Mode = UploadModeOverwrite
+	case UploadModeOverwrite, UploadModeSkipIfSame, UploadModeNoClobber:
+	default:
+		return &ConfigError{Name: "mode", Message: fmt.Sprintf("%q is invalid. It must be one of %v", c.Mode, UploadModes)}
+	}
+	var err error
+	if c.ResumableThreshold != "" {
+		c.resumableThreshold, err = ParseByteSize(c.ResumableThreshold)
+		if err != nil {
+			return &ConfigError{Name: "resumable_threshold", Message: err.Error()}
+		}
+	}
+	if c.CompositeThreshold != "" {
+		c.compositeThreshold, err = ParseByteSize(c.CompositeThreshold)
+		if err != nil {
+			return &ConfigError{Name: "composite_threshold", Message: err.Error()}
+		}
+	}
+	if c.CompositeParts < 2 || c.CompositeParts > MaxCompositeParts {
+		return &ConfigError{Name: "composite_parts", Message: fmt.Sprintf("%d is invalid. It must be between 2 and %d", c.CompositeParts, MaxCompositeParts)}
+	}
+	if strings.HasPrefix(c.CompositeTempPrefix, "/") {
+		return &ConfigError{Name: "composite_temp_prefix", Message: fmt.Sprintf("%q must not start with /", c.CompositeTempPrefix)}
+	}
+	if c.Manifest != "" && !strings.HasPrefix(c.Manifest, "gs://") {
+		return &ConfigError{Name: "manifest", Message: fmt.Sprintf("%q must start with gs://", c.Manifest)}
+	}
+	for _, d := range c.Destinations {
+		if err := d.setup(); err != nil {
+			err.Add("destinations")
+			return err
+		}
+	}
+	for _, a := range c.Attributes {
+		if err := a.setup(); err != nil {
+			err.Add("attributes")
+			return err
+		}
+	}
 	return c.Worker.setup()
 }
+
+const (
+	UploadUploaded        = "uploaded"
+	UploadSkippedSame     = "skipped_same"
+	UploadSkippedExisting = "skipped_existing"
+)
+
+// UploadResult is what was done for the file to upload to URL.
+// The size and hashes of the local file are set only if the manifest is uploaded.
+type UploadResult struct {
+	URL     string `json:"url"`
+	Result  string `json:"result"`
+	Size    uint64 `json:"size"`
+	Md5Hash string `json:"md5_hash,omitempty"`
+	Crc32c  string `json:"crc32c,omitempty"`
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/groovenauts/blocks-variable"
+)
+
+// UploadDestination maps the files under uploads_dir which match Pattern to Destination.
+// Pattern is matched with the path relative to uploads_dir separated by `/`.
+// Destination is a template of gs://bucket/object which can use the variables
+// for the command and `file.path`, `file.dir` and `file.name`.
+// The path of the file is appended to Destination if it ends with `/`.
+type UploadDestination struct {
+	Pattern     string `json:"pattern"`
+	Destination string `json:"destination"`
+}
+
+func (d *UploadDestination) setup() *ConfigError {
+	if d.Pattern == "" {
+		return &ConfigError{Name: "pattern", Message: "is required"}
+	}
+	if _, err := path.Match(strings.Replace(d.Pattern, "**", "*", -1), ""); err != nil {
+		return &ConfigError{Name: "pattern", Message: fmt.Sprintf("%q is invalid: %v", d.Pattern, err)}
+	}
+	if !strings.HasPrefix(d.Destination, "gs://") {
+		return &ConfigError{Name: "destination", Message: fmt.Sprintf("%q must start with gs://", d.Destination)}
+	}
+	return nil
+}
+
+// Match returns true if relPath matches Pattern.
+// `**` matches any number of directories including none.
+func (d *UploadDestination) Match(relPath string) bool {
+	return matchPathSegments(strings.Split(d.Pattern, "/"), strings.Split(relPath, "/"))
+}
+
+func matchPathSegments(patterns, segments []string) bool {
+	if len(patterns) == 0 {
+		return len(segments) == 0
+	}
+	if patterns[0] == "**" {
+		for i := 0; i <= len(segments); i++ {
+			if matchPathSegments(patterns[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segments) == 0 {
+		return false
+	}
+	ok, err := path.Match(patterns[0], segments[0])
+	if err != nil || !ok {
+		return false
+	}
+	return matchPathSegments(patterns[1:], segments[1:])
+}
+
+// uploadFileVariable returns the copy of v with `file.path`, `file.dir` and `file.name`
+// of the file at relPath under uploads_dir.
+func uploadFileVariable(v *bvariable.Variable, relPath string) *bvariable.Variable {
+	dir := path.Dir(relPath)
+	if dir == "." {
+		dir = ""
+	}
+	data := map[string]interface{}{}
+	for key, val := range v.Data {
+		data[key] = val
+	}
+	data["file"] = map[string]interface{}{
+		"path": relPath,
+		"dir":  dir,
+		"name": path.Base(relPath),
+	}
+	return &bvariable.Variable{Data: data, Separator: v.Separator}
+}
+
+// Target returns the Target to upload the file at localPath to.
+// v must be the variable returned by uploadFileVariable.
+func (d *UploadDestination) Target(v *bvariable.Variable, relPath, localPath string) (*Target, error) {
+	dest, err := v.Expand(d.Destination)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(dest, "/") {
+		dest = dest + relPath
+	}
+	u, err := url.Parse(dest)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "gs" || u.Host == "" || len(u.Path) < 2 {
+		return nil, fmt.Errorf("Invalid upload destination %q for %s", dest, relPath)
+	}
+	return &Target{
+		Bucket:    u.Host,
+		Object:    u.Path[1:],
+		LocalPath: localPath,
+	}, nil
+}
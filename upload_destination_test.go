@@ -0,0 +1,167 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	pubsub "google.golang.org/api/pubsub/v1"
+)
+
+func TestUploadDestinationMatch(t *testing.T) {
+	type pattern struct {
+		pattern string
+		path    string
+		result  bool
+	}
+	patterns := []pattern{
+		{"*.csv", "a.csv", true},
+		{"*.csv", "dir/a.csv", false},
+		{"*/*.csv", "dir/a.csv", true},
+		{"**/*.csv", "a.csv", true},
+		{"**/*.csv", "dir/sub/a.csv", true},
+		{"**/*.csv", "dir/sub/a.txt", false},
+		{"logs/**", "logs/2018/01/a.log", true},
+		{"logs/**", "other/a.log", false},
+		{"**", "any/path/to/file", true},
+	}
+	for _, ptn := range patterns {
+		d := &UploadDestination{Pattern: ptn.pattern, Destination: "gs://bucket1/"}
+		assert.Equal(t, ptn.result, d.Match(ptn.path), "pattern %q path %q", ptn.pattern, ptn.path)
+	}
+}
+
+func TestUploadDestinationSetup(t *testing.T) {
+	assert.Nil(t, (&UploadDestination{Pattern: "**/*.csv", Destination: "gs://bucket1/"}).setup())
+	assert.NotNil(t, (&UploadDestination{Pattern: "", Destination: "gs://bucket1/"}).setup())
+	assert.NotNil(t, (&UploadDestination{Pattern: "[", Destination: "gs://bucket1/"}).setup())
+	assert.NotNil(t, (&UploadDestination{Pattern: "*", Destination: "/tmp/foo"}).setup())
+
+	c := &UploadConfig{
+		Destinations: []*UploadDestination{{Pattern: "*", Destination: "bucket1"}},
+	}
+	err := c.setup()
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "destinations")
+	}
+}
+
+func TestJobUploadFilesWithDestinations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload_destinations")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	uploads_dir := filepath.Join(dir, "uploads")
+	files := map[string]string{
+		"result.csv":             "csv",
+		"logs/2018/app.log":      "log",
+		"bucket3/path/to/legacy": "legacy",
+	}
+	for name, content := range files {
+		p := filepath.Join(uploads_dir, name)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(p), 0700))
+		assert.NoError(t, ioutil.WriteFile(p, []byte(content), 0644))
+	}
+
+	config := &UploadConfig{
+		Destinations: []*UploadDestination{
+			{Pattern: "*.csv", Destination: "gs://%{attrs.bucket}/results/%{attrs.run}/%{file.name}"},
+			{Pattern: "logs/**", Destination: "gs://bucket2/%{attrs.run}/"},
+		},
+	}
+	assert.Nil(t, config.setup())
+
+	storage := &LocalStorage{Root: filepath.Join(dir, "storage")}
+	job := &Job{
+		message: &JobMessage{
+			raw: &pubsub.ReceivedMessage{
+				Message: &pubsub.PubsubMessage{
+					Attributes: map[string]string{"bucket": "bucket1", "run": "run-42"},
+				},
+			},
+		},
+		uploads_dir:  uploads_dir,
+		uploadConfig: config,
+		storage:      storage,
+	}
+	assert.NoError(t, job.uploadFiles())
+
+	expected := map[string]string{
+		"bucket1/results/run-42/result.csv": "csv",
+		"bucket2/run-42/logs/2018/app.log":  "log",
+		"bucket3/path/to/legacy":            "legacy",
+	}
+	for name, content := range expected {
+		data, err := ioutil.ReadFile(filepath.Join(dir, "storage", name))
+		if assert.NoError(t, err, name) {
+			assert.Equal(t, content, string(data))
+		}
+	}
+
+	// Unknown attribute makes the job invalid
+	job.message.raw.Message.Attributes = map[string]string{"run": "run-43"}
+	err = job.uploadFiles()
+	assert.Error(t, err)
+}
+
+func TestJobUploadFilesWithAttributes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload_attributes")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	uploads_dir := filepath.Join(dir, "uploads")
+	for _, name := range []string{"bucket1/result.dat", "bucket1/logs/app.log"} {
+		p := filepath.Join(uploads_dir, name)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(p), 0700))
+		assert.NoError(t, ioutil.WriteFile(p, []byte(name), 0644))
+	}
+
+	config := &UploadConfig{
+		Attributes: []*UploadAttributes{
+			{
+				CacheControl: "no-cache",
+				Metadata: map[string]string{
+					"job-id":    "%{attrs.job_id}",
+					"exec-uuid": "%{exec_uuid}",
+				},
+			},
+			{Pattern: "**/*.dat", ContentType: "application/x-result"},
+			{Pattern: "bucket1/logs/*", ContentEncoding: "identity", Metadata: map[string]string{"source": "%{file.name}"}},
+		},
+	}
+	assert.Nil(t, config.setup())
+
+	storage := &LocalStorage{Root: filepath.Join(dir, "storage")}
+	job := &Job{
+		message: &JobMessage{
+			raw: &pubsub.ReceivedMessage{
+				Message: &pubsub.PubsubMessage{
+					Attributes: map[string]string{"job_id": "job-1"},
+					MessageId:  "msg-1",
+				},
+			},
+		},
+		execUUID:     "uuid-1",
+		uploads_dir:  uploads_dir,
+		uploadConfig: config,
+		storage:      storage,
+	}
+	assert.NoError(t, job.uploadFiles())
+
+	obj, err := storage.Get("bucket1", "result.dat")
+	if assert.NoError(t, err) && assert.NotNil(t, obj) {
+		assert.Equal(t, "application/x-result", obj.ContentType)
+		assert.Equal(t, "no-cache", obj.CacheControl)
+		assert.Equal(t, map[string]string{"job-id": "job-1", "exec-uuid": "uuid-1"}, obj.Metadata)
+	}
+
+	obj, err = storage.Get("bucket1", "logs/app.log")
+	if assert.NoError(t, err) && assert.NotNil(t, obj) {
+		assert.Equal(t, "", obj.ContentType)
+		assert.Equal(t, "identity", obj.ContentEncoding)
+		assert.Equal(t, map[string]string{"job-id": "job-1", "exec-uuid": "uuid-1", "source": "app.log"}, obj.Metadata)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	logrus "github.com/sirupsen/logrus"
+)
+
+func TestUploadConfigMode(t *testing.T) {
+	c := &UploadConfig{}
+	assert.Nil(t, c.setup())
+	assert.Equal(t, UploadModeOverwrite, c.Mode)
+
+	c = &UploadConfig{Mode: "unknown"}
+	assert.NotNil(t, c.setup())
+}
+
+func TestJobUploadFilesWithMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload_mode")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	uploads_dir := filepath.Join(dir, "uploads")
+	src := filepath.Join(uploads_dir, "bucket1", "result.txt")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(src), 0700))
+	assert.NoError(t, ioutil.WriteFile(src, []byte("new result"), 0644))
+
+	root := filepath.Join(dir, "storage")
+	setupExisting := func(content string) {
+		p := filepath.Join(dir, "existing.txt")
+		assert.NoError(t, ioutil.WriteFile(p, []byte(content), 0644))
+		assert.NoError(t, (&LocalStorage{Root: root}).Upload("bucket1", "result.txt", p))
+	}
+	read := func() string {
+		data, err := ioutil.ReadFile(filepath.Join(root, "bucket1", "result.txt"))
+		assert.NoError(t, err)
+		return string(data)
+	}
+
+	type pattern struct {
+		mode     string
+		existing string
+		result   string
+		content  string
+	}
+	patterns := []pattern{
+		{UploadModeOverwrite, "old result", UploadUploaded, "new result"},
+		{UploadModeSkipIfSame, "new result", UploadSkippedSame, "new result"},
+		{UploadModeSkipIfSame, "old result", UploadUploaded, "new result"},
+		{UploadModeNoClobber, "old result", UploadSkippedExisting, "old result"},
+	}
+	for _, ptn := range patterns {
+		setupExisting(ptn.existing)
+		config := &UploadConfig{Mode: ptn.mode}
+		assert.Nil(t, config.setup())
+		job := &Job{
+			uploads_dir:  uploads_dir,
+			uploadConfig: config,
+			storage:      &LocalStorage{Root: root},
+		}
+		summary, detail, err := job.uploadFilesWithSummary()
+		assert.NoError(t, err)
+		assert.Equal(t, "1", summary["upload."+ptn.result], "mode %v", ptn.mode)
+		assert.Equal(t, ptn.result+" gs://bucket1/result.txt", detail)
+		assert.Equal(t, ptn.content, read(), "mode %v", ptn.mode)
+	}
+}
+
+func TestProgressNotificationWrapWithSummary(t *testing.T) {
+	publisher := DummyPublisher{}
+	notification := ProgressNotification{
+		config:    &ProgressNotificationConfig{Topic: DummyTopic},
+		publisher: &publisher,
+		logLevel:  logrus.DebugLevel,
+	}
+	f := func() (map[string]string, string, error) {
+		return map[string]string{"upload.uploaded": "1"}, "uploaded gs://bucket1/result.txt", nil
+	}
+	err := notification.wrapWithSummary(DummyJobID, UPLOADING, map[string]string{"foo": "bar"}, f)()
+	assert.NoError(t, err)
+	if assert.Equal(t, 2, len(publisher.Invocations)) {
+		msg := publisher.Invocations[1].Message
+		assert.Equal(t, "SUCCESS", msg.Attributes["step_status"])
+		assert.Equal(t, "1", msg.Attributes["upload.uploaded"])
+		assert.Equal(t, "bar", msg.Attributes["foo"])
+		data, err := base64.StdEncoding.DecodeString(msg.Data)
+		assert.NoError(t, err)
+		assert.Equal(t, "UPLOADING SUCCESS\nuploaded gs://bucket1/result.txt", string(data))
+	}
+}